@@ -0,0 +1,566 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1beta1"
+	"github.com/monimesl/bookkeeper-operator/internal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUnavailableAnnotation keeps a percentage based v1beta1 maxUnavailable
+// which v1alpha1 can only represent as the number of bookies it resolves to
+const maxUnavailableAnnotation = internal.Domain + "/max-unavailable"
+
+var _ conversion.Convertible = &BookkeeperCluster{}
+
+// ConvertTo converts this BookkeeperCluster to the hub version (v1beta1)
+func (in *BookkeeperCluster) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1beta1.BookkeeperCluster)
+	if !ok {
+		return fmt.Errorf("unsupported conversion hub type: %T", dstRaw)
+	}
+	in.ObjectMeta.DeepCopyInto(&dst.ObjectMeta)
+	dst.Spec = in.Spec.convertTo()
+	dst.Spec.MaxUnavailable = in.maxUnavailableTo()
+	delete(dst.Annotations, maxUnavailableAnnotation)
+	dst.Status = in.Status.convertTo(in.CreationTimestamp)
+	return nil
+}
+
+// ConvertFrom converts the hub version (v1beta1) to this BookkeeperCluster
+func (in *BookkeeperCluster) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1beta1.BookkeeperCluster)
+	if !ok {
+		return fmt.Errorf("unsupported conversion hub type: %T", srcRaw)
+	}
+	src.ObjectMeta.DeepCopyInto(&in.ObjectMeta)
+	in.Spec.convertFrom(&src.Spec)
+	in.maxUnavailableFrom(src.Spec.MaxUnavailable)
+	in.Status.convertFrom(&src.Status)
+	return nil
+}
+
+// maxUnavailableTo restores the percentage kept by maxUnavailableFrom
+// unless a v1alpha1 client has since changed the number of bookies
+func (in *BookkeeperCluster) maxUnavailableTo() *intstr.IntOrString {
+	if in.Spec.MaxUnavailableNodes == 0 {
+		return nil
+	}
+	if value, ok := in.Annotations[maxUnavailableAnnotation]; ok {
+		percent := intstr.FromString(value)
+		if resolveMaxUnavailable(&percent, in.Spec.Size) == in.Spec.MaxUnavailableNodes {
+			return &percent
+		}
+	}
+	maxUnavailable := intstr.FromInt32(in.Spec.MaxUnavailableNodes)
+	return &maxUnavailable
+}
+
+func (in *BookkeeperCluster) maxUnavailableFrom(maxUnavailable *intstr.IntOrString) {
+	delete(in.Annotations, maxUnavailableAnnotation)
+	in.Spec.MaxUnavailableNodes = 0
+	if maxUnavailable == nil {
+		return
+	}
+	in.Spec.MaxUnavailableNodes = resolveMaxUnavailable(maxUnavailable, in.Spec.Size)
+	if maxUnavailable.Type == intstr.String {
+		if in.Annotations == nil {
+			in.Annotations = map[string]string{}
+		}
+		in.Annotations[maxUnavailableAnnotation] = maxUnavailable.StrVal
+	}
+}
+
+// resolveMaxUnavailable resolves the maxUnavailable against the cluster size, rounding down
+// to at least one bookie since a zero value means the default to v1alpha1
+func resolveMaxUnavailable(maxUnavailable *intstr.IntOrString, size *int32) int32 {
+	if maxUnavailable.Type == intstr.Int {
+		return maxUnavailable.IntVal
+	}
+	total := 0
+	if size != nil {
+		total = int(*size)
+	}
+	value, err := intstr.GetScaledValueFromIntOrPercent(maxUnavailable, total, false)
+	if err != nil || value < 1 {
+		return 1
+	}
+	return int32(value)
+}
+
+func (in *BookkeeperClusterSpec) convertTo() v1beta1.BookkeeperClusterSpec {
+	zkServers, zkChroot := in.ZkEndpoints()
+	dst := v1beta1.BookkeeperClusterSpec{
+		BookkeeperVersion:    in.BookkeeperVersion,
+		ImagePullPolicy:      in.ImagePullPolicy,
+		Size:                 in.Size,
+		AutoRecoveryReplicas: in.AutoRecoveryReplicas,
+		ZkServers:            zkServers,
+		ZkChroot:             zkChroot,
+		ZkRootPath:           in.ZkRootPath,
+		EnableAutoRecovery:   in.EnableAutoRecovery,
+		JVMOptions: v1beta1.JVMOptions{
+			Memory:    in.JVMOptions.Memory,
+			Gc:        in.JVMOptions.Gc,
+			GcLogging: in.JVMOptions.GcLogging,
+			Extra:     in.JVMOptions.Extra,
+		},
+		PodConfig:     *in.PodConfig.DeepCopy(),
+		ProbeConfig:   in.ProbeConfig.DeepCopy(),
+		Labels:        copyMap(in.Labels),
+		Annotations:   copyMap(in.Annotations),
+		ClusterDomain: in.ClusterDomain,
+	}
+	dst.BkConfig, dst.Quorum = liftQuorum(in.BkConfig)
+	if in.Directories != nil {
+		dst.Directories = &v1beta1.Directories{
+			IndexDirs:  in.Directories.IndexDirs,
+			JournalDir: in.Directories.JournalDir,
+			LedgerDirs: in.Directories.LedgerDirs,
+		}
+	}
+	if in.Ports != nil {
+		dst.Ports = &v1beta1.Ports{
+			Bookie:  in.Ports.Bookie,
+			Admin:   in.Ports.Admin,
+			Metrics: in.Ports.Metrics,
+		}
+	}
+	if in.ZkConfig != nil {
+		dst.ZkConfig = &v1beta1.ZkConfig{
+			SessionTimeout:    in.ZkConfig.SessionTimeout,
+			ConnectionTimeout: in.ZkConfig.ConnectionTimeout,
+			Retries:           in.ZkConfig.Retries,
+		}
+		if auth := in.ZkConfig.Auth; auth != nil {
+			dst.ZkConfig.Auth = &v1beta1.ZkAuth{
+				Scheme:     v1beta1.ZkAuthScheme(auth.Scheme),
+				SecretName: auth.SecretName,
+			}
+		}
+		if tls := in.ZkConfig.TLS; tls != nil {
+			dst.ZkConfig.TLS = &v1beta1.ZkTLS{SecretName: tls.SecretName, ClientAuth: tls.ClientAuth}
+		}
+	}
+	if in.Monitoring != nil {
+		dst.Monitoring = &v1beta1.MonitoringConfig{
+			Enabled:           in.Monitoring.Enabled,
+			Kind:              v1beta1.MonitorKind(in.Monitoring.Kind),
+			Interval:          in.Monitoring.Interval,
+			ScrapeTimeout:     in.Monitoring.ScrapeTimeout,
+			Labels:            copyMap(in.Monitoring.Labels),
+			Relabelings:       relabelConfigsTo(in.Monitoring.Relabelings),
+			MetricRelabelings: relabelConfigsTo(in.Monitoring.MetricRelabelings),
+		}
+		if alerts := in.Monitoring.Alerts; alerts != nil {
+			dst.Monitoring.Alerts = &v1beta1.AlertsConfig{
+				Enabled: alerts.Enabled,
+				Labels:  copyMap(alerts.Labels),
+			}
+			if alerts.Thresholds != nil {
+				dst.Monitoring.Alerts.Thresholds = &v1beta1.AlertThresholds{
+					For:                          alerts.Thresholds.For,
+					JournalSyncLatencyMillis:     alerts.Thresholds.JournalSyncLatencyMillis,
+					DiskUsagePercent:             alerts.Thresholds.DiskUsagePercent,
+					UnderReplicatedLedgersWindow: alerts.Thresholds.UnderReplicatedLedgersWindow,
+				}
+			}
+		}
+	}
+	if in.Persistence != nil {
+		dst.Persistence = &v1beta1.Persistence{
+			ReclaimPolicy:          v1beta1.VolumeReclaimPolicy(in.Persistence.ReclaimPolicy),
+			Annotations:            copyMap(in.Persistence.Annotations),
+			JournalVolumeClaimSpec: in.Persistence.JournalVolumeClaimSpec.DeepCopy(),
+			LedgerVolumeClaimSpec:  in.Persistence.LedgerVolumeClaimSpec.DeepCopy(),
+			IndexVolumeClaimSpec:   in.Persistence.IndexVolumeClaimSpec.DeepCopy(),
+		}
+	}
+	return dst
+}
+
+func (in *BookkeeperClusterSpec) convertFrom(src *v1beta1.BookkeeperClusterSpec) {
+	*in = BookkeeperClusterSpec{
+		BookkeeperVersion:    src.BookkeeperVersion,
+		ImagePullPolicy:      src.ImagePullPolicy,
+		Size:                 src.Size,
+		AutoRecoveryReplicas: src.AutoRecoveryReplicas,
+		ZkServers:            strings.Join(src.ZkServers, ",") + src.ZkChroot,
+		ZkRootPath:           src.ZkRootPath,
+		EnableAutoRecovery:   src.EnableAutoRecovery,
+		JVMOptions: JVMOptions{
+			Memory:    src.JVMOptions.Memory,
+			Gc:        src.JVMOptions.Gc,
+			GcLogging: src.JVMOptions.GcLogging,
+			Extra:     src.JVMOptions.Extra,
+		},
+		BkConfig:      lowerQuorum(src.BkConfig, src.Quorum),
+		PodConfig:     *src.PodConfig.DeepCopy(),
+		ProbeConfig:   src.ProbeConfig.DeepCopy(),
+		Labels:        copyMap(src.Labels),
+		Annotations:   copyMap(src.Annotations),
+		ClusterDomain: src.ClusterDomain,
+	}
+	if src.Directories != nil {
+		in.Directories = &Directories{
+			IndexDirs:  src.Directories.IndexDirs,
+			JournalDir: src.Directories.JournalDir,
+			LedgerDirs: src.Directories.LedgerDirs,
+		}
+	}
+	if src.Ports != nil {
+		in.Ports = &Ports{
+			Bookie:  src.Ports.Bookie,
+			Admin:   src.Ports.Admin,
+			Metrics: src.Ports.Metrics,
+		}
+	}
+	if src.ZkConfig != nil {
+		in.ZkConfig = &ZkConfig{
+			SessionTimeout:    src.ZkConfig.SessionTimeout,
+			ConnectionTimeout: src.ZkConfig.ConnectionTimeout,
+			Retries:           src.ZkConfig.Retries,
+		}
+		if auth := src.ZkConfig.Auth; auth != nil {
+			in.ZkConfig.Auth = &ZkAuth{
+				Scheme:     ZkAuthScheme(auth.Scheme),
+				SecretName: auth.SecretName,
+			}
+		}
+		if tls := src.ZkConfig.TLS; tls != nil {
+			in.ZkConfig.TLS = &ZkTLS{SecretName: tls.SecretName, ClientAuth: tls.ClientAuth}
+		}
+	}
+	if src.Monitoring != nil {
+		in.Monitoring = &MonitoringConfig{
+			Enabled:           src.Monitoring.Enabled,
+			Kind:              MonitorKind(src.Monitoring.Kind),
+			Interval:          src.Monitoring.Interval,
+			ScrapeTimeout:     src.Monitoring.ScrapeTimeout,
+			Labels:            copyMap(src.Monitoring.Labels),
+			Relabelings:       relabelConfigsFrom(src.Monitoring.Relabelings),
+			MetricRelabelings: relabelConfigsFrom(src.Monitoring.MetricRelabelings),
+		}
+		if alerts := src.Monitoring.Alerts; alerts != nil {
+			in.Monitoring.Alerts = &AlertsConfig{
+				Enabled: alerts.Enabled,
+				Labels:  copyMap(alerts.Labels),
+			}
+			if alerts.Thresholds != nil {
+				in.Monitoring.Alerts.Thresholds = &AlertThresholds{
+					For:                          alerts.Thresholds.For,
+					JournalSyncLatencyMillis:     alerts.Thresholds.JournalSyncLatencyMillis,
+					DiskUsagePercent:             alerts.Thresholds.DiskUsagePercent,
+					UnderReplicatedLedgersWindow: alerts.Thresholds.UnderReplicatedLedgersWindow,
+				}
+			}
+		}
+	}
+	if src.Persistence != nil {
+		in.Persistence = &Persistence{
+			ReclaimPolicy:          VolumeReclaimPolicy(src.Persistence.ReclaimPolicy),
+			Annotations:            copyMap(src.Persistence.Annotations),
+			JournalVolumeClaimSpec: src.Persistence.JournalVolumeClaimSpec.DeepCopy(),
+			LedgerVolumeClaimSpec:  src.Persistence.LedgerVolumeClaimSpec.DeepCopy(),
+			IndexVolumeClaimSpec:   src.Persistence.IndexVolumeClaimSpec.DeepCopy(),
+		}
+	}
+}
+
+func relabelConfigsTo(configs []RelabelConfig) []v1beta1.RelabelConfig {
+	if configs == nil {
+		return nil
+	}
+	dst := make([]v1beta1.RelabelConfig, len(configs))
+	for i, config := range configs {
+		dst[i] = v1beta1.RelabelConfig{
+			SourceLabels: append([]string(nil), config.SourceLabels...),
+			Separator:    config.Separator,
+			TargetLabel:  config.TargetLabel,
+			Regex:        config.Regex,
+			Modulus:      config.Modulus,
+			Replacement:  config.Replacement,
+			Action:       config.Action,
+		}
+	}
+	return dst
+}
+
+func relabelConfigsFrom(configs []v1beta1.RelabelConfig) []RelabelConfig {
+	if configs == nil {
+		return nil
+	}
+	dst := make([]RelabelConfig, len(configs))
+	for i, config := range configs {
+		dst[i] = RelabelConfig{
+			SourceLabels: append([]string(nil), config.SourceLabels...),
+			Separator:    config.Separator,
+			TargetLabel:  config.TargetLabel,
+			Regex:        config.Regex,
+			Modulus:      config.Modulus,
+			Replacement:  config.Replacement,
+			Action:       config.Action,
+		}
+	}
+	return dst
+}
+
+// liftQuorum moves the quorum settings out of the BkConfig into the typed v1beta1 quorum.
+// Only the values which would be rendered back identically are moved.
+func liftQuorum(bkConfig map[string]string) (map[string]string, *v1beta1.Quorum) {
+	config := copyMap(bkConfig)
+	quorum := &v1beta1.Quorum{}
+	for key, value := range map[string]*int32{
+		BkConfigEnsembleSize:    &quorum.EnsembleSize,
+		BkConfigWriteQuorumSize: &quorum.WriteQuorumSize,
+		BkConfigAckQuorumSize:   &quorum.AckQuorumSize,
+	} {
+		i, err := strconv.ParseInt(config[key], 10, 32)
+		if err != nil || i <= 0 || strconv.FormatInt(i, 10) != config[key] {
+			continue
+		}
+		*value = int32(i)
+		delete(config, key)
+	}
+	if *quorum == (v1beta1.Quorum{}) {
+		return config, nil
+	}
+	return config, quorum
+}
+
+func lowerQuorum(bkConfig map[string]string, quorum *v1beta1.Quorum) map[string]string {
+	config := copyMap(bkConfig)
+	if quorum == nil {
+		return config
+	}
+	if config == nil {
+		config = map[string]string{}
+	}
+	for key, value := range map[string]int32{
+		BkConfigEnsembleSize:    quorum.EnsembleSize,
+		BkConfigWriteQuorumSize: quorum.WriteQuorumSize,
+		BkConfigAckQuorumSize:   quorum.AckQuorumSize,
+	} {
+		if value > 0 {
+			config[key] = strconv.Itoa(int(value))
+		}
+	}
+	return config
+}
+
+// convertTo converts the status to v1beta1. The LastUpdateTime of the conditions has no v1beta1
+// equivalent and is dropped. The v1beta1 conditions require a reason and a transition time, the
+// conditions missing them default to the Initializing reason and the specified creation time.
+func (in *BookkeeperClusterStatus) convertTo(created metav1.Time) v1beta1.BookkeeperClusterStatus {
+	dst := v1beta1.BookkeeperClusterStatus{
+		Replicas:        in.Replicas,
+		CurrentReplicas: in.CurrentReplicas,
+		ReadyReplicas:   in.ReadyReplicas,
+		Membership: v1beta1.Membership{
+			Ready:   in.Membership.Ready,
+			Unready: in.Membership.Unready,
+		},
+		Metadata: v1beta1.Metadata{
+			Size:                  in.Metadata.Size,
+			BkVersion:             in.Metadata.BkVersion,
+			BkConfig:              copyMap(in.Metadata.BkConfig),
+			ServiceMonitorVersion: in.Metadata.ServiceMonitorVersion,
+			PrometheusRuleVersion: in.Metadata.PrometheusRuleVersion,
+			AutoRecoveryEnabled:   in.Metadata.AutoRecoveryEnabled,
+			ConfigHash:            in.Metadata.ConfigHash,
+			Initialized:           in.Metadata.Initialized,
+			InstanceID:            in.Metadata.InstanceID,
+			LayoutVersion:         in.Metadata.LayoutVersion,
+			LedgerManagerType:     in.Metadata.LedgerManagerType,
+		},
+	}
+	if in.Rollout != nil {
+		dst.Rollout = &v1beta1.Rollout{
+			Phase:         v1beta1.RolloutPhase(in.Rollout.Phase),
+			Revision:      in.Rollout.Revision,
+			Ordinal:       in.Rollout.Ordinal,
+			StepStartTime: in.Rollout.StepStartTime.DeepCopy(),
+			Message:       in.Rollout.Message,
+		}
+	}
+	if in.Decommission != nil {
+		dst.Decommission = &v1beta1.Decommission{
+			Phase:         v1beta1.DecommissionPhase(in.Decommission.Phase),
+			Ordinal:       in.Decommission.Ordinal,
+			BookieID:      in.Decommission.BookieID,
+			StepStartTime: in.Decommission.StepStartTime.DeepCopy(),
+			Message:       in.Decommission.Message,
+		}
+	}
+	for _, bookie := range in.Bookies {
+		dst.Bookies = append(dst.Bookies, v1beta1.BookieStatus{
+			ID:                    bookie.ID,
+			Pod:                   bookie.Pod,
+			Ordinal:               bookie.Ordinal,
+			State:                 v1beta1.BookieState(bookie.State),
+			Version:               bookie.Version,
+			FreeDiskSpace:         copyQuantity(bookie.FreeDiskSpace),
+			TotalDiskSpace:        copyQuantity(bookie.TotalDiskSpace),
+			JournalFreeDiskSpace:  copyQuantity(bookie.JournalFreeDiskSpace),
+			JournalTotalDiskSpace: copyQuantity(bookie.JournalTotalDiskSpace),
+		})
+	}
+	for _, condition := range in.Conditions {
+		dst.Conditions = append(dst.Conditions, metav1.Condition{
+			Type:               string(condition.Type),
+			Status:             metav1.ConditionStatus(condition.Status),
+			Reason:             conditionReason(condition.Reason),
+			Message:            condition.Message,
+			LastTransitionTime: conditionTransitionTime(&condition, created),
+			ObservedGeneration: condition.ObservedGeneration,
+		})
+	}
+	return dst
+}
+
+func (in *BookkeeperClusterStatus) convertFrom(src *v1beta1.BookkeeperClusterStatus) {
+	*in = BookkeeperClusterStatus{
+		Replicas:        src.Replicas,
+		CurrentReplicas: src.CurrentReplicas,
+		ReadyReplicas:   src.ReadyReplicas,
+		Membership: Membership{
+			Ready:   src.Membership.Ready,
+			Unready: src.Membership.Unready,
+		},
+		Metadata: Metadata{
+			Size:                  src.Metadata.Size,
+			BkVersion:             src.Metadata.BkVersion,
+			BkConfig:              copyMap(src.Metadata.BkConfig),
+			ServiceMonitorVersion: src.Metadata.ServiceMonitorVersion,
+			PrometheusRuleVersion: src.Metadata.PrometheusRuleVersion,
+			AutoRecoveryEnabled:   src.Metadata.AutoRecoveryEnabled,
+			ConfigHash:            src.Metadata.ConfigHash,
+			Initialized:           src.Metadata.Initialized,
+			InstanceID:            src.Metadata.InstanceID,
+			LayoutVersion:         src.Metadata.LayoutVersion,
+			LedgerManagerType:     src.Metadata.LedgerManagerType,
+		},
+	}
+	if src.Rollout != nil {
+		in.Rollout = &Rollout{
+			Phase:         RolloutPhase(src.Rollout.Phase),
+			Revision:      src.Rollout.Revision,
+			Ordinal:       src.Rollout.Ordinal,
+			StepStartTime: src.Rollout.StepStartTime.DeepCopy(),
+			Message:       src.Rollout.Message,
+		}
+	}
+	if src.Decommission != nil {
+		in.Decommission = &Decommission{
+			Phase:         DecommissionPhase(src.Decommission.Phase),
+			Ordinal:       src.Decommission.Ordinal,
+			BookieID:      src.Decommission.BookieID,
+			StepStartTime: src.Decommission.StepStartTime.DeepCopy(),
+			Message:       src.Decommission.Message,
+		}
+	}
+	for _, bookie := range src.Bookies {
+		in.Bookies = append(in.Bookies, BookieStatus{
+			ID:                    bookie.ID,
+			Pod:                   bookie.Pod,
+			Ordinal:               bookie.Ordinal,
+			State:                 BookieState(bookie.State),
+			Version:               bookie.Version,
+			FreeDiskSpace:         copyQuantity(bookie.FreeDiskSpace),
+			TotalDiskSpace:        copyQuantity(bookie.TotalDiskSpace),
+			JournalFreeDiskSpace:  copyQuantity(bookie.JournalFreeDiskSpace),
+			JournalTotalDiskSpace: copyQuantity(bookie.JournalTotalDiskSpace),
+		})
+	}
+	for _, condition := range src.Conditions {
+		transitionTime := formatConditionTime(condition.LastTransitionTime)
+		in.Conditions = append(in.Conditions, ClusterCondition{
+			Type:               ConditionType(condition.Type),
+			Status:             v1.ConditionStatus(condition.Status),
+			Reason:             condition.Reason,
+			Message:            condition.Message,
+			LastUpdateTime:     transitionTime,
+			LastTransitionTime: transitionTime,
+			ObservedGeneration: condition.ObservedGeneration,
+		})
+	}
+}
+
+func conditionReason(reason string) string {
+	if reason == "" {
+		return ReasonInitializing
+	}
+	return reason
+}
+
+// conditionTransitionTime returns the transition time of the condition, falling back to its update
+// time, then to the specified creation time and finally to the epoch so it is never zero
+func conditionTransitionTime(condition *ClusterCondition, created metav1.Time) metav1.Time {
+	for _, t := range []metav1.Time{
+		parseConditionTime(condition.LastTransitionTime),
+		parseConditionTime(condition.LastUpdateTime),
+		created,
+	} {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return metav1.Unix(0, 0)
+}
+
+func parseConditionTime(value string) metav1.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return metav1.Time{}
+	}
+	return metav1.NewTime(t)
+}
+
+func formatConditionTime(t metav1.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func copyQuantity(q *resource.Quantity) *resource.Quantity {
+	if q == nil {
+		return nil
+	}
+	res := q.DeepCopy()
+	return &res
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"github.com/monimesl/bookkeeper-operator/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"testing"
+	"time"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func newV1alpha1Cluster() *BookkeeperCluster {
+	transitionTime := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	return &BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "bk",
+			Namespace:   "default",
+			Annotations: map[string]string{"team": "storage"},
+		},
+		Spec: BookkeeperClusterSpec{
+			BookkeeperVersion:   "4.16.3",
+			ImagePullPolicy:     v1.PullIfNotPresent,
+			Size:                int32Ptr(5),
+			MaxUnavailableNodes: 2,
+			ZkServers:           "zk-0.zk:2181,zk-1.zk:2181/bk",
+			ZkRootPath:          "/bookkeeper/default/bk",
+			ZkConfig: &ZkConfig{
+				SessionTimeout: &metav1.Duration{Duration: 30 * time.Second},
+				Retries:        int32Ptr(5),
+				Auth:           &ZkAuth{Scheme: ZkAuthSchemeSASL, SecretName: "bk-zk-auth"},
+				TLS:            &ZkTLS{SecretName: "bk-zk-tls", ClientAuth: true},
+			},
+			Directories: &Directories{
+				JournalDir: "/bk/journal",
+				LedgerDirs: "/bk/ledgers",
+				IndexDirs:  "/bk/index",
+			},
+			Ports: &Ports{Bookie: 3181, Admin: 8080, Metrics: 8000},
+			Monitoring: &MonitoringConfig{
+				Enabled:  true,
+				Kind:     MonitorKindPodMonitor,
+				Interval: "30s",
+				Labels:   map[string]string{"release": "prometheus"},
+				Alerts: &AlertsConfig{
+					Enabled:    true,
+					Labels:     map[string]string{"severity": "page"},
+					Thresholds: &AlertThresholds{DiskUsagePercent: int32Ptr(90)},
+				},
+				MetricRelabelings: []RelabelConfig{{
+					SourceLabels: []string{"__name__"},
+					Regex:        "jvm_.*",
+					Action:       "drop",
+				}},
+			},
+			EnableAutoRecovery: boolPtr(true),
+			JVMOptions:         JVMOptions{Memory: []string{"-Xms1g"}},
+			BkConfig: map[string]string{
+				BkConfigEnsembleSize:    "3",
+				BkConfigWriteQuorumSize: "3",
+				BkConfigAckQuorumSize:   "2",
+				"journalSyncData":       "true",
+			},
+			Labels: map[string]string{"tier": "storage"},
+			Persistence: &Persistence{
+				ReclaimPolicy: VolumeReclaimPolicyDelete,
+				LedgerVolumeClaimSpec: &v1.PersistentVolumeClaimSpec{
+					AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+					},
+				},
+			},
+			ClusterDomain: "cluster.local",
+		},
+		Status: BookkeeperClusterStatus{
+			Conditions: []ClusterCondition{{
+				Type:               ConditionClusterReady,
+				Status:             v1.ConditionTrue,
+				Reason:             ReasonAllBookiesWritable,
+				LastUpdateTime:     transitionTime,
+				LastTransitionTime: transitionTime,
+				ObservedGeneration: 3,
+			}},
+			Replicas:      5,
+			ReadyReplicas: 5,
+			Membership:    Membership{Ready: []string{"bk-0", "bk-1"}},
+			Metadata: Metadata{Size: 5, BkVersion: "4.16.3", Initialized: true,
+				InstanceID: "a1b2c3d4-0000-4000-8000-000000000000", LayoutVersion: 2, LedgerManagerType: "hierarchical"},
+		},
+	}
+}
+
+func TestConvertRoundTripFromV1alpha1(t *testing.T) {
+	src := newV1alpha1Cluster()
+	hub := &v1beta1.BookkeeperCluster{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if got := hub.Spec.ZkServers; len(got) != 2 || got[0] != "zk-0.zk:2181" || got[1] != "zk-1.zk:2181" {
+		t.Errorf("unexpected zkServers: %v", got)
+	}
+	if hub.Spec.ZkChroot != "/bk" {
+		t.Errorf("unexpected zkChroot: %s", hub.Spec.ZkChroot)
+	}
+	if hub.Spec.Quorum == nil || *hub.Spec.Quorum != (v1beta1.Quorum{EnsembleSize: 3, WriteQuorumSize: 3, AckQuorumSize: 2}) {
+		t.Errorf("unexpected quorum: %v", hub.Spec.Quorum)
+	}
+	if _, ok := hub.Spec.BkConfig[BkConfigEnsembleSize]; ok {
+		t.Errorf("the quorum should be lifted out of the bkConfig: %v", hub.Spec.BkConfig)
+	}
+	if hub.Spec.MaxUnavailable == nil || *hub.Spec.MaxUnavailable != intstr.FromInt32(2) {
+		t.Errorf("unexpected maxUnavailable: %v", hub.Spec.MaxUnavailable)
+	}
+	dst := &BookkeeperCluster{}
+	if err := dst.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if !apiequality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip mismatch:\n%s", diff.ObjectReflectDiff(src, dst))
+	}
+}
+
+func TestConvertDefaultStatus(t *testing.T) {
+	src := &BookkeeperCluster{ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "default"}}
+	src.SetStatusDefaults()
+	hub := &v1beta1.BookkeeperCluster{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if len(hub.Status.Conditions) != len(src.Status.Conditions) {
+		t.Fatalf("expected %d conditions, got %d", len(src.Status.Conditions), len(hub.Status.Conditions))
+	}
+	if errs := metav1validation.ValidateConditions(hub.Status.Conditions, field.NewPath("status", "conditions")); len(errs) > 0 {
+		t.Errorf("invalid conditions: %v", errs)
+	}
+}
+
+func TestConvertLegacyConditions(t *testing.T) {
+	created := metav1.NewTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	updated := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	src := &BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "default", CreationTimestamp: created},
+		Status: BookkeeperClusterStatus{Conditions: []ClusterCondition{
+			{Type: ConditionClusterReady, Status: v1.ConditionFalse},
+			{Type: ConditionClusterDegraded, Status: v1.ConditionFalse, LastUpdateTime: updated.Format(time.RFC3339)},
+		}},
+	}
+	hub := &v1beta1.BookkeeperCluster{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if errs := metav1validation.ValidateConditions(hub.Status.Conditions, field.NewPath("status", "conditions")); len(errs) > 0 {
+		t.Errorf("invalid conditions: %v", errs)
+	}
+	if got := hub.Status.Conditions[0]; got.Reason != ReasonInitializing || !got.LastTransitionTime.Equal(&created) {
+		t.Errorf("expected the Initializing reason and the creation time, got %q at %v", got.Reason, got.LastTransitionTime)
+	}
+	if got := hub.Status.Conditions[1]; !got.LastTransitionTime.Time.Equal(updated) {
+		t.Errorf("expected the update time, got %v", got.LastTransitionTime)
+	}
+	src.CreationTimestamp = metav1.Time{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if hub.Status.Conditions[0].LastTransitionTime.IsZero() {
+		t.Errorf("the transition time must never be zero")
+	}
+	if !src.SetStatusDefaults() || src.Status.Conditions[0].Reason != ReasonInitializing {
+		t.Errorf("the defaults should set the missing reasons: %v", src.Status.Conditions)
+	}
+}
+
+func TestConvertRoundTripFromV1beta1(t *testing.T) {
+	maxUnavailable := intstr.FromString("40%")
+	src := &v1beta1.BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "default"},
+		Spec: v1beta1.BookkeeperClusterSpec{
+			Size:           int32Ptr(5),
+			MaxUnavailable: &maxUnavailable,
+			ZkServers:      []string{"zk-0.zk:2181", "zk-1.zk:2181"},
+			Quorum:         &v1beta1.Quorum{EnsembleSize: 3, WriteQuorumSize: 2, AckQuorumSize: 2},
+			BkConfig:       map[string]string{"journalSyncData": "false"},
+		},
+		Status: v1beta1.BookkeeperClusterStatus{
+			Conditions: []metav1.Condition{{
+				Type:               string(ConditionClusterReady),
+				Status:             metav1.ConditionFalse,
+				Reason:             "PodsNotReady",
+				LastTransitionTime: metav1.NewTime(time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)),
+			}},
+		},
+	}
+	spoke := &BookkeeperCluster{}
+	if err := spoke.ConvertFrom(src); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if spoke.Spec.MaxUnavailableNodes != 2 {
+		t.Errorf("expected 40%% of 5 bookies to resolve to 2, got %d", spoke.Spec.MaxUnavailableNodes)
+	}
+	if spoke.Spec.ZkServers != "zk-0.zk:2181,zk-1.zk:2181" {
+		t.Errorf("unexpected zkServers: %s", spoke.Spec.ZkServers)
+	}
+	if spoke.Spec.BkConfig[BkConfigWriteQuorumSize] != "2" {
+		t.Errorf("the quorum should be lowered into the bkConfig: %v", spoke.Spec.BkConfig)
+	}
+	dst := &v1beta1.BookkeeperCluster{}
+	if err := spoke.ConvertTo(dst); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if !apiequality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip mismatch:\n%s", diff.ObjectReflectDiff(src, dst))
+	}
+}
+
+func TestConvertMaxUnavailablePercentChangedByV1alpha1(t *testing.T) {
+	maxUnavailable := intstr.FromString("40%")
+	src := &v1beta1.BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "bk"},
+		Spec: v1beta1.BookkeeperClusterSpec{
+			Size:           int32Ptr(5),
+			MaxUnavailable: &maxUnavailable,
+			ZkServers:      []string{"zk:2181"},
+		},
+	}
+	spoke := &BookkeeperCluster{}
+	if err := spoke.ConvertFrom(src); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	spoke.Spec.MaxUnavailableNodes = 1
+	dst := &v1beta1.BookkeeperCluster{}
+	if err := spoke.ConvertTo(dst); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if dst.Spec.MaxUnavailable == nil || *dst.Spec.MaxUnavailable != intstr.FromInt32(1) {
+		t.Errorf("expected the v1alpha1 change to win, got %v", dst.Spec.MaxUnavailable)
+	}
+	if _, ok := dst.Annotations[maxUnavailableAnnotation]; ok {
+		t.Errorf("the conversion annotation should not leak into v1beta1: %v", dst.Annotations)
+	}
+}
+
+func TestConvertRoundTripMaxUnavailablePercentFromV1alpha1(t *testing.T) {
+	src := newV1alpha1Cluster()
+	src.Annotations[maxUnavailableAnnotation] = "40%"
+	hub := &v1beta1.BookkeeperCluster{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if hub.Spec.MaxUnavailable == nil || *hub.Spec.MaxUnavailable != intstr.FromString("40%") {
+		t.Errorf("expected the annotated percentage, got %v", hub.Spec.MaxUnavailable)
+	}
+	if _, ok := hub.Annotations[maxUnavailableAnnotation]; ok {
+		t.Errorf("the conversion annotation should not leak into v1beta1: %v", hub.Annotations)
+	}
+	dst := &BookkeeperCluster{}
+	if err := dst.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if !apiequality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip mismatch:\n%s", diff.ObjectReflectDiff(src, dst))
+	}
+}
+
+func TestConvertRoundTripUnliftedQuorum(t *testing.T) {
+	src := newV1alpha1Cluster()
+	src.Spec.BkConfig = map[string]string{
+		"BK_" + BkConfigEnsembleSize:    "3",
+		"BK_" + BkConfigWriteQuorumSize: "3",
+		BkConfigAckQuorumSize:           "02",
+	}
+	hub := &v1beta1.BookkeeperCluster{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if hub.Spec.Quorum != nil {
+		t.Errorf("the prefixed and non canonical quorum keys should not be lifted: %v", hub.Spec.Quorum)
+	}
+	if !apiequality.Semantic.DeepEqual(src.Spec.BkConfig, hub.Spec.BkConfig) {
+		t.Errorf("the bkConfig should be kept as is:\n%s", diff.ObjectReflectDiff(src.Spec.BkConfig, hub.Spec.BkConfig))
+	}
+	dst := &BookkeeperCluster{}
+	if err := dst.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if !apiequality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip mismatch:\n%s", diff.ObjectReflectDiff(src, dst))
+	}
+}
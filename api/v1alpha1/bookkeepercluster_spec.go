@@ -17,13 +17,17 @@
 package v1alpha1
 
 import (
+	"fmt"
 	"github.com/monimesl/bookkeeper-operator/internal"
 	"github.com/monimesl/operator-helper/basetype"
 	"github.com/monimesl/operator-helper/k8s"
 	"github.com/monimesl/operator-helper/k8s/pod"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -66,10 +70,25 @@ const (
 	ServiceMetricsPortName = "http-metrics"
 )
 
+// The BkConfig keys the operator reads the ledger quorum settings from
+const (
+	BkConfigEnsembleSize    = "ensembleSize"
+	BkConfigWriteQuorumSize = "writeQuorumSize"
+	BkConfigAckQuorumSize   = "ackQuorumSize"
+)
+
 var (
 	defaultTerminationGracePeriod int64 = 120
 	defaultAutoRecoveryReplica          = int32(1)
-	defaultClusterSize                  = int32(minimumClusterSize)
+	// defaultWriteQuorumSize is the bookkeeper default writeQuorumSize
+	defaultWriteQuorumSize = int32(2)
+	defaultClusterSize     = int32(minimumClusterSize)
+)
+
+const (
+	defaultZkSessionTimeout    = 10 * time.Second
+	defaultZkConnectionTimeout = 10 * time.Second
+	defaultZkRetries           = int32(3)
 )
 
 // BookkeeperClusterSpec defines the desired state of BookkeeperCluster
@@ -92,11 +111,24 @@ type BookkeeperClusterSpec struct {
 	// Default is 1.
 	// +optional
 	MaxUnavailableNodes int32 `json:"maxUnavailableNodes"`
-	// ZkServers specifies the hostname/IP address and port in the format "hostname:port".
+	// ZkServers specifies the zookeeper connection string: a comma-separated list of
+	// "hostname:port" endpoints, optionally followed by a chroot, e.g. "zk-0:2181,zk-1:2181/bk".
 	// +kubebuilder:validation:Required
-	ZkServers   string       `json:"zkServers"`
+	ZkServers string `json:"zkServers"`
+	// ZkRootPath is the zookeeper path the cluster metadata is stored under, within the chroot if any.
+	// It defaults to "/bookkeeper/namespaces/<namespace>/<name>" for the clusters created through the webhook
+	// and to the legacy "/bookkeeper/<name>" otherwise. It cannot be changed once the cluster is created.
+	// +kubebuilder:validation:Pattern=`^(/[^/]+)+$`
+	// +optional
+	ZkRootPath string `json:"zkRootPath,omitempty"`
+	// ZkConfig configures the zookeeper client of the operator
+	// +optional
+	ZkConfig    *ZkConfig    `json:"zkConfig,omitempty"`
 	Directories *Directories `json:"directories,omitempty"`
 	Ports       *Ports       `json:"ports,omitempty"`
+	// Monitoring configures the scraping of the cluster metrics by the Prometheus Operator
+	// +optional
+	Monitoring *MonitoringConfig `json:"monitoring,omitempty"`
 	// EnableAutoRecovery indicates whether BookKeeper auto recovery is enabled.
 	// Defaults to true.
 	// +optional
@@ -131,9 +163,180 @@ type BookkeeperClusterSpec struct {
 	ClusterDomain string `json:"clusterDomain,omitempty"`
 }
 
+// ZkConfig configures how the operator connects to the zookeeper ensemble
+type ZkConfig struct {
+	// SessionTimeout is the zookeeper session timeout. Defaults to 10s.
+	// +optional
+	SessionTimeout *metav1.Duration `json:"sessionTimeout,omitempty"`
+	// ConnectionTimeout is how long to wait for the session to be established. Defaults to 10s.
+	// +optional
+	ConnectionTimeout *metav1.Duration `json:"connectionTimeout,omitempty"`
+	// Retries is the number of times in a row a transient zookeeper error is retried, by requeueing
+	// the reconciliation with an exponential backoff, before it fails the reconciliation. Defaults to 3.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Retries *int32 `json:"retries,omitempty"`
+	// Auth configures the authentication to zookeeper
+	// +optional
+	Auth *ZkAuth `json:"auth,omitempty"`
+	// TLS configures the TLS connections to zookeeper
+	// +optional
+	TLS *ZkTLS `json:"tls,omitempty"`
+}
+
+// The keys of the Secret holding the zookeeper TLS certificates
+const (
+	ZkTLSCAKey   = "ca.crt"
+	ZkTLSCertKey = "tls.crt"
+	ZkTLSKeyKey  = "tls.key"
+)
+
+// ZkTLS references the Secret holding the certificates of the zookeeper TLS connections
+// of the operator, the bookies and the autorecovery. The "ca.crt" key of the Secret holds
+// the CA the zookeeper servers are verified with.
+type ZkTLS struct {
+	// SecretName is the name of the Secret within the cluster namespace
+	// +kubebuilder:validation:Required
+	SecretName string `json:"secretName"`
+	// ClientAuth presents the client certificate of the "tls.crt" and "tls.key" keys of the Secret
+	// +optional
+	ClientAuth bool `json:"clientAuth,omitempty"`
+}
+
+// ZkAuthScheme defines how the clients authenticate to zookeeper
+// +kubebuilder:validation:Enum=digest;sasl
+type ZkAuthScheme string
+
+const (
+	// ZkAuthSchemeDigest authenticates the operator with the digest credentials
+	ZkAuthSchemeDigest ZkAuthScheme = "digest"
+	// ZkAuthSchemeSASL authenticates the bookies with SASL too
+	ZkAuthSchemeSASL ZkAuthScheme = "sasl"
+)
+
+// The keys of the Secret holding the zookeeper credentials
+const (
+	ZkAuthUsernameKey   = "username"
+	ZkAuthPasswordKey   = "password"
+	ZkAuthJaasConfigKey = "jaas.conf"
+)
+
+// ZkAuth references the Secret holding the zookeeper credentials. The operator authenticates
+// with the digest "username" and "password" keys of the Secret and creates the znodes it owns
+// with creator-only ACLs, the parent ones stay open. With the digest scheme, the bookies
+// authenticate with the same credentials through a generated JAAS DigestLoginModule configuration.
+// With the sasl scheme, the bookies authenticate with the JAAS configuration of the "jaas.conf"
+// key and secure their znodes with zkEnableSecurity; the operator then needs the digest
+// credentials of a user allowed on the bookie znodes.
+type ZkAuth struct {
+	// Scheme is the authentication scheme, digest or sasl. Defaults to digest.
+	// +optional
+	Scheme ZkAuthScheme `json:"scheme,omitempty"`
+	// SecretName is the name of the Secret within the cluster namespace
+	// +kubebuilder:validation:Required
+	SecretName string `json:"secretName"`
+}
+
+// MonitorKind defines the kind of the Prometheus Operator monitor scraping the cluster
+type MonitorKind string
+
+const (
+	// MonitorKindServiceMonitor scrapes the pods through the headless service
+	MonitorKindServiceMonitor MonitorKind = "ServiceMonitor"
+	// MonitorKindPodMonitor scrapes the pods directly
+	MonitorKindPodMonitor MonitorKind = "PodMonitor"
+)
+
+// MonitoringConfig configures the scraping of the bookie and autorecovery
+// metrics by the Prometheus Operator, when its CRDs are installed
 type MonitoringConfig struct {
 	// Enabled defines whether this monitoring is enabled or not.
 	Enabled bool `json:"enabled,omitempty"`
+	// Kind is the kind of the monitor to create. Defaults to ServiceMonitor.
+	// +kubebuilder:validation:Enum=ServiceMonitor;PodMonitor
+	// +optional
+	Kind MonitorKind `json:"kind,omitempty"`
+	// Interval is the scrape interval, e.g. 30s. Defaults to the Prometheus one.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$`
+	// +optional
+	Interval string `json:"interval,omitempty"`
+	// ScrapeTimeout is the scrape timeout, e.g. 10s. Defaults to the Prometheus one.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$`
+	// +optional
+	ScrapeTimeout string `json:"scrapeTimeout,omitempty"`
+	// Labels defines the extra labels of the monitor, e.g. the ones the Prometheus instance selects the monitors by
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Relabelings are applied to the scraped targets before scraping
+	// +optional
+	Relabelings []RelabelConfig `json:"relabelings,omitempty"`
+	// MetricRelabelings are applied to the scraped samples before ingestion
+	// +optional
+	MetricRelabelings []RelabelConfig `json:"metricRelabelings,omitempty"`
+	// Alerts configures the PrometheusRule of the curated bookkeeper alerts
+	// +optional
+	Alerts *AlertsConfig `json:"alerts,omitempty"`
+}
+
+// AlertsConfig configures the PrometheusRule of the curated bookkeeper alerts
+type AlertsConfig struct {
+	// Enabled defines whether the alerts are enabled or not. It requires the monitoring to be enabled.
+	Enabled bool `json:"enabled,omitempty"`
+	// Labels defines the extra labels of the alerts, e.g. the ones the alerts are routed by
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Thresholds overrides the default thresholds of the alerts
+	// +optional
+	Thresholds *AlertThresholds `json:"thresholds,omitempty"`
+}
+
+// AlertThresholds defines the thresholds of the alerts; the unset ones take their default
+type AlertThresholds struct {
+	// For is how long a condition must hold before its alert fires. Defaults to 5m.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?)$`
+	// +optional
+	For string `json:"for,omitempty"`
+	// JournalSyncLatencyMillis is the p99 journal sync latency above which the bookie is alerted on. Defaults to 100.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	JournalSyncLatencyMillis *int32 `json:"journalSyncLatencyMillis,omitempty"`
+	// DiskUsagePercent is the ledger directory usage above which the bookie is alerted on. Defaults to 85.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	DiskUsagePercent *int32 `json:"diskUsagePercent,omitempty"`
+	// UnderReplicatedLedgersWindow is the window over which a growth of the under-replicated
+	// ledgers is alerted on. Defaults to 30m.
+	// +kubebuilder:validation:Pattern=`^(([0-9]+)h)?(([0-9]+)m)?$`
+	// +optional
+	UnderReplicatedLedgersWindow string `json:"underReplicatedLedgersWindow,omitempty"`
+}
+
+// RelabelConfig is a Prometheus relabeling rule
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	// SourceLabels are the labels whose values are concatenated and matched against the regex
+	// +optional
+	SourceLabels []string `json:"sourceLabels,omitempty"`
+	// Separator placed between the concatenated source label values. Defaults to ;
+	// +optional
+	Separator string `json:"separator,omitempty"`
+	// TargetLabel is the label the result is written to in a replace action
+	// +optional
+	TargetLabel string `json:"targetLabel,omitempty"`
+	// Regex is matched against the concatenated source label values. Defaults to (.*)
+	// +optional
+	Regex string `json:"regex,omitempty"`
+	// Modulus is the modulus to take of the hash of the source label values
+	// +optional
+	Modulus uint64 `json:"modulus,omitempty"`
+	// Replacement is the value written to the target label in a replace action. Defaults to $1
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+	// Action to perform based on the regex matching. Defaults to replace
+	// +kubebuilder:validation:Enum=replace;keep;drop;hashmod;labelmap;labeldrop;labelkeep;lowercase;uppercase;keepequal;dropequal
+	// +optional
+	Action string `json:"action,omitempty"`
 }
 
 type Ports struct {
@@ -284,6 +487,14 @@ func (in *BookkeeperClusterSpec) setDefaults() (changed bool) { //nolint:cyclop
 		changed = true
 		in.ClusterDomain = defaultClusterDomain
 	}
+	if in.ZkConfig != nil && in.ZkConfig.Auth != nil && in.ZkConfig.Auth.Scheme == "" {
+		changed = true
+		in.ZkConfig.Auth.Scheme = ZkAuthSchemeDigest
+	}
+	if in.Monitoring != nil && in.Monitoring.Kind == "" {
+		changed = true
+		in.Monitoring.Kind = MonitorKindServiceMonitor
+	}
 	if in.Persistence == nil {
 		changed = true
 		in.Persistence = &Persistence{}
@@ -347,14 +558,143 @@ func (in *BookkeeperClusterSpec) setDefaults() (changed bool) { //nolint:cyclop
 	return
 }
 
+// Quorum defines the ledger quorum settings configured for the cluster.
+// A zero value means the setting is not configured.
+type Quorum struct {
+	EnsembleSize    int32
+	WriteQuorumSize int32
+	AckQuorumSize   int32
+}
+
+// Quorum returns the ledger quorum settings configured in the BkConfig
+func (in *BookkeeperClusterSpec) Quorum() (quorum Quorum, err error) {
+	if quorum.EnsembleSize, err = in.bkConfigInt32(BkConfigEnsembleSize); err != nil {
+		return
+	}
+	if quorum.WriteQuorumSize, err = in.bkConfigInt32(BkConfigWriteQuorumSize); err != nil {
+		return
+	}
+	quorum.AckQuorumSize, err = in.bkConfigInt32(BkConfigAckQuorumSize)
+	return
+}
+
+// WriteQuorumSize returns the configured write quorum size, or the bookkeeper
+// default one, capped to the cluster size
+func (in *BookkeeperClusterSpec) WriteQuorumSize() int32 {
+	writeQuorum := defaultWriteQuorumSize
+	if quorum, err := in.Quorum(); err == nil && quorum.WriteQuorumSize > 0 {
+		writeQuorum = quorum.WriteQuorumSize
+	}
+	if in.Size != nil && writeQuorum > *in.Size {
+		writeQuorum = *in.Size
+	}
+	return writeQuorum
+}
+
+// ZkEndpoints returns the zookeeper endpoints and the chroot, if any, of the connection string
+func (in *BookkeeperClusterSpec) ZkEndpoints() (servers []string, chroot string) {
+	return ParseZkConnectString(in.ZkServers)
+}
+
+// ZkConnectString returns the normalized zookeeper connection string
+// the bookies connect with, the chroot included
+func (in *BookkeeperClusterSpec) ZkConnectString() string {
+	servers, chroot := in.ZkEndpoints()
+	return strings.Join(servers, ",") + chroot
+}
+
+// ZkSessionTimeout returns the configured zookeeper session timeout or the default one
+func (in *BookkeeperClusterSpec) ZkSessionTimeout() time.Duration {
+	if in.ZkConfig != nil && in.ZkConfig.SessionTimeout != nil && in.ZkConfig.SessionTimeout.Duration > 0 {
+		return in.ZkConfig.SessionTimeout.Duration
+	}
+	return defaultZkSessionTimeout
+}
+
+// ZkConnectionTimeout returns how long to wait for the zookeeper session to be established
+func (in *BookkeeperClusterSpec) ZkConnectionTimeout() time.Duration {
+	if in.ZkConfig != nil && in.ZkConfig.ConnectionTimeout != nil && in.ZkConfig.ConnectionTimeout.Duration > 0 {
+		return in.ZkConfig.ConnectionTimeout.Duration
+	}
+	return defaultZkConnectionTimeout
+}
+
+// ZkRetries returns the number of times a transient zookeeper error is retried
+func (in *BookkeeperClusterSpec) ZkRetries() int32 {
+	if in.ZkConfig != nil && in.ZkConfig.Retries != nil {
+		return *in.ZkConfig.Retries
+	}
+	return defaultZkRetries
+}
+
+// ZkAuth returns the zookeeper authentication settings, nil when none are configured
+func (in *BookkeeperClusterSpec) ZkAuth() *ZkAuth {
+	if in.ZkConfig == nil {
+		return nil
+	}
+	return in.ZkConfig.Auth
+}
+
+// ZkSASLEnabled checks whether the bookies authenticate to zookeeper with SASL
+func (in *BookkeeperClusterSpec) ZkSASLEnabled() bool {
+	auth := in.ZkAuth()
+	return auth != nil && auth.Scheme == ZkAuthSchemeSASL
+}
+
+// ZkTLS returns the zookeeper TLS settings, nil when the connections are in plain text
+func (in *BookkeeperClusterSpec) ZkTLS() *ZkTLS {
+	if in.ZkConfig == nil {
+		return nil
+	}
+	return in.ZkConfig.TLS
+}
+
+// ParseZkConnectString splits the zookeeper connection string, e.g. "zk-0:2181,zk-1:2181/bk",
+// into its endpoints and its chroot. The chroot is empty when the string has none.
+func ParseZkConnectString(connectString string) (servers []string, chroot string) {
+	connectString = strings.TrimSpace(connectString)
+	if i := strings.Index(connectString, "/"); i >= 0 {
+		chroot = strings.TrimRight(strings.TrimSpace(connectString[i:]), "/")
+		connectString = connectString[:i]
+	}
+	for _, server := range strings.Split(connectString, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers, chroot
+}
+
+// bkConfigValue returns the BkConfig value of the key with or without the "BK_" prefix
+func (in *BookkeeperClusterSpec) bkConfigValue(key string) (string, bool) {
+	if v, ok := in.BkConfig[key]; ok {
+		return strings.TrimSpace(v), true
+	}
+	v, ok := in.BkConfig["BK_"+key]
+	return strings.TrimSpace(v), ok
+}
+
+func (in *BookkeeperClusterSpec) bkConfigInt32(key string) (int32, error) {
+	v, ok := in.bkConfigValue(key)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %w", key, v, err)
+	}
+	return int32(i), nil
+}
+
 func (in *BookkeeperClusterSpec) createAnnotations() map[string]string {
 	return in.Annotations
 }
 
 func (in *BookkeeperClusterSpec) createLabels(clusterName string) map[string]string {
-	labels := in.Labels
-	if labels == nil {
-		labels = map[string]string{}
+	// Copy the labels so the operator managed ones never leak into the spec
+	labels := make(map[string]string, len(in.Labels)+4)
+	for k, v := range in.Labels {
+		labels[k] = v
 	}
 	labels["app"] = "zookeeper"
 	labels[k8s.LabelAppName] = "zookeeper"
@@ -362,3 +702,6 @@ func (in *BookkeeperClusterSpec) createLabels(clusterName string) map[string]str
 	labels[k8s.LabelAppManagedBy] = internal.OperatorName
 	return labels
 }
+
+// operatorManagedLabels are the labels createLabels always sets on the generated objects
+var operatorManagedLabels = []string{"app", k8s.LabelAppName, k8s.LabelAppInstance, k8s.LabelAppManagedBy}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZkConnectString(t *testing.T) {
+	tests := []struct {
+		connectString string
+		servers       []string
+		chroot        string
+	}{
+		{"", nil, ""},
+		{"   ", nil, ""},
+		{"zk:2181", []string{"zk:2181"}, ""},
+		{"zk-0:2181,zk-1:2181", []string{"zk-0:2181", "zk-1:2181"}, ""},
+		{"zk-0:2181,zk-1:2181/bk", []string{"zk-0:2181", "zk-1:2181"}, "/bk"},
+		{"zk:2181/bk/nested", []string{"zk:2181"}, "/bk/nested"},
+		{"zk:2181/bk/", []string{"zk:2181"}, "/bk"},
+		{"zk:2181/", []string{"zk:2181"}, ""},
+		{" zk-0:2181 , zk-1:2181 /bk ", []string{"zk-0:2181", "zk-1:2181"}, "/bk"},
+		{"zk-0:2181,,zk-1:2181,", []string{"zk-0:2181", "zk-1:2181"}, ""},
+		{"/bk", nil, "/bk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.connectString, func(t *testing.T) {
+			servers, chroot := ParseZkConnectString(tt.connectString)
+			if !reflect.DeepEqual(servers, tt.servers) || chroot != tt.chroot {
+				t.Errorf("ParseZkConnectString(%q) = %v, %q, want %v, %q",
+					tt.connectString, servers, chroot, tt.servers, tt.chroot)
+			}
+		})
+	}
+}
+
+func TestZkConnectString(t *testing.T) {
+	spec := &BookkeeperClusterSpec{ZkServers: " zk-0:2181 , zk-1:2181/bk/ "}
+	if got := spec.ZkConnectString(); got != "zk-0:2181,zk-1:2181/bk" {
+		t.Errorf("unexpected normalized connect string %q", got)
+	}
+}
@@ -17,16 +17,75 @@
 package v1alpha1
 
 import (
+	"fmt"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"time"
 )
 
 type ConditionType string
 
 const (
+	// ConditionClusterPreparing the cluster is being deployed and its bookies are not all writable yet
 	ConditionClusterPreparing ConditionType = "Preparing"
-	ConditionClusterReady     ConditionType = "Ready"
-	ConditionClusterError     ConditionType = "Error"
+	// ConditionClusterReady all the bookies of the cluster are writable
+	ConditionClusterReady ConditionType = "Ready"
+	// ConditionClusterDegraded the writable bookies are fewer than the cluster size but still enough for the write quorum
+	ConditionClusterDegraded ConditionType = "Degraded"
+	// ConditionClusterUnavailable the writable bookies are too few for the write quorum
+	ConditionClusterUnavailable ConditionType = "Unavailable"
+	// ConditionClusterUpgrading the bookies are being rolled to a new revision
+	ConditionClusterUpgrading ConditionType = "Upgrading"
+	// ConditionClusterScalingUp bookies are being added to the cluster
+	ConditionClusterScalingUp ConditionType = "ScalingUp"
+	// ConditionClusterScalingDown bookies are being decommissioned from the cluster
+	ConditionClusterScalingDown ConditionType = "ScalingDown"
+	// ConditionClusterZooKeeperUnreachable the operator failed to connect to zookeeper
+	ConditionClusterZooKeeperUnreachable ConditionType = "ZooKeeperUnreachable"
+	// ConditionClusterMetadataError the operator failed to read or write the cluster metadata in zookeeper,
+	// e.g. it is malformed, written by a newer operator or concurrently written
+	ConditionClusterMetadataError ConditionType = "MetadataError"
+	// ConditionClusterInstanceIDChanged the instance id of the cluster metadata in zookeeper is not the one
+	// first read, the metadata was reformatted underneath the cluster
+	ConditionClusterInstanceIDChanged ConditionType = "InstanceIDChanged"
+	// ConditionClusterReconcileError the last reconciliation of the cluster failed
+	ConditionClusterReconcileError ConditionType = "ReconcileError"
+	// ConditionClusterMonitoringUnavailable the monitoring is enabled but the Prometheus Operator CRDs are not installed
+	ConditionClusterMonitoringUnavailable ConditionType = "MonitoringUnavailable"
+
+	// legacyConditionClusterError was never set and is superseded by ConditionClusterReconcileError
+	legacyConditionClusterError ConditionType = "Error"
+)
+
+// The reasons of the cluster conditions
+const (
+	ReasonInitializing         = "Initializing"
+	ReasonClusterCreated       = "ClusterCreated"
+	ReasonInitializingMetadata = "InitializingMetadata"
+	ReasonMetadataInitFailed   = "MetadataInitFailed"
+	ReasonPartialMetadata      = "PartialMetadata"
+	ReasonAllBookiesWritable   = "AllBookiesWritable"
+	ReasonBookiesNotWritable   = "BookiesNotWritable"
+	ReasonBelowWriteQuorum     = "BelowWriteQuorum"
+	ReasonVersionUpgrade       = "VersionUpgrade"
+	ReasonRollingUpdate        = "RollingUpdate"
+	ReasonRolloutStalled       = "RolloutStalled"
+	ReasonRolloutCompleted     = "RolloutCompleted"
+	ReasonAddingBookies        = "AddingBookies"
+	ReasonDecommissioning      = "DecommissioningBookie"
+	ReasonDecommissionStalled  = "DecommissionStalled"
+	ReasonScaleCompleted       = "ScaleCompleted"
+	ReasonZooKeeperError       = "ZooKeeperError"
+	ReasonZooKeeperConnected   = "ZooKeeperConnected"
+	ReasonMetadataError        = "MetadataError"
+	ReasonMetadataHealthy      = "MetadataHealthy"
+	ReasonInstanceIDMatches    = "InstanceIDMatches"
+	ReasonInstanceIDChanged    = "InstanceIDChanged"
+	ReasonReconcileFailed      = "ReconcileFailed"
+	ReasonReconcileSucceeded   = "ReconcileSucceeded"
+	ReasonPrometheusCRDMissing = "PrometheusOperatorCRDMissing"
+	ReasonMonitoringAvailable  = "MonitoringAvailable"
 )
 
 // BookkeeperClusterStatus defines the observed state of BookkeeperCluster
@@ -51,9 +110,48 @@ type BookkeeperClusterStatus struct {
 	// Membership describe the status of members within the cluster
 	// +optional
 	Membership Membership `json:"members"`
+	// Bookies lists the status of each bookie of the cluster
+	// +optional
+	Bookies []BookieStatus `json:"bookies,omitempty"`
 	// Metadata defines the metadata status of the cluster
 	// +optional
 	Metadata Metadata `json:"metadata,omitempty"`
+
+	// Rollout describes the progress of the bookies rolling update
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// Decommission describes the progress of the bookie being decommissioned on a scale down
+	// +optional
+	Decommission *Decommission `json:"decommission,omitempty"`
+}
+
+// RolloutPhase defines the phase of the bookies rolling update
+type RolloutPhase string
+
+const (
+	// RolloutPhaseRolling the bookies are being rolled one at a time
+	RolloutPhaseRolling RolloutPhase = "Rolling"
+	// RolloutPhaseStalled the rolled bookie did not become healthy in time; the rollout is held
+	RolloutPhaseStalled RolloutPhase = "Stalled"
+	// RolloutPhaseCompleted all the bookies run the latest revision
+	RolloutPhaseCompleted RolloutPhase = "Completed"
+)
+
+// Rollout is the status of the bookies rolling update
+type Rollout struct {
+	// Phase is the phase of the rollout
+	Phase RolloutPhase `json:"phase"`
+	// Revision is the statefulset revision the bookies are rolled to
+	Revision string `json:"revision,omitempty"`
+	// Ordinal is the ordinal of the last bookie rolled
+	Ordinal int32 `json:"ordinal"`
+	// StepStartTime is when the last bookie started rolling
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+	// Message describes what the rollout is waiting on
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // Metadata defines the metadata status of the cluster
@@ -62,6 +160,61 @@ type Metadata struct {
 	BkVersion             string            `json:"bkVersion,omitempty"`
 	BkConfig              map[string]string `json:"bkConfig,omitempty"`
 	ServiceMonitorVersion *string           `json:"serviceMonitorVersion,omitempty"`
+	// PrometheusRuleVersion is the resource version of the applied PrometheusRule of the alerts
+	PrometheusRuleVersion *string `json:"prometheusRuleVersion,omitempty"`
+	// AutoRecoveryEnabled is the autorecovery switch last applied in zookeeper
+	AutoRecoveryEnabled *bool `json:"autoRecoveryEnabled,omitempty"`
+	// ConfigHash is the content hash of the configuration the pods are rolled to
+	ConfigHash string `json:"configHash,omitempty"`
+	// Initialized is true once the ledgers metadata of the cluster is formatted in zookeeper
+	Initialized bool `json:"initialized,omitempty"`
+	// InstanceID is the instance id of the cluster metadata as first read from zookeeper
+	InstanceID string `json:"instanceId,omitempty"`
+	// LayoutVersion is the format version of the ledgers layout
+	LayoutVersion int32 `json:"layoutVersion,omitempty"`
+	// LedgerManagerType is the type of the ledger manager the ledgers metadata is stored with, e.g. hierarchical
+	LedgerManagerType string `json:"ledgerManagerType,omitempty"`
+}
+
+// BookieState defines the state of a bookie as registered in zookeeper
+type BookieState string
+
+const (
+	// BookieStateWritable the bookie is registered as writable
+	BookieStateWritable BookieState = "Writable"
+	// BookieStateReadOnly the bookie is registered as read-only, e.g. its disks are full
+	BookieStateReadOnly BookieState = "ReadOnly"
+	// BookieStateUnavailable the bookie is not registered
+	BookieStateUnavailable BookieState = "Unavailable"
+)
+
+// BookieStatus is the status of a single bookie
+type BookieStatus struct {
+	// ID is the id the bookie registers with
+	ID string `json:"id"`
+	// Pod is the name of the bookie pod
+	Pod string `json:"pod"`
+	// Ordinal is the ordinal of the bookie pod
+	Ordinal int32 `json:"ordinal"`
+	// State is the state of the bookie in zookeeper
+	State BookieState `json:"state"`
+	// Version is the bookkeeper version the bookie pod runs
+	// +optional
+	Version string `json:"version,omitempty"`
+	// FreeDiskSpace is the free space of the bookie ledger directories summed as reported by the bookie
+	// admin API. The index directories are not included, the bookie does not report them.
+	// +optional
+	FreeDiskSpace *resource.Quantity `json:"freeDiskSpace,omitempty"`
+	// TotalDiskSpace is the total space of the bookie ledger directories, with the same limitation
+	// as the FreeDiskSpace. The ledger directories sharing a volume count it once each.
+	// +optional
+	TotalDiskSpace *resource.Quantity `json:"totalDiskSpace,omitempty"`
+	// JournalFreeDiskSpace is the free space of the volume of the bookie journal directory
+	// +optional
+	JournalFreeDiskSpace *resource.Quantity `json:"journalFreeDiskSpace,omitempty"`
+	// JournalTotalDiskSpace is the total space of the volume of the bookie journal directory
+	// +optional
+	JournalTotalDiskSpace *resource.Quantity `json:"journalTotalDiskSpace,omitempty"`
 }
 
 // Membership is the status of the members within the cluster
@@ -100,33 +253,84 @@ type ClusterCondition struct {
 	// LastTransitionTime the last time a transition was made.
 	// +optional
 	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+	// ObservedGeneration is the cluster generation the condition was set from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 }
 
 func (in *BookkeeperClusterStatus) setDefault() (changed bool) {
 	clusterConditions := []ConditionType{
 		ConditionClusterPreparing,
 		ConditionClusterReady,
-		ConditionClusterError,
+		ConditionClusterDegraded,
+		ConditionClusterUnavailable,
+		ConditionClusterUpgrading,
+		ConditionClusterScalingUp,
+		ConditionClusterScalingDown,
+		ConditionClusterZooKeeperUnreachable,
+		ConditionClusterMetadataError,
+		ConditionClusterInstanceIDChanged,
+		ConditionClusterReconcileError,
+		ConditionClusterMonitoringUnavailable,
 	}
 	if in.Conditions == nil {
 		changed = true
 		for _, typ := range clusterConditions {
-			in.setCondition(typ, v1.ConditionFalse, "", "")
+			in.setCondition(typ, v1.ConditionFalse, ReasonInitializing, "waiting for the first reconciliation", 0)
+		}
+	}
+	for i := range in.Conditions {
+		// set without a reason by the previous versions
+		if in.Conditions[i].Reason == "" {
+			changed = true
+			in.Conditions[i].Reason = ReasonInitializing
 		}
 	}
+	if in.removeCondition(legacyConditionClusterError) {
+		changed = true
+	}
 	return
 }
 
-func (in *BookkeeperClusterStatus) SetPodsReadyConditionTrue() {
-	in.setCondition(ConditionClusterReady, v1.ConditionTrue, "", "")
+// SetAvailabilityConditions sets the Ready, Degraded and Unavailable conditions from
+// the number of writable bookies against the cluster size and the write quorum size
+func (in *BookkeeperClusterStatus) SetAvailabilityConditions(writable, size, writeQuorum int32, generation int64) {
+	switch {
+	case writable >= size:
+		message := fmt.Sprintf("all the %d bookies are writable", size)
+		in.setCondition(ConditionClusterReady, v1.ConditionTrue, ReasonAllBookiesWritable, message, generation)
+		in.setCondition(ConditionClusterDegraded, v1.ConditionFalse, ReasonAllBookiesWritable, message, generation)
+		in.setCondition(ConditionClusterUnavailable, v1.ConditionFalse, ReasonAllBookiesWritable, message, generation)
+		in.setCondition(ConditionClusterPreparing, v1.ConditionFalse, ReasonAllBookiesWritable, message, generation)
+	case writable >= writeQuorum:
+		message := fmt.Sprintf("%d of the %d bookies are writable, the write quorum size is %d",
+			writable, size, writeQuorum)
+		in.setCondition(ConditionClusterReady, v1.ConditionFalse, ReasonBookiesNotWritable, message, generation)
+		in.setCondition(ConditionClusterDegraded, v1.ConditionTrue, ReasonBookiesNotWritable, message, generation)
+		in.setCondition(ConditionClusterUnavailable, v1.ConditionFalse, ReasonBookiesNotWritable, message, generation)
+	default:
+		message := fmt.Sprintf("%d of the %d bookies are writable, below the write quorum size %d",
+			writable, size, writeQuorum)
+		in.setCondition(ConditionClusterReady, v1.ConditionFalse, ReasonBelowWriteQuorum, message, generation)
+		in.setCondition(ConditionClusterDegraded, v1.ConditionFalse, ReasonBelowWriteQuorum, message, generation)
+		in.setCondition(ConditionClusterUnavailable, v1.ConditionTrue, ReasonBelowWriteQuorum, message, generation)
+	}
+}
+
+func (in *BookkeeperClusterStatus) SetPreparingCondition(generation int64) {
+	in.setCondition(ConditionClusterPreparing, v1.ConditionTrue, ReasonClusterCreated, "deploying the pods", generation)
 }
 
-func (in *BookkeeperClusterStatus) SetPodsReadyConditionFalse() {
-	in.setCondition(ConditionClusterReady, v1.ConditionFalse, "", "")
+// SetCondition sets the condition of the specified type
+func (in *BookkeeperClusterStatus) SetCondition(condType ConditionType, status v1.ConditionStatus,
+	reason, message string, generation int64) {
+	in.setCondition(condType, status, reason, message, generation)
 }
 
-func (in *BookkeeperClusterStatus) SetPreparingCondition() {
-	in.setCondition(ConditionClusterPreparing, v1.ConditionTrue, "deploying the pods", "")
+// IsConditionTrue checks whether the condition of the specified type is true
+func (in *BookkeeperClusterStatus) IsConditionTrue(typ ConditionType) bool {
+	_, condition := in.GetCondition(typ)
+	return condition != nil && condition.Status == v1.ConditionTrue
 }
 
 func (in *BookkeeperClusterStatus) GetCondition(typ ConditionType) (int, *ClusterCondition) {
@@ -138,7 +342,8 @@ func (in *BookkeeperClusterStatus) GetCondition(typ ConditionType) (int, *Cluste
 	return -1, nil
 }
 
-func (in *BookkeeperClusterStatus) setCondition(condType ConditionType, status v1.ConditionStatus, reason, message string) {
+func (in *BookkeeperClusterStatus) setCondition(condType ConditionType, status v1.ConditionStatus,
+	reason, message string, generation int64) {
 	newCond := &ClusterCondition{
 		Type:               condType,
 		Status:             status,
@@ -146,6 +351,7 @@ func (in *BookkeeperClusterStatus) setCondition(condType ConditionType, status v
 		Message:            message,
 		LastUpdateTime:     "",
 		LastTransitionTime: "",
+		ObservedGeneration: generation,
 	}
 	now := time.Now().Format(time.RFC3339)
 	position, old := in.GetCondition(newCond.Type)
@@ -155,14 +361,58 @@ func (in *BookkeeperClusterStatus) setCondition(condType ConditionType, status v
 			old.LastTransitionTime = now
 			old.LastUpdateTime = now
 		}
-
-		if old.Reason != newCond.Reason || old.Message != newCond.Message {
+		if old.Reason != newCond.Reason || old.Message != newCond.Message ||
+			old.ObservedGeneration != newCond.ObservedGeneration {
 			old.Reason = newCond.Reason
 			old.Message = newCond.Message
+			old.ObservedGeneration = newCond.ObservedGeneration
 			old.LastUpdateTime = now
 		}
 		in.Conditions[position] = *old
 		return
 	}
+	newCond.LastTransitionTime = now
+	newCond.LastUpdateTime = now
 	in.Conditions = append(in.Conditions, *newCond)
 }
+
+func (in *BookkeeperClusterStatus) removeCondition(typ ConditionType) bool {
+	position, _ := in.GetCondition(typ)
+	if position < 0 {
+		return false
+	}
+	in.Conditions = append(in.Conditions[:position], in.Conditions[position+1:]...)
+	return true
+}
+
+// DecommissionPhase defines the phase of a bookie decommission
+type DecommissionPhase string
+
+const (
+	// DecommissionPhaseReadOnly the bookie is being made read-only
+	DecommissionPhaseReadOnly DecommissionPhase = "ReadOnly"
+	// DecommissionPhaseStopping the bookie pod is being removed from the statefulset
+	DecommissionPhaseStopping DecommissionPhase = "Stopping"
+	// DecommissionPhaseDecommissioning the decommission of the stopped bookie is being requested
+	DecommissionPhaseDecommissioning DecommissionPhase = "Decommissioning"
+	// DecommissionPhaseRecovering the ledgers of the bookie are being re-replicated
+	DecommissionPhaseRecovering DecommissionPhase = "Recovering"
+	// DecommissionPhaseCleaningUp the cookie and the PVCs of the bookie are being deleted
+	DecommissionPhaseCleaningUp DecommissionPhase = "CleaningUp"
+)
+
+// Decommission is the status of the bookie being decommissioned
+type Decommission struct {
+	// Phase is the phase of the decommission
+	Phase DecommissionPhase `json:"phase"`
+	// Ordinal is the ordinal of the bookie being decommissioned
+	Ordinal int32 `json:"ordinal"`
+	// BookieID is the id of the bookie being decommissioned
+	BookieID string `json:"bookieId"`
+	// StepStartTime is when the current phase started
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+	// Message describes what the decommission is waiting on
+	// +optional
+	Message string `json:"message,omitempty"`
+}
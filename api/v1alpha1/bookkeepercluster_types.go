@@ -18,13 +18,20 @@ package v1alpha1
 
 import (
 	"fmt"
+	"github.com/monimesl/bookkeeper-operator/internal"
 	"github.com/monimesl/operator-helper/basetype"
 	"github.com/monimesl/operator-helper/config"
 	"github.com/monimesl/operator-helper/k8s"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
 )
 
+// AnnotationAllowUnsafeUpdate when added as "true" by an update lets it change the spec fields
+// which are otherwise immutable because they carry the bookie data. Left on the cluster, it does
+// not allow the later updates; it must be removed and added again.
+const AnnotationAllowUnsafeUpdate = internal.Domain + "/allow-unsafe-update"
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -43,6 +50,7 @@ func init() {
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:storageversion
 
 // BookkeeperCluster is the Schema for the bookkeeperclusters API
 type BookkeeperCluster struct {
@@ -90,11 +98,49 @@ func (in *BookkeeperCluster) AutoRecoveryDeploymentName() string {
 	return fmt.Sprintf("%s-bookie-autorecovery", in.generateName())
 }
 
+// AutoRecoveryEnabled returns whether the bookkeeper autorecovery is enabled for the cluster
+func (in *BookkeeperCluster) AutoRecoveryEnabled() bool {
+	return in.Spec.EnableAutoRecovery == nil || *in.Spec.EnableAutoRecovery
+}
+
+// AutoRecoveryReplicas returns the number of autorecovery pods to run; none when the autorecovery is disabled
+func (in *BookkeeperCluster) AutoRecoveryReplicas() int32 {
+	if !in.AutoRecoveryEnabled() || in.Spec.AutoRecoveryReplicas == nil {
+		return 0
+	}
+	return *in.Spec.AutoRecoveryReplicas
+}
+
+// MetadataInitJobName defines the name of the job initializing the cluster metadata
+func (in *BookkeeperCluster) MetadataInitJobName() string {
+	return fmt.Sprintf("%s-metadata-init", in.generateName())
+}
+
 // StatefulSetName defines the name of the statefulset object
 func (in *BookkeeperCluster) StatefulSetName() string {
 	return in.generateName()
 }
 
+// MonitorName defines the name of the Prometheus Operator monitor object
+func (in *BookkeeperCluster) MonitorName() string {
+	return in.generateName()
+}
+
+// MonitoringEnabled returns whether the cluster metrics are to be scraped by the Prometheus Operator
+func (in *BookkeeperCluster) MonitoringEnabled() bool {
+	return in.Spec.Monitoring != nil && in.Spec.Monitoring.Enabled
+}
+
+// PrometheusRuleName defines the name of the Prometheus Operator rule object
+func (in *BookkeeperCluster) PrometheusRuleName() string {
+	return in.generateName()
+}
+
+// AlertsEnabled returns whether the PrometheusRule of the cluster alerts is to be created
+func (in *BookkeeperCluster) AlertsEnabled() bool {
+	return in.MonitoringEnabled() && in.Spec.Monitoring.Alerts != nil && in.Spec.Monitoring.Alerts.Enabled
+}
+
 // ClientServiceName defines the name of the client service object
 func (in *BookkeeperCluster) ClientServiceName() string {
 	return in.generateName()
@@ -110,11 +156,76 @@ func (in *BookkeeperCluster) ClientServiceFQDN() string {
 	return fmt.Sprintf("%s.%s.svc.%s", in.ClientServiceName(), in.Namespace, in.Spec.ClusterDomain)
 }
 
-// ZkRootPath the zk root of this bookkeeper cluster
+// BookiePodFQDN defines the FQDN of the specified bookie pod within the headless service
+func (in *BookkeeperCluster) BookiePodFQDN(podName string) string {
+	return fmt.Sprintf("%s.%s.%s.svc.%s", podName, in.HeadlessServiceName(), in.Namespace, in.Spec.ClusterDomain)
+}
+
+// BookieID returns the id the bookie of the specified pod registers in zookeeper with.
+// The bookies use their hostname which resolves to the pod FQDN.
+func (in *BookkeeperCluster) BookieID(podName string) string {
+	return fmt.Sprintf("%s:%d", in.BookiePodFQDN(podName), in.Spec.Ports.Bookie)
+}
+
+// ZkRootPath the zk root of this bookkeeper cluster. The clusters without
+// a configured root keep the legacy path which is not namespace aware.
 func (in *BookkeeperCluster) ZkRootPath() string {
+	if in.Spec.ZkRootPath != "" {
+		return in.Spec.ZkRootPath
+	}
 	return fmt.Sprintf("/bookkeeper/%s", in.Name)
 }
 
+// zkNamespacesRootPath the tree of the namespace aware zk roots the new clusters default to
+const zkNamespacesRootPath = "/bookkeeper/namespaces"
+
+// defaultZkRootPath the namespace aware zk root the new clusters default to. A namespace and a name
+// cannot contain a slash, so the defaulted roots neither collide with nor nest each other.
+func (in *BookkeeperCluster) defaultZkRootPath() string {
+	return fmt.Sprintf("%s/%s/%s", zkNamespacesRootPath, in.Namespace, in.Name)
+}
+
+// ZkRootPathReserved checks whether the zk root encloses or is within the tree of the namespace
+// aware roots without being the own root of the cluster, e.g. the legacy root of a cluster named
+// namespaces. The tree is reserved to the defaulted roots; the metadata of the clusters there is
+// not guarded by the overlap check once their object is gone.
+func (in *BookkeeperCluster) ZkRootPathReserved() bool {
+	root := in.ZkRootPath()
+	if root == in.defaultZkRootPath() {
+		return false
+	}
+	return containsPath(root, zkNamespacesRootPath) || containsPath(zkNamespacesRootPath, root)
+}
+
+// ZkMetadataOverlaps checks whether the metadata of the clusters is stored in the same zookeeper
+// tree, i.e. their ensembles share a server and a root path contains the other one
+func (in *BookkeeperCluster) ZkMetadataOverlaps(other *BookkeeperCluster) bool {
+	servers, chroot := in.Spec.ZkEndpoints()
+	otherServers, otherChroot := other.Spec.ZkEndpoints()
+	if !containsAny(servers, otherServers) {
+		return false
+	}
+	path := chroot + in.ZkRootPath()
+	otherPath := otherChroot + other.ZkRootPath()
+	return containsPath(path, otherPath) || containsPath(otherPath, path)
+}
+
+// containsPath checks whether the zk path is the same as or nested in the parent path
+func containsPath(parent, path string) bool {
+	return path == parent || strings.HasPrefix(path, strings.TrimSuffix(parent, "/")+"/")
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // ZkLedgersRootPath the zkLedgersRootPath of this bookkeeper cluster
 func (in *BookkeeperCluster) ZkLedgersRootPath() string {
 	return fmt.Sprintf("%s/ledgers", in.ZkRootPath())
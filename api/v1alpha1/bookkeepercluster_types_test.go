@@ -0,0 +1,216 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"github.com/monimesl/operator-helper/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+)
+
+// clusterListReader lists the specified clusters
+type clusterListReader struct {
+	client.Reader
+	clusters []BookkeeperCluster
+}
+
+func (r *clusterListReader) List(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	list.(*BookkeeperClusterList).Items = r.clusters
+	return nil
+}
+
+func newZkCluster(namespace, name, zkServers, zkRootPath string) *BookkeeperCluster {
+	return &BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       BookkeeperClusterSpec{ZkServers: zkServers, ZkRootPath: zkRootPath},
+	}
+}
+
+func TestDefaultZkRootPath(t *testing.T) {
+	config.GetLogger("test")
+	cluster := newZkCluster("pulsar", "pulsar", "zk:2181", "")
+	cluster.Default()
+	if cluster.Spec.ZkRootPath != "/bookkeeper/namespaces/pulsar/pulsar" {
+		t.Errorf("unexpected default zkRootPath %q", cluster.Spec.ZkRootPath)
+	}
+	legacy := newZkCluster("pulsar", "pulsar", "zk:2181", "")
+	if legacy.ZkRootPath() != "/bookkeeper/pulsar" {
+		t.Errorf("unexpected legacy zkRootPath %q", legacy.ZkRootPath())
+	}
+	if cluster.ZkMetadataOverlaps(legacy) {
+		t.Errorf("the default zkRootPath %q overlaps the legacy %q", cluster.ZkRootPath(), legacy.ZkRootPath())
+	}
+	existing := newZkCluster("default", "bk", "zk:2181", "")
+	existing.CreationTimestamp = metav1.Now()
+	existing.Default()
+	if existing.Spec.ZkRootPath != "" {
+		t.Errorf("the existing cluster is defaulted the zkRootPath %q", existing.Spec.ZkRootPath)
+	}
+	explicit := newZkCluster("default", "bk", "zk:2181", "/custom/bk")
+	explicit.Default()
+	if explicit.Spec.ZkRootPath != "/custom/bk" {
+		t.Errorf("the specified zkRootPath is overridden by %q", explicit.Spec.ZkRootPath)
+	}
+}
+
+func TestZkMetadataOverlaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		cluster  *BookkeeperCluster
+		other    *BookkeeperCluster
+		overlaps bool
+	}{
+		{
+			name:     "same legacy path",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181", ""),
+			other:    newZkCluster("ns2", "bk", "zk:2181", ""),
+			overlaps: true,
+		},
+		{
+			name:     "same path on other ensembles",
+			cluster:  newZkCluster("ns1", "bk", "zk-a:2181", ""),
+			other:    newZkCluster("ns2", "bk", "zk-b:2181", ""),
+			overlaps: false,
+		},
+		{
+			name:     "a shared server",
+			cluster:  newZkCluster("ns1", "bk", "zk-a:2181,zk-b:2181", "/bk"),
+			other:    newZkCluster("ns2", "bk", "zk-b:2181, zk-c:2181", "/bk"),
+			overlaps: true,
+		},
+		{
+			name:     "nested path",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181", "/bookkeeper/bk/nested"),
+			other:    newZkCluster("ns2", "bk", "zk:2181", "/bookkeeper/bk"),
+			overlaps: true,
+		},
+		{
+			name:     "enclosing path",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181", "/bookkeeper"),
+			other:    newZkCluster("ns2", "bk", "zk:2181", ""),
+			overlaps: true,
+		},
+		{
+			name:     "common path prefix",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181", "/bookkeeper/bk"),
+			other:    newZkCluster("ns2", "bk", "zk:2181", "/bookkeeper/bk2"),
+			overlaps: false,
+		},
+		{
+			name:     "path within the chroot of the other",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181", "/a/bookkeeper/bk"),
+			other:    newZkCluster("ns2", "bk", "zk:2181/a", "/bookkeeper/bk"),
+			overlaps: true,
+		},
+		{
+			name:     "other chroots",
+			cluster:  newZkCluster("ns1", "bk", "zk:2181/a", "/bookkeeper/bk"),
+			other:    newZkCluster("ns2", "bk", "zk:2181/b", "/bookkeeper/bk"),
+			overlaps: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cluster.ZkMetadataOverlaps(tt.other); got != tt.overlaps {
+				t.Errorf("ZkMetadataOverlaps() = %v, want %v", got, tt.overlaps)
+			}
+			if got := tt.other.ZkMetadataOverlaps(tt.cluster); got != tt.overlaps {
+				t.Errorf("reversed ZkMetadataOverlaps() = %v, want %v", got, tt.overlaps)
+			}
+		})
+	}
+}
+
+func TestZkRootPathReserved(t *testing.T) {
+	tests := []struct {
+		name     string
+		cluster  *BookkeeperCluster
+		reserved bool
+	}{
+		{name: "own namespace aware path", cluster: newZkCluster("ns", "bk", "zk:2181", "/bookkeeper/namespaces/ns/bk")},
+		{name: "legacy path", cluster: newZkCluster("ns", "bk", "zk:2181", "")},
+		{name: "custom path", cluster: newZkCluster("ns", "bk", "zk:2181", "/custom/bk")},
+		{name: "legacy path of a cluster named namespaces", cluster: newZkCluster("ns", "namespaces", "zk:2181", ""), reserved: true},
+		{name: "enclosing path", cluster: newZkCluster("ns", "bk", "zk:2181", "/bookkeeper"), reserved: true},
+		{name: "root path", cluster: newZkCluster("ns", "bk", "zk:2181", "/"), reserved: true},
+		{name: "namespace path", cluster: newZkCluster("ns", "bk", "zk:2181", "/bookkeeper/namespaces/ns"), reserved: true},
+		{name: "other cluster path", cluster: newZkCluster("ns", "bk", "zk:2181", "/bookkeeper/namespaces/ns/bk2"), reserved: true},
+		{name: "nested path", cluster: newZkCluster("ns", "bk", "zk:2181", "/bookkeeper/namespaces/ns/bk/nested"), reserved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cluster.ZkRootPathReserved(); got != tt.reserved {
+				t.Errorf("ZkRootPathReserved() = %v, want %v", got, tt.reserved)
+			}
+		})
+	}
+}
+
+func TestValidateZkRootPathOwnership(t *testing.T) {
+	deleting := newZkCluster("ns2", "bk", "zk:2181", "")
+	deleting.DeletionTimestamp = &metav1.Time{Time: metav1.Now().Time}
+	tests := []struct {
+		name       string
+		zkRootPath string
+		existing   []BookkeeperCluster
+		errors     int
+	}{
+		{name: "no cluster"},
+		{
+			name:     "itself",
+			existing: []BookkeeperCluster{*newZkCluster("ns1", "bk", "zk:2181", "")},
+		},
+		{
+			name:     "a live overlapping cluster",
+			existing: []BookkeeperCluster{*newZkCluster("ns2", "bk", "zk:2181", "")},
+			errors:   1,
+		},
+		{
+			name:     "a deleted overlapping cluster",
+			existing: []BookkeeperCluster{*deleting},
+		},
+		{
+			name:     "a cluster of another ensemble",
+			existing: []BookkeeperCluster{*newZkCluster("ns2", "bk", "zk-b:2181", "")},
+		},
+		{
+			name:       "a legacy cluster named namespaces",
+			zkRootPath: "/bookkeeper/namespaces/ns1/bk",
+			existing:   []BookkeeperCluster{*newZkCluster("ns2", "namespaces", "zk:2181", "")},
+			errors:     1,
+		},
+		{
+			name:       "a path reserved to the namespace aware paths",
+			zkRootPath: "/bookkeeper/namespaces/ns2/bk",
+			errors:     1,
+		},
+	}
+	defer SetWebhookClusterReader(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetWebhookClusterReader(&clusterListReader{clusters: tt.existing})
+			cluster := newZkCluster("ns1", "bk", "zk:2181", tt.zkRootPath)
+			errs := cluster.validateZkRootPathOwnership(field.NewPath("spec", "zkRootPath"))
+			if len(errs) != tt.errors {
+				t.Errorf("validateZkRootPathOwnership() = %v, want %d errors", errs, tt.errors)
+			}
+		})
+	}
+}
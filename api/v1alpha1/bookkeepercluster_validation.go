@@ -0,0 +1,510 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net"
+	"path"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strconv"
+	"strings"
+)
+
+// validate validates the cluster spec and returns the non-fatal warnings
+// along with the aggregated invalid error if any of the rules failed.
+// The old cluster is nil on create.
+func (in *BookkeeperCluster) validate(old *BookkeeperCluster) (admission.Warnings, error) {
+	specPath := field.NewPath("spec")
+	allErrs := field.ErrorList{}
+	allErrs = append(allErrs, validateZkServers(in.Spec.ZkServers, specPath.Child("zkServers"))...)
+	allErrs = append(allErrs, validateZkConfig(in.Spec.ZkConfig, specPath.Child("zkConfig"))...)
+	allErrs = append(allErrs, in.Spec.validateSize(specPath)...)
+	allErrs = append(allErrs, validatePorts(in.Spec.Ports, specPath.Child("ports"))...)
+	allErrs = append(allErrs, validateDirectories(in.Spec.Directories, specPath.Child("directories"))...)
+	allErrs = append(allErrs, validatePersistence(in.Spec.Persistence, specPath.Child("persistence"))...)
+	allErrs = append(allErrs, metav1validation.ValidateLabels(in.Spec.Labels, specPath.Child("labels"))...)
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(in.Spec.Annotations, specPath.Child("annotations"))...)
+	warnings := in.Spec.warnings(specPath)
+	if old == nil || in.ZkRootPath() != old.ZkRootPath() || in.Spec.ZkServers != old.Spec.ZkServers {
+		// the path is taken over on create and on the forced change of the path or the ensemble
+		allErrs = append(allErrs, in.validateZkRootPathOwnership(specPath.Child("zkRootPath"))...)
+	}
+	if old != nil {
+		immutableErrs := in.Spec.validateImmutableFields(&old.Spec, specPath)
+		immutableErrs = append(immutableErrs, in.validateScaleDown(old, specPath)...)
+		if in.ZkRootPath() != old.ZkRootPath() {
+			immutableErrs = append(immutableErrs, field.Forbidden(specPath.Child("zkRootPath"),
+				fmt.Sprintf("the zookeeper root path holds the cluster metadata; the bookies would no longer find "+
+					"their ledgers metadata and cookies; add the annotation %s=true in the same update to force the change",
+					AnnotationAllowUnsafeUpdate)))
+		}
+		if in.unsafeUpdateAllowed(old) {
+			for _, err := range immutableErrs {
+				warnings = append(warnings, fmt.Sprintf("%s: forced by the %s annotation",
+					err.Field, AnnotationAllowUnsafeUpdate))
+			}
+		} else {
+			allErrs = append(allErrs, immutableErrs...)
+		}
+	}
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(GroupVersion.WithKind("BookkeeperCluster").GroupKind(), in.Name, allErrs)
+}
+
+// unsafeUpdateAllowed checks whether the update adds the unsafe update annotation. The annotation left
+// on the cluster by a previous update does not allow the later ones, it must be added again.
+func (in *BookkeeperCluster) unsafeUpdateAllowed(old *BookkeeperCluster) bool {
+	return in.Annotations[AnnotationAllowUnsafeUpdate] == "true" && old.Annotations[AnnotationAllowUnsafeUpdate] != "true"
+}
+
+// validateImmutableFields rejects the changes which would leave the existing bookie data orphaned
+func (in *BookkeeperClusterSpec) validateImmutableFields(old *BookkeeperClusterSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	forbid := func(fldPath *field.Path, reason string) {
+		allErrs = append(allErrs, field.Forbidden(fldPath, fmt.Sprintf("%s; add the annotation %s=true in the same update to force the change",
+			reason, AnnotationAllowUnsafeUpdate)))
+	}
+	if old.Directories != nil && in.Directories != nil {
+		dirsPath := fldPath.Child("directories")
+		dirsReason := "the bookies would start on empty directories and no longer find their journal, ledgers and cookie"
+		if in.Directories.JournalDir != old.Directories.JournalDir {
+			forbid(dirsPath.Child("journalDir"), dirsReason)
+		}
+		if in.Directories.LedgerDirs != old.Directories.LedgerDirs {
+			forbid(dirsPath.Child("ledgerDirs"), dirsReason)
+		}
+		if in.Directories.IndexDirs != old.Directories.IndexDirs {
+			forbid(dirsPath.Child("indexDirs"), dirsReason)
+		}
+	}
+	if old.Ports != nil && in.Ports != nil && old.Ports.Bookie != 0 && in.Ports.Bookie != old.Ports.Bookie {
+		forbid(fldPath.Child("ports", "bookie"), "the bookie port is part of the bookie ID recorded "+
+			"in the ledgers metadata; the existing ledgers would reference bookies which no longer exist")
+	}
+	_, oldChroot := old.ZkEndpoints()
+	if _, chroot := in.ZkEndpoints(); chroot != oldChroot {
+		forbid(fldPath.Child("zkServers"), "the zookeeper chroot holds the cluster metadata; "+
+			"the bookies would no longer find their ledgers metadata and cookies")
+	}
+	if old.ClusterDomain != "" && in.ClusterDomain != old.ClusterDomain {
+		forbid(fldPath.Child("clusterDomain"), "the cluster domain is part of the bookie ID recorded "+
+			"in the ledgers metadata; the existing ledgers would reference bookies which no longer exist")
+	}
+	if old.Persistence != nil && in.Persistence != nil {
+		persistencePath := fldPath.Child("persistence")
+		for _, claim := range []struct {
+			name     string
+			old, new *v1.PersistentVolumeClaimSpec
+		}{
+			{"journal", old.Persistence.JournalVolumeClaimSpec, in.Persistence.JournalVolumeClaimSpec},
+			{"ledger", old.Persistence.LedgerVolumeClaimSpec, in.Persistence.LedgerVolumeClaimSpec},
+			{"index", old.Persistence.IndexVolumeClaimSpec, in.Persistence.IndexVolumeClaimSpec},
+		} {
+			if claim.old != nil && !apiequality.Semantic.DeepEqual(claim.old, claim.new) {
+				forbid(persistencePath.Child(claim.name), "the volume claim templates of the bookie "+
+					"statefulset are immutable; a new claim would leave the existing volumes orphaned")
+			}
+		}
+	}
+	if !labelsEqual(userLabels(in.Labels), userLabels(old.Labels)) {
+		forbid(fldPath.Child("labels"), "the labels form the immutable selector of the bookie statefulset; "+
+			"changing them would leave the existing bookies and their volumes orphaned")
+	}
+	return allErrs
+}
+
+// validateScaleDown rejects the scale down to zero and the scale down without the autorecovery, the ledgers
+// of the decommissioned bookies are re-replicated by the autorecovery onto the remaining bookies and the
+// decommission would stall without it. The last bookie has no peer to re-replicate its ledgers to.
+func (in *BookkeeperCluster) validateScaleDown(old *BookkeeperCluster, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if !in.DeletionTimestamp.IsZero() {
+		// the finalizer scales the deleted cluster down to zero without decommissioning its bookies
+		return allErrs
+	}
+	if in.Spec.Size != nil && *in.Spec.Size == 0 && old.Spec.Size != nil && *old.Spec.Size > 0 {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("size"),
+			fmt.Sprintf("the last bookie has no peer to re-replicate its ledgers to; the scale down to zero "+
+				"would delete the cluster ledgers; add the annotation %s=true in the same update to force the change",
+				AnnotationAllowUnsafeUpdate)))
+		return allErrs
+	}
+	if in.AutoRecoveryEnabled() {
+		return allErrs
+	}
+	if in.Spec.Size != nil && old.Spec.Size != nil && *in.Spec.Size < *old.Spec.Size {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("size"),
+			fmt.Sprintf("the decommissioned bookies ledgers are re-replicated by the autorecovery; the scale down "+
+				"would stall with the autorecovery disabled; add the annotation %s=true in the same update to force the change",
+				AnnotationAllowUnsafeUpdate)))
+	} else if old.AutoRecoveryEnabled() && old.Status.Decommission != nil {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("enableAutoRecovery"),
+			fmt.Sprintf("the bookie %s is being decommissioned; its ledgers are re-replicated by the autorecovery; "+
+				"add the annotation %s=true in the same update to force the change", old.Status.Decommission.BookieID,
+				AnnotationAllowUnsafeUpdate)))
+	}
+	return allErrs
+}
+
+// userLabels returns the labels excluding the ones managed by the operator
+func userLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	for _, label := range operatorManagedLabels {
+		delete(res, label)
+	}
+	return res
+}
+
+func labelsEqual(l1, l2 map[string]string) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	for k, v := range l1 {
+		if l2v, ok := l2[k]; !ok || l2v != v {
+			return false
+		}
+	}
+	return true
+}
+
+// validateZkRootPathOwnership refuses the cluster whose zookeeper metadata would be stored in
+// the tree of an existing cluster or in the tree reserved to the namespace aware roots, the
+// clusters would corrupt and delete each other's metadata
+func (in *BookkeeperCluster) validateZkRootPathOwnership(fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if in.ZkRootPathReserved() {
+		allErrs = append(allErrs, field.Invalid(fldPath, in.ZkRootPath(),
+			fmt.Sprintf("the zookeeper path overlaps the tree %s reserved to the namespace aware paths, "+
+				"only the path %s is allowed there", zkNamespacesRootPath, in.defaultZkRootPath())))
+	}
+	if clusterReader == nil {
+		return allErrs
+	}
+	clusters := &BookkeeperClusterList{}
+	if err := clusterReader.List(context.TODO(), clusters); err != nil {
+		return append(allErrs, field.InternalError(fldPath, fmt.Errorf("error on listing the clusters: %w", err)))
+	}
+	for i := range clusters.Items {
+		other := &clusters.Items[i]
+		if other.Namespace == in.Namespace && other.Name == in.Name {
+			continue
+		}
+		if !other.DeletionTimestamp.IsZero() {
+			// its metadata is being released
+			continue
+		}
+		if in.ZkMetadataOverlaps(other) {
+			allErrs = append(allErrs, field.Invalid(fldPath, in.ZkRootPath(),
+				fmt.Sprintf("the zookeeper path overlaps the path %s of the cluster %s/%s",
+					other.ZkRootPath(), other.Namespace, other.Name)))
+		}
+	}
+	return allErrs
+}
+
+func validateZkServers(zkServers string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	servers, chroot := ParseZkConnectString(zkServers)
+	if len(servers) == 0 {
+		return append(allErrs, field.Required(fldPath, "the zookeeper servers must be specified"))
+	}
+	for _, server := range servers {
+		if err := validateHostPort(server); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, zkServers,
+				fmt.Sprintf("%q is not a valid host:port pair: %s", server, err)))
+		}
+	}
+	if chroot != "" && path.Clean(chroot) != chroot {
+		allErrs = append(allErrs, field.Invalid(fldPath, zkServers,
+			fmt.Sprintf("%q is not a valid zookeeper chroot path", chroot)))
+	}
+	return allErrs
+}
+
+func validateZkConfig(zkConfig *ZkConfig, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if zkConfig == nil {
+		return allErrs
+	}
+	if zkConfig.Auth != nil {
+		allErrs = append(allErrs, validateSecretName(zkConfig.Auth.SecretName,
+			fldPath.Child("auth", "secretName"), "the zookeeper credentials secret must be specified")...)
+	}
+	if zkConfig.TLS != nil {
+		allErrs = append(allErrs, validateSecretName(zkConfig.TLS.SecretName,
+			fldPath.Child("tls", "secretName"), "the zookeeper TLS secret must be specified")...)
+	}
+	return allErrs
+}
+
+func validateSecretName(name string, fldPath *field.Path, requiredMsg string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if name == "" {
+		return append(allErrs, field.Required(fldPath, requiredMsg))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, msg))
+	}
+	return allErrs
+}
+
+// ValidateZkEndpoints checks the zookeeper endpoints parsed from a connection string
+// are not empty and are valid host:port pairs
+func ValidateZkEndpoints(servers []string) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("the zookeeper servers must be specified")
+	}
+	for _, server := range servers {
+		if err := validateHostPort(server); err != nil {
+			return fmt.Errorf("%q is not a valid host:port pair: %w", server, err)
+		}
+	}
+	return nil
+}
+
+func validateHostPort(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(errs) > 0 {
+			return fmt.Errorf("invalid host: %s", strings.Join(errs, ", "))
+		}
+	}
+	if p, err := strconv.Atoi(port); err != nil || validation.IsValidPortNum(p) != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+	return nil
+}
+
+func (in *BookkeeperClusterSpec) validateSize(fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if in.MaxUnavailableNodes < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxUnavailableNodes"),
+			in.MaxUnavailableNodes, "must be greater than or equal to 0"))
+	}
+	quorum, err := in.Quorum()
+	if err != nil {
+		return append(allErrs, field.Invalid(fldPath.Child("bkConfig"), in.BkConfig, err.Error()))
+	}
+	bkConfigPath := fldPath.Child("bkConfig")
+	if quorum.EnsembleSize < 0 {
+		allErrs = append(allErrs, field.Invalid(bkConfigPath.Key(BkConfigEnsembleSize),
+			quorum.EnsembleSize, "must be greater than 0"))
+	}
+	if quorum.WriteQuorumSize < 0 {
+		allErrs = append(allErrs, field.Invalid(bkConfigPath.Key(BkConfigWriteQuorumSize),
+			quorum.WriteQuorumSize, "must be greater than 0"))
+	}
+	if quorum.AckQuorumSize < 0 {
+		allErrs = append(allErrs, field.Invalid(bkConfigPath.Key(BkConfigAckQuorumSize),
+			quorum.AckQuorumSize, "must be greater than 0"))
+	}
+	if quorum.EnsembleSize > 0 && quorum.WriteQuorumSize > quorum.EnsembleSize {
+		allErrs = append(allErrs, field.Invalid(bkConfigPath.Key(BkConfigWriteQuorumSize),
+			quorum.WriteQuorumSize, fmt.Sprintf("must not be greater than the %s (%d)",
+				BkConfigEnsembleSize, quorum.EnsembleSize)))
+	}
+	if quorum.WriteQuorumSize > 0 && quorum.AckQuorumSize > quorum.WriteQuorumSize {
+		allErrs = append(allErrs, field.Invalid(bkConfigPath.Key(BkConfigAckQuorumSize),
+			quorum.AckQuorumSize, fmt.Sprintf("must not be greater than the %s (%d)",
+				BkConfigWriteQuorumSize, quorum.WriteQuorumSize)))
+	}
+	if in.Size == nil || *in.Size == 0 {
+		// A cluster scaled down to zero has no quorum to satisfy
+		return allErrs
+	}
+	size := *in.Size
+	for _, q := range []struct {
+		key   string
+		value int32
+	}{
+		{BkConfigEnsembleSize, quorum.EnsembleSize},
+		{BkConfigWriteQuorumSize, quorum.WriteQuorumSize},
+		{BkConfigAckQuorumSize, quorum.AckQuorumSize},
+	} {
+		if q.value > size {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("size"), size,
+				fmt.Sprintf("must be at least the %s (%d)", q.key, q.value)))
+		}
+	}
+	return allErrs
+}
+
+func validatePorts(ports *Ports, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if ports == nil {
+		return allErrs
+	}
+	seen := map[int32]string{}
+	for _, p := range []struct {
+		name string
+		port int32
+	}{
+		{"bookie", ports.Bookie},
+		{"admin", ports.Admin},
+		{"metrics", ports.Metrics},
+	} {
+		if p.port == 0 {
+			// Defaulted by the mutating webhook
+			continue
+		}
+		if validation.IsValidPortNum(int(p.port)) != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(p.name), p.port,
+				"must be between 1 and 65535, inclusive"))
+			continue
+		}
+		if other, ok := seen[p.port]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Child(p.name),
+				fmt.Sprintf("%d is already used by the %s port", p.port, other)))
+			continue
+		}
+		seen[p.port] = p.name
+	}
+	return allErrs
+}
+
+func validateDirectories(directories *Directories, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if directories == nil {
+		return allErrs
+	}
+	if strings.Contains(directories.JournalDir, ",") {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("journalDir"), directories.JournalDir,
+			"only a single journal directory is supported since the journal volume is mounted once"))
+	}
+	seen := map[string]string{}
+	for _, dirs := range []struct {
+		name  string
+		value string
+	}{
+		{"journalDir", directories.JournalDir},
+		{"ledgerDirs", directories.LedgerDirs},
+		{"indexDirs", directories.IndexDirs},
+	} {
+		if dirs.value == "" {
+			// Defaulted by the mutating webhook
+			continue
+		}
+		for _, dir := range strings.Split(dirs.value, ",") {
+			dir = strings.TrimSpace(dir)
+			switch {
+			case dir == "":
+				allErrs = append(allErrs, field.Invalid(fldPath.Child(dirs.name), dirs.value,
+					"must not contain an empty directory"))
+				continue
+			case !path.IsAbs(dir):
+				allErrs = append(allErrs, field.Invalid(fldPath.Child(dirs.name), dirs.value,
+					fmt.Sprintf("%q must be an absolute path", dir)))
+				continue
+			}
+			dir = path.Clean(dir)
+			for other, otherName := range seen {
+				if dir == other || strings.HasPrefix(dir, other+"/") || strings.HasPrefix(other, dir+"/") {
+					allErrs = append(allErrs, field.Invalid(fldPath.Child(dirs.name), dirs.value,
+						fmt.Sprintf("%q overlaps the %s directory %q; each directory needs its own mount", dir, otherName, other)))
+				}
+			}
+			seen[dir] = dirs.name
+		}
+	}
+	return allErrs
+}
+
+func validatePersistence(persistence *Persistence, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if persistence == nil {
+		return allErrs
+	}
+	for _, claim := range []struct {
+		name string
+		spec *v1.PersistentVolumeClaimSpec
+	}{
+		{"journal", persistence.JournalVolumeClaimSpec},
+		{"ledger", persistence.LedgerVolumeClaimSpec},
+		{"index", persistence.IndexVolumeClaimSpec},
+	} {
+		if claim.spec == nil {
+			// Defaulted by the mutating webhook
+			continue
+		}
+		claimPath := fldPath.Child(claim.name)
+		if len(claim.spec.AccessModes) == 0 {
+			allErrs = append(allErrs, field.Required(claimPath.Child("accessModes"),
+				fmt.Sprintf("the %s volume claim must specify at least one access mode", claim.name)))
+		}
+		storage, ok := claim.spec.Resources.Requests[v1.ResourceStorage]
+		if !ok || storage.Sign() <= 0 {
+			allErrs = append(allErrs, field.Required(claimPath.Child("resources", "requests", string(v1.ResourceStorage)),
+				fmt.Sprintf("the %s volume claim must request a positive storage size", claim.name)))
+		}
+	}
+	return allErrs
+}
+
+func (in *BookkeeperClusterSpec) warnings(fldPath *field.Path) admission.Warnings {
+	var warnings admission.Warnings
+	if in.Size != nil {
+		switch size := *in.Size; {
+		case size == 0:
+			warnings = append(warnings, fmt.Sprintf("%s is 0; the cluster has no bookies",
+				fldPath.Child("size")))
+		case size < minimumClusterSize:
+			warnings = append(warnings, fmt.Sprintf("%s is %d; at least %d bookies are recommended",
+				fldPath.Child("size"), size, minimumClusterSize))
+		case in.MaxUnavailableNodes >= size:
+			warnings = append(warnings, fmt.Sprintf("%s (%d) allows every bookie to be disrupted at once",
+				fldPath.Child("maxUnavailableNodes"), in.MaxUnavailableNodes))
+		}
+	}
+	if in.Directories != nil {
+		for _, dirs := range []struct {
+			name  string
+			value string
+		}{
+			{"ledgerDirs", in.Directories.LedgerDirs},
+			{"indexDirs", in.Directories.IndexDirs},
+		} {
+			if n := len(strings.Split(dirs.value, ",")); n > 1 {
+				warnings = append(warnings, fmt.Sprintf("%s: the %d directories share a single volume "+
+					"and will not spread the I/O across disks", fldPath.Child("directories", dirs.name), n))
+			}
+		}
+	}
+	for _, label := range operatorManagedLabels {
+		if _, ok := in.Labels[label]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s: the label %q is managed by the operator and will be overridden",
+				fldPath.Child("labels"), label))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,438 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newValidCluster() *BookkeeperCluster {
+	cluster := &BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "bk", Namespace: "default"},
+		Spec: BookkeeperClusterSpec{
+			Size:       int32Ptr(3),
+			ZkServers:  "zk-0.zk:2181,zk-1.zk:2181/bk",
+			ZkRootPath: "/bookkeeper/namespaces/default/bk",
+			BkConfig: map[string]string{
+				BkConfigEnsembleSize:    "3",
+				BkConfigWriteQuorumSize: "2",
+				BkConfigAckQuorumSize:   "2",
+			},
+		},
+	}
+	cluster.SetSpecDefaults()
+	return cluster
+}
+
+func newVolumeClaimSpec(storage string) *v1.PersistentVolumeClaimSpec {
+	return &v1.PersistentVolumeClaimSpec{
+		AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(storage)},
+		},
+	}
+}
+
+// invalidFields returns the sorted fields of the causes of the invalid error
+func invalidFields(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	statusErr, ok := err.(*apierrors.StatusError)
+	if !ok || !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an invalid error, got %v", err)
+	}
+	var fields []string
+	for _, cause := range statusErr.Status().Details.Causes {
+		fields = append(fields, cause.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func assertInvalidFields(t *testing.T, err error, expected []string) {
+	t.Helper()
+	if fields := invalidFields(t, err); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected the invalid fields %v, got %v: %v", expected, fields, err)
+	}
+}
+
+func assertWarnings(t *testing.T, warnings []string, expected []string) {
+	t.Helper()
+	if len(warnings) != len(expected) {
+		t.Fatalf("expected the warnings %v, got %v", expected, warnings)
+	}
+	for i, warning := range warnings {
+		if !strings.Contains(warning, expected[i]) {
+			t.Errorf("expected a warning containing %q, got %q", expected[i], warning)
+		}
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(c *BookkeeperCluster)
+		fields   []string
+		warnings []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(c *BookkeeperCluster) {},
+		},
+		{
+			name:   "missing zkServers",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "only a chroot",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "/bk" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "server without a port",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk-0.zk:2181,zk-1.zk" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "server with an invalid port",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk-0.zk:70000" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "server with an invalid host",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk_0:2181" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "ip server",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "10.0.0.1:2181,[::1]:2181" },
+		},
+		{
+			name:   "unclean chroot",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk:2181/a//b" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "relative chroot",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk:2181/a/../b" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "trailing slash chroot",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk:2181/bk/" },
+		},
+		{
+			name:   "size below the ensemble",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Size = int32Ptr(2) },
+			fields: []string{"spec.size"},
+			warnings: []string{
+				"spec.size is 2",
+			},
+		},
+		{
+			name:     "size zero",
+			mutate:   func(c *BookkeeperCluster) { c.Spec.Size = int32Ptr(0) },
+			warnings: []string{"the cluster has no bookies"},
+		},
+		{
+			name: "write quorum above the ensemble",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.BkConfig[BkConfigWriteQuorumSize] = "4"
+				c.Spec.Size = int32Ptr(5)
+			},
+			fields: []string{"spec.bkConfig[" + BkConfigWriteQuorumSize + "]"},
+		},
+		{
+			name:   "ack quorum above the write quorum",
+			mutate: func(c *BookkeeperCluster) { c.Spec.BkConfig[BkConfigAckQuorumSize] = "3" },
+			fields: []string{"spec.bkConfig[" + BkConfigAckQuorumSize + "]"},
+		},
+		{
+			name:   "malformed quorum",
+			mutate: func(c *BookkeeperCluster) { c.Spec.BkConfig[BkConfigEnsembleSize] = "three" },
+			fields: []string{"spec.bkConfig"},
+		},
+		{
+			name:   "negative maxUnavailableNodes",
+			mutate: func(c *BookkeeperCluster) { c.Spec.MaxUnavailableNodes = -1 },
+			fields: []string{"spec.maxUnavailableNodes"},
+		},
+		{
+			name:     "every bookie disruptable",
+			mutate:   func(c *BookkeeperCluster) { c.Spec.MaxUnavailableNodes = 3 },
+			warnings: []string{"allows every bookie to be disrupted at once"},
+		},
+		{
+			name:   "invalid port",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Ports.Admin = 70000 },
+			fields: []string{"spec.ports.admin"},
+		},
+		{
+			name:   "duplicate ports",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Ports.Metrics = c.Spec.Ports.Bookie },
+			fields: []string{"spec.ports.metrics"},
+		},
+		{
+			name:   "multiple journal directories",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Directories.JournalDir = "/bk/journal1,/bk/journal2" },
+			fields: []string{"spec.directories.journalDir"},
+		},
+		{
+			name:   "relative directory",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Directories.LedgerDirs = "bk/ledgers" },
+			fields: []string{"spec.directories.ledgerDirs"},
+		},
+		{
+			name:   "empty directory",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Directories.LedgerDirs = "/bk/ledgers," },
+			fields: []string{"spec.directories.ledgerDirs"},
+			warnings: []string{
+				"spec.directories.ledgerDirs: the 2 directories share a single volume",
+			},
+		},
+		{
+			name: "overlapping directories",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.Directories.JournalDir = "/bk/journal"
+				c.Spec.Directories.LedgerDirs = "/bk/journal/ledgers"
+			},
+			fields: []string{"spec.directories.ledgerDirs"},
+		},
+		{
+			name:     "multiple ledger directories",
+			mutate:   func(c *BookkeeperCluster) { c.Spec.Directories.LedgerDirs = "/bk/ledgers1,/bk/ledgers2" },
+			warnings: []string{"spec.directories.ledgerDirs: the 2 directories share a single volume"},
+		},
+		{
+			name: "volume claim without an access mode",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.Persistence.LedgerVolumeClaimSpec = newVolumeClaimSpec("10Gi")
+				c.Spec.Persistence.LedgerVolumeClaimSpec.AccessModes = nil
+			},
+			fields: []string{"spec.persistence.ledger.accessModes"},
+		},
+		{
+			name: "volume claim without a storage",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.Persistence.JournalVolumeClaimSpec = newVolumeClaimSpec("0")
+			},
+			fields: []string{"spec.persistence.journal.resources.requests.storage"},
+		},
+		{
+			name:   "zk auth without a secret",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkConfig = &ZkConfig{Auth: &ZkAuth{Scheme: ZkAuthSchemeDigest}} },
+			fields: []string{"spec.zkConfig.auth.secretName"},
+		},
+		{
+			name: "zk tls with an invalid secret",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.ZkConfig = &ZkConfig{TLS: &ZkTLS{SecretName: "Invalid_Secret"}}
+			},
+			fields: []string{"spec.zkConfig.tls.secretName"},
+		},
+		{
+			name: "zk secrets",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.ZkConfig = &ZkConfig{
+					Auth: &ZkAuth{Scheme: ZkAuthSchemeDigest, SecretName: "bk-zk-auth"},
+					TLS:  &ZkTLS{SecretName: "bk-zk-tls"},
+				}
+			},
+		},
+		{
+			name:     "operator managed label",
+			mutate:   func(c *BookkeeperCluster) { c.Spec.Labels = map[string]string{"app": "bookie"} },
+			warnings: []string{`the label "app" is managed by the operator`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newValidCluster()
+			tt.mutate(cluster)
+			warnings, err := cluster.validate(nil)
+			assertInvalidFields(t, err, tt.fields)
+			assertWarnings(t, warnings, tt.warnings)
+		})
+	}
+}
+
+func TestValidateZkRootPathTakeover(t *testing.T) {
+	defer SetWebhookClusterReader(nil)
+	existing := newValidCluster()
+	existing.Namespace = "other"
+	SetWebhookClusterReader(&clusterListReader{clusters: []BookkeeperCluster{*existing}})
+	cluster := newValidCluster()
+	_, err := cluster.validate(nil)
+	assertInvalidFields(t, err, []string{"spec.zkRootPath"})
+	// checked on the change of the path only, the existing clusters are not rejected
+	if _, err = cluster.validate(newValidCluster()); err != nil {
+		t.Errorf("expected the update to be valid, got %v", err)
+	}
+	// the forced change of the path is checked too
+	existing.Spec.ZkRootPath = "/bookkeeper/shared"
+	SetWebhookClusterReader(&clusterListReader{clusters: []BookkeeperCluster{*existing}})
+	cluster.Spec.ZkRootPath = "/bookkeeper/shared"
+	cluster.Annotations = map[string]string{AnnotationAllowUnsafeUpdate: "true"}
+	_, err = cluster.validate(newValidCluster())
+	assertInvalidFields(t, err, []string{"spec.zkRootPath"})
+}
+
+func TestValidateUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(c *BookkeeperCluster)
+		fields []string
+	}{
+		{
+			name:   "scale up",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Size = int32Ptr(5) },
+		},
+		{
+			name:   "scale down",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Size = int32Ptr(2); c.Spec.BkConfig = nil },
+		},
+		{
+			name:   "journal directory",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Directories.JournalDir = "/data/journal" },
+			fields: []string{"spec.directories.journalDir"},
+		},
+		{
+			name: "ledger and index directories",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.Directories.LedgerDirs = "/data/ledgers"
+				c.Spec.Directories.IndexDirs = "/data/index"
+			},
+			fields: []string{"spec.directories.indexDirs", "spec.directories.ledgerDirs"},
+		},
+		{
+			name:   "bookie port",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Ports.Bookie = 3282 },
+			fields: []string{"spec.ports.bookie"},
+		},
+		{
+			name:   "admin port",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Ports.Admin = 8081 },
+		},
+		{
+			name:   "zk chroot",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk-0.zk:2181,zk-1.zk:2181/other" },
+			fields: []string{"spec.zkServers"},
+		},
+		{
+			name:   "zk servers",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkServers = "zk-0.zk:2181,zk-2.zk:2181/bk" },
+		},
+		{
+			name:   "zk root path",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ZkRootPath = "/bookkeeper/other" },
+			fields: []string{"spec.zkRootPath"},
+		},
+		{
+			name:   "cluster domain",
+			mutate: func(c *BookkeeperCluster) { c.Spec.ClusterDomain = "example.org" },
+			fields: []string{"spec.clusterDomain"},
+		},
+		{
+			name:   "volume claim",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Persistence.LedgerVolumeClaimSpec = newVolumeClaimSpec("1Ti") },
+			fields: []string{"spec.persistence.ledger"},
+		},
+		{
+			name:   "labels",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Labels = map[string]string{"team": "storage"} },
+			fields: []string{"spec.labels"},
+		},
+		{
+			name: "scale down without the autorecovery",
+			mutate: func(c *BookkeeperCluster) {
+				c.Spec.Size = int32Ptr(2)
+				c.Spec.BkConfig = nil
+				c.Spec.EnableAutoRecovery = boolPtr(false)
+			},
+			fields: []string{"spec.size"},
+		},
+		{
+			name:   "scale down to zero",
+			mutate: func(c *BookkeeperCluster) { c.Spec.Size = int32Ptr(0) },
+			fields: []string{"spec.size"},
+		},
+		{
+			name:   "disable the autorecovery",
+			mutate: func(c *BookkeeperCluster) { c.Spec.EnableAutoRecovery = boolPtr(false) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := newValidCluster()
+			cluster := newValidCluster()
+			tt.mutate(cluster)
+			_, err := cluster.validate(old)
+			assertInvalidFields(t, err, tt.fields)
+			// the annotation forces the change with a warning per rejected field
+			cluster.Annotations = map[string]string{AnnotationAllowUnsafeUpdate: "true"}
+			warnings, err := cluster.validate(old)
+			if err != nil {
+				t.Errorf("expected the change to be forced, got %v", err)
+			}
+			var forced []string
+			for _, warning := range warnings {
+				if strings.HasSuffix(warning, "forced by the "+AnnotationAllowUnsafeUpdate+" annotation") {
+					forced = append(forced, strings.Split(warning, ":")[0])
+				}
+			}
+			sort.Strings(forced)
+			if !reflect.DeepEqual(forced, tt.fields) {
+				t.Errorf("expected the forced fields %v, got %v", tt.fields, forced)
+			}
+			// the annotation left by a previous update does not force the change
+			old.Annotations = map[string]string{AnnotationAllowUnsafeUpdate: "true"}
+			_, err = cluster.validate(old)
+			assertInvalidFields(t, err, tt.fields)
+		})
+	}
+}
+
+func TestValidateUpdateFinalizerScaleDown(t *testing.T) {
+	old := newValidCluster()
+	old.Spec.EnableAutoRecovery = boolPtr(false)
+	old.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	cluster := old.DeepCopy()
+	cluster.Spec.Size = int32Ptr(0)
+	cluster.Spec.AutoRecoveryReplicas = int32Ptr(0)
+	if _, err := cluster.validate(old); err != nil {
+		t.Errorf("expected the scale down of the deleted cluster to be valid, got %v", err)
+	}
+}
+
+func TestValidateUpdateDisableAutoRecoveryWhileDecommissioning(t *testing.T) {
+	old := newValidCluster()
+	old.Status.Decommission = &Decommission{Phase: DecommissionPhaseRecovering, Ordinal: 3, BookieID: "bk-3"}
+	cluster := newValidCluster()
+	cluster.Spec.EnableAutoRecovery = boolPtr(false)
+	_, err := cluster.validate(old)
+	assertInvalidFields(t, err, []string{"spec.enableAutoRecovery"})
+}
@@ -17,16 +17,28 @@
 package v1alpha1
 
 import (
+	"fmt"
 	"github.com/monimesl/operator-helper/config"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+// clusterReader lists the existing clusters the created ones are checked against
+var clusterReader client.Reader
+
+// SetWebhookClusterReader sets the reader the validation webhook lists the existing clusters with.
+// The zookeeper root path collisions are not detected without it.
+func SetWebhookClusterReader(reader client.Reader) {
+	clusterReader = reader
+}
+
 // SetupWebhookWithManager needed for webhook test suite
 
 func (in *BookkeeperCluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	SetWebhookClusterReader(mgr.GetAPIReader())
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(in).
 		Complete()
@@ -41,6 +53,10 @@ var _ webhook.Defaulter = &BookkeeperCluster{}
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (in *BookkeeperCluster) Default() {
 	config.RequireRootLogger().Info("[Webhook] Setting defaults", "name", in.Name)
+	if in.CreationTimestamp.IsZero() && in.Spec.ZkRootPath == "" {
+		// only the new clusters, the existing ones keep their legacy path
+		in.Spec.ZkRootPath = in.defaultZkRootPath()
+	}
 	in.SetSpecDefaults()
 	in.SetStatusDefaults()
 }
@@ -53,23 +69,21 @@ var _ webhook.Validator = &BookkeeperCluster{}
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (in *BookkeeperCluster) ValidateCreate() (admission.Warnings, error) {
 	config.RequireRootLogger().Info("validate create", "name", in.Name)
-
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil, nil
+	return in.validate(nil)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (in *BookkeeperCluster) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
 	config.RequireRootLogger().Info("validate update", "name", in.Name)
-
-	// TODO(user): fill in your validation logic upon object update.
-	return nil, nil
+	oldCluster, ok := old.(*BookkeeperCluster)
+	if !ok {
+		return nil, fmt.Errorf("expected a BookkeeperCluster object but got %T", old)
+	}
+	return in.validate(oldCluster)
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (in *BookkeeperCluster) ValidateDelete() (admission.Warnings, error) {
 	config.RequireRootLogger().Info("validate delete", "name", in.Name)
-
-	// TODO(user): fill in your validation logic upon object deletion.
 	return nil, nil
 }
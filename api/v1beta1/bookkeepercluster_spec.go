@@ -0,0 +1,341 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1beta1
+
+import (
+	"github.com/monimesl/operator-helper/basetype"
+	"github.com/monimesl/operator-helper/k8s/pod"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// BookkeeperClusterSpec defines the desired state of BookkeeperCluster
+type BookkeeperClusterSpec struct {
+	// BookkeeperVersion defines the version of bookkeeper to use
+	// +optional
+	BookkeeperVersion string `json:"bookkeeperVersion,omitempty"`
+	// ImagePullPolicy describes a policy for if/when to pull the image
+	// +optional
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	Size *int32 `json:"size,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	AutoRecoveryReplicas *int32 `json:"autoRecoveryReplicas,omitempty"`
+	// MaxUnavailable defines the maximum number or percentage of bookies
+	// that can be unavailable as per kubernetes PodDisruptionBudget
+	// Default is 1.
+	// +optional
+	// +kubebuilder:validation:XIntOrString
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// ZkServers lists the zookeeper endpoints in the format "hostname:port".
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	ZkServers []string `json:"zkServers"`
+	// ZkChroot is the zookeeper path the cluster metadata is rooted at, e.g. "/bk"
+	// +optional
+	// +kubebuilder:validation:Pattern=`^(/[^/]+)*$`
+	ZkChroot string `json:"zkChroot,omitempty"`
+	// ZkRootPath is the zookeeper path the cluster metadata is stored under, within the chroot if any.
+	// It cannot be changed once the cluster is created.
+	// +kubebuilder:validation:Pattern=`^(/[^/]+)+$`
+	// +optional
+	ZkRootPath string `json:"zkRootPath,omitempty"`
+	// ZkConfig configures the zookeeper client of the operator
+	// +optional
+	ZkConfig *ZkConfig `json:"zkConfig,omitempty"`
+	// Quorum defines the ledger quorum settings the cluster should satisfy
+	// +optional
+	Quorum      *Quorum      `json:"quorum,omitempty"`
+	Directories *Directories `json:"directories,omitempty"`
+	Ports       *Ports       `json:"ports,omitempty"`
+	// Monitoring configures the scraping of the cluster metrics by the Prometheus Operator
+	// +optional
+	Monitoring *MonitoringConfig `json:"monitoring,omitempty"`
+	// EnableAutoRecovery indicates whether BookKeeper auto recovery is enabled.
+	// Defaults to true.
+	// +optional
+	EnableAutoRecovery *bool `json:"enableAutoRecovery,omitempty"`
+	// JVMOptions defines the JVM options for bookkeeper; this is useful for performance tuning.
+	// If unspecified, a reasonable defaults will be set
+	// +optional
+	JVMOptions JVMOptions `json:"jvmOptions"`
+	// BkConfig defines the Bookkeeper configurations to override the bk_server.conf
+	// https://github.com/apache/bookkeeper/tree/master/docker#configuration
+	// +optional
+	BkConfig map[string]string `json:"bkConfig,omitempty"`
+	// PodConfig defines common configuration for the bookkeeper pods
+	// +optional
+	PodConfig basetype.PodConfig `json:"podConfig,omitempty"`
+	// ProbeConfig defines the probing settings for the bookkeeper containers
+	// +optional
+	ProbeConfig *pod.Probes `json:"probeConfig,omitempty"`
+
+	// Persistence configures your node storage
+	// +optional
+	Persistence *Persistence `json:"persistence,omitempty"`
+
+	// Labels defines the labels to attach to the bookkeeper deployment
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations defines the annotations to attach to the bookkeeper statefulset and services
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ClusterDomain defines the cluster domain for the cluster
+	// It defaults to cluster.local
+	ClusterDomain string `json:"clusterDomain,omitempty"`
+}
+
+// Quorum defines the ledger quorum settings of the cluster
+type Quorum struct {
+	// EnsembleSize is the number of bookies a ledger is striped across
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	EnsembleSize int32 `json:"ensembleSize,omitempty"`
+	// WriteQuorumSize is the number of bookies each entry is written to
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	WriteQuorumSize int32 `json:"writeQuorumSize,omitempty"`
+	// AckQuorumSize is the number of bookies which must acknowledge each entry
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	AckQuorumSize int32 `json:"ackQuorumSize,omitempty"`
+}
+
+// ZkConfig configures how the operator connects to the zookeeper ensemble
+type ZkConfig struct {
+	// SessionTimeout is the zookeeper session timeout. Defaults to 10s.
+	// +optional
+	SessionTimeout *metav1.Duration `json:"sessionTimeout,omitempty"`
+	// ConnectionTimeout is how long to wait for the session to be established. Defaults to 10s.
+	// +optional
+	ConnectionTimeout *metav1.Duration `json:"connectionTimeout,omitempty"`
+	// Retries is the number of times in a row a transient zookeeper error is retried, by requeueing
+	// the reconciliation with an exponential backoff, before it fails the reconciliation. Defaults to 3.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Retries *int32 `json:"retries,omitempty"`
+	// Auth configures the authentication to zookeeper
+	// +optional
+	Auth *ZkAuth `json:"auth,omitempty"`
+	// TLS configures the TLS connections to zookeeper
+	// +optional
+	TLS *ZkTLS `json:"tls,omitempty"`
+}
+
+// The keys of the Secret holding the zookeeper TLS certificates
+const (
+	ZkTLSCAKey   = "ca.crt"
+	ZkTLSCertKey = "tls.crt"
+	ZkTLSKeyKey  = "tls.key"
+)
+
+// ZkTLS references the Secret holding the certificates of the zookeeper TLS connections
+// of the operator, the bookies and the autorecovery. The "ca.crt" key of the Secret holds
+// the CA the zookeeper servers are verified with.
+type ZkTLS struct {
+	// SecretName is the name of the Secret within the cluster namespace
+	// +kubebuilder:validation:Required
+	SecretName string `json:"secretName"`
+	// ClientAuth presents the client certificate of the "tls.crt" and "tls.key" keys of the Secret
+	// +optional
+	ClientAuth bool `json:"clientAuth,omitempty"`
+}
+
+// ZkAuthScheme defines how the clients authenticate to zookeeper
+// +kubebuilder:validation:Enum=digest;sasl
+type ZkAuthScheme string
+
+const (
+	// ZkAuthSchemeDigest authenticates the operator with the digest credentials
+	ZkAuthSchemeDigest ZkAuthScheme = "digest"
+	// ZkAuthSchemeSASL authenticates the bookies with SASL too
+	ZkAuthSchemeSASL ZkAuthScheme = "sasl"
+)
+
+// The keys of the Secret holding the zookeeper credentials
+const (
+	ZkAuthUsernameKey   = "username"
+	ZkAuthPasswordKey   = "password"
+	ZkAuthJaasConfigKey = "jaas.conf"
+)
+
+// ZkAuth references the Secret holding the zookeeper credentials. The operator authenticates
+// with the digest "username" and "password" keys of the Secret and creates its znodes with
+// creator-only ACLs. With the sasl scheme, the bookies also authenticate with the JAAS
+// configuration of the "jaas.conf" key and secure their znodes with zkEnableSecurity;
+// the operator then needs the digest credentials of a user allowed on the bookie znodes.
+type ZkAuth struct {
+	// Scheme is the authentication scheme, digest or sasl. Defaults to digest.
+	// +optional
+	Scheme ZkAuthScheme `json:"scheme,omitempty"`
+	// SecretName is the name of the Secret within the cluster namespace
+	// +kubebuilder:validation:Required
+	SecretName string `json:"secretName"`
+}
+
+// MonitorKind defines the kind of the Prometheus Operator monitor scraping the cluster
+type MonitorKind string
+
+const (
+	// MonitorKindServiceMonitor scrapes the pods through the headless service
+	MonitorKindServiceMonitor MonitorKind = "ServiceMonitor"
+	// MonitorKindPodMonitor scrapes the pods directly
+	MonitorKindPodMonitor MonitorKind = "PodMonitor"
+)
+
+// MonitoringConfig configures the scraping of the bookie and autorecovery
+// metrics by the Prometheus Operator, when its CRDs are installed
+type MonitoringConfig struct {
+	// Enabled defines whether this monitoring is enabled or not.
+	Enabled bool `json:"enabled,omitempty"`
+	// Kind is the kind of the monitor to create. Defaults to ServiceMonitor.
+	// +kubebuilder:validation:Enum=ServiceMonitor;PodMonitor
+	// +optional
+	Kind MonitorKind `json:"kind,omitempty"`
+	// Interval is the scrape interval, e.g. 30s. Defaults to the Prometheus one.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$`
+	// +optional
+	Interval string `json:"interval,omitempty"`
+	// ScrapeTimeout is the scrape timeout, e.g. 10s. Defaults to the Prometheus one.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$`
+	// +optional
+	ScrapeTimeout string `json:"scrapeTimeout,omitempty"`
+	// Labels defines the extra labels of the monitor, e.g. the ones the Prometheus instance selects the monitors by
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Relabelings are applied to the scraped targets before scraping
+	// +optional
+	Relabelings []RelabelConfig `json:"relabelings,omitempty"`
+	// MetricRelabelings are applied to the scraped samples before ingestion
+	// +optional
+	MetricRelabelings []RelabelConfig `json:"metricRelabelings,omitempty"`
+	// Alerts configures the PrometheusRule of the curated bookkeeper alerts
+	// +optional
+	Alerts *AlertsConfig `json:"alerts,omitempty"`
+}
+
+// AlertsConfig configures the PrometheusRule of the curated bookkeeper alerts
+type AlertsConfig struct {
+	// Enabled defines whether the alerts are enabled or not. It requires the monitoring to be enabled.
+	Enabled bool `json:"enabled,omitempty"`
+	// Labels defines the extra labels of the alerts, e.g. the ones the alerts are routed by
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Thresholds overrides the default thresholds of the alerts
+	// +optional
+	Thresholds *AlertThresholds `json:"thresholds,omitempty"`
+}
+
+// AlertThresholds defines the thresholds of the alerts; the unset ones take their default
+type AlertThresholds struct {
+	// For is how long a condition must hold before its alert fires. Defaults to 5m.
+	// +kubebuilder:validation:Pattern=`^(0|(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?)$`
+	// +optional
+	For string `json:"for,omitempty"`
+	// JournalSyncLatencyMillis is the p99 journal sync latency above which the bookie is alerted on. Defaults to 100.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	JournalSyncLatencyMillis *int32 `json:"journalSyncLatencyMillis,omitempty"`
+	// DiskUsagePercent is the ledger directory usage above which the bookie is alerted on. Defaults to 85.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	DiskUsagePercent *int32 `json:"diskUsagePercent,omitempty"`
+	// UnderReplicatedLedgersWindow is the window over which a growth of the under-replicated
+	// ledgers is alerted on. Defaults to 30m.
+	// +kubebuilder:validation:Pattern=`^(([0-9]+)h)?(([0-9]+)m)?$`
+	// +optional
+	UnderReplicatedLedgersWindow string `json:"underReplicatedLedgersWindow,omitempty"`
+}
+
+// RelabelConfig is a Prometheus relabeling rule
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	// SourceLabels are the labels whose values are concatenated and matched against the regex
+	// +optional
+	SourceLabels []string `json:"sourceLabels,omitempty"`
+	// Separator placed between the concatenated source label values. Defaults to ;
+	// +optional
+	Separator string `json:"separator,omitempty"`
+	// TargetLabel is the label the result is written to in a replace action
+	// +optional
+	TargetLabel string `json:"targetLabel,omitempty"`
+	// Regex is matched against the concatenated source label values. Defaults to (.*)
+	// +optional
+	Regex string `json:"regex,omitempty"`
+	// Modulus is the modulus to take of the hash of the source label values
+	// +optional
+	Modulus uint64 `json:"modulus,omitempty"`
+	// Replacement is the value written to the target label in a replace action. Defaults to $1
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+	// Action to perform based on the regex matching. Defaults to replace
+	// +kubebuilder:validation:Enum=replace;keep;drop;hashmod;labelmap;labeldrop;labelkeep;lowercase;uppercase;keepequal;dropequal
+	// +optional
+	Action string `json:"action,omitempty"`
+}
+
+type Ports struct {
+	// +kubebuilder:validation:Minimum=1
+	Bookie int32 `json:"bookie,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	Admin int32 `json:"admin,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	Metrics int32 `json:"metrics,omitempty"`
+}
+
+type Directories struct {
+	IndexDirs  string `json:"indexDirs,omitempty"`
+	JournalDir string `json:"journalDir,omitempty"`
+	LedgerDirs string `json:"ledgerDirs,omitempty"`
+}
+
+type JVMOptions struct {
+	// Memory defines memory options
+	// +optional
+	Memory []string `json:"memory,omitempty"`
+	// Gc defines garbage collection options
+	// +optional
+	Gc []string `json:"gc,omitempty"`
+	// GcLogging defines garbage collection logging options
+	// +optional
+	GcLogging []string `json:"gcLogging,omitempty"`
+	// Extra defines extra options
+	// +optional
+	Extra []string `json:"extra,omitempty"`
+}
+
+// VolumeReclaimPolicy defines the possible volume reclaim policy: Delete or Retain
+type VolumeReclaimPolicy string
+
+// Persistence defines cluster node persistence volume is configured
+type Persistence struct {
+	// ReclaimPolicy decides the fate of the PVCs after the cluster is deleted.
+	// If it's set to Delete and the bookkeeper cluster is deleted, the corresponding
+	// PVCs will be deleted. The default value is Retain.
+	// +kubebuilder:validation:Enum="Delete";"Retain"
+	ReclaimPolicy VolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	// Annotations defines the annotations to attach to the pod
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// JournalVolumeClaimSpec describes the PVC for the bookkeeper journal
+	JournalVolumeClaimSpec *v1.PersistentVolumeClaimSpec `json:"journal,omitempty"`
+	// LedgerVolumeClaimSpec describes the PVC for the bookkeeper ledgers
+	LedgerVolumeClaimSpec *v1.PersistentVolumeClaimSpec `json:"ledger,omitempty"`
+	// IndexVolumeClaimSpec describes the PVC for the bookkeeper index
+	IndexVolumeClaimSpec *v1.PersistentVolumeClaimSpec `json:"index,omitempty"`
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BookkeeperClusterStatus defines the observed state of BookkeeperCluster
+type BookkeeperClusterStatus struct {
+	// Conditions list all the applied conditions
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Replicas is the number of desired bookkeeper nodes in the cluster
+	// +optional
+	Replicas int32 `json:"replicas"`
+
+	// CurrentReplicas is the number of current bookkeeper nodes in the cluster
+	// +optional
+	CurrentReplicas int32 `json:"currentReplicas"`
+
+	// ReadyReplicas is the number of ready bookkeeper nodes in the cluster
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas"`
+
+	// Membership describe the status of members within the cluster
+	// +optional
+	Membership Membership `json:"members"`
+	// Bookies lists the status of each bookie of the cluster
+	// +optional
+	Bookies []BookieStatus `json:"bookies,omitempty"`
+	// Metadata defines the metadata status of the cluster
+	// +optional
+	Metadata Metadata `json:"metadata,omitempty"`
+
+	// Rollout describes the progress of the bookies rolling update
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// Decommission describes the progress of the bookie being decommissioned on a scale down
+	// +optional
+	Decommission *Decommission `json:"decommission,omitempty"`
+}
+
+// RolloutPhase defines the phase of the bookies rolling update
+type RolloutPhase string
+
+const (
+	// RolloutPhaseRolling the bookies are being rolled one at a time
+	RolloutPhaseRolling RolloutPhase = "Rolling"
+	// RolloutPhaseStalled the rolled bookie did not become healthy in time; the rollout is held
+	RolloutPhaseStalled RolloutPhase = "Stalled"
+	// RolloutPhaseCompleted all the bookies run the latest revision
+	RolloutPhaseCompleted RolloutPhase = "Completed"
+)
+
+// Rollout is the status of the bookies rolling update
+type Rollout struct {
+	// Phase is the phase of the rollout
+	Phase RolloutPhase `json:"phase"`
+	// Revision is the statefulset revision the bookies are rolled to
+	Revision string `json:"revision,omitempty"`
+	// Ordinal is the ordinal of the last bookie rolled
+	Ordinal int32 `json:"ordinal"`
+	// StepStartTime is when the last bookie started rolling
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+	// Message describes what the rollout is waiting on
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// Metadata defines the metadata status of the cluster
+type Metadata struct {
+	Size                  int32             `json:"size,omitempty"`
+	BkVersion             string            `json:"bkVersion,omitempty"`
+	BkConfig              map[string]string `json:"bkConfig,omitempty"`
+	ServiceMonitorVersion *string           `json:"serviceMonitorVersion,omitempty"`
+	// PrometheusRuleVersion is the resource version of the applied PrometheusRule of the alerts
+	PrometheusRuleVersion *string `json:"prometheusRuleVersion,omitempty"`
+	// AutoRecoveryEnabled is the autorecovery switch last applied in zookeeper
+	AutoRecoveryEnabled *bool `json:"autoRecoveryEnabled,omitempty"`
+	// ConfigHash is the content hash of the configuration the pods are rolled to
+	ConfigHash string `json:"configHash,omitempty"`
+	// Initialized is true once the ledgers metadata of the cluster is formatted in zookeeper
+	Initialized bool `json:"initialized,omitempty"`
+	// InstanceID is the instance id of the cluster metadata as first read from zookeeper
+	InstanceID string `json:"instanceId,omitempty"`
+	// LayoutVersion is the format version of the ledgers layout
+	LayoutVersion int32 `json:"layoutVersion,omitempty"`
+	// LedgerManagerType is the type of the ledger manager the ledgers metadata is stored with, e.g. hierarchical
+	LedgerManagerType string `json:"ledgerManagerType,omitempty"`
+}
+
+// BookieState defines the state of a bookie as registered in zookeeper
+type BookieState string
+
+const (
+	// BookieStateWritable the bookie is registered as writable
+	BookieStateWritable BookieState = "Writable"
+	// BookieStateReadOnly the bookie is registered as read-only, e.g. its disks are full
+	BookieStateReadOnly BookieState = "ReadOnly"
+	// BookieStateUnavailable the bookie is not registered
+	BookieStateUnavailable BookieState = "Unavailable"
+)
+
+// BookieStatus is the status of a single bookie
+type BookieStatus struct {
+	// ID is the id the bookie registers with
+	ID string `json:"id"`
+	// Pod is the name of the bookie pod
+	Pod string `json:"pod"`
+	// Ordinal is the ordinal of the bookie pod
+	Ordinal int32 `json:"ordinal"`
+	// State is the state of the bookie in zookeeper
+	State BookieState `json:"state"`
+	// Version is the bookkeeper version the bookie pod runs
+	// +optional
+	Version string `json:"version,omitempty"`
+	// FreeDiskSpace is the free space of the bookie ledger directories summed as reported by the bookie
+	// admin API. The index directories are not included, the bookie does not report them.
+	// +optional
+	FreeDiskSpace *resource.Quantity `json:"freeDiskSpace,omitempty"`
+	// TotalDiskSpace is the total space of the bookie ledger directories, with the same limitation
+	// as the FreeDiskSpace. The ledger directories sharing a volume count it once each.
+	// +optional
+	TotalDiskSpace *resource.Quantity `json:"totalDiskSpace,omitempty"`
+	// JournalFreeDiskSpace is the free space of the volume of the bookie journal directory
+	// +optional
+	JournalFreeDiskSpace *resource.Quantity `json:"journalFreeDiskSpace,omitempty"`
+	// JournalTotalDiskSpace is the total space of the volume of the bookie journal directory
+	// +optional
+	JournalTotalDiskSpace *resource.Quantity `json:"journalTotalDiskSpace,omitempty"`
+}
+
+// Membership is the status of the members within the cluster
+type Membership struct {
+	// +optional
+	// +nullable
+	Ready []string `json:"ready"`
+	// +optional
+	// +nullable
+	Unready []string `json:"unready"`
+}
+
+// DecommissionPhase defines the phase of a bookie decommission
+type DecommissionPhase string
+
+const (
+	// DecommissionPhaseReadOnly the bookie is being made read-only
+	DecommissionPhaseReadOnly DecommissionPhase = "ReadOnly"
+	// DecommissionPhaseStopping the bookie pod is being removed from the statefulset
+	DecommissionPhaseStopping DecommissionPhase = "Stopping"
+	// DecommissionPhaseDecommissioning the decommission of the stopped bookie is being requested
+	DecommissionPhaseDecommissioning DecommissionPhase = "Decommissioning"
+	// DecommissionPhaseRecovering the ledgers of the bookie are being re-replicated
+	DecommissionPhaseRecovering DecommissionPhase = "Recovering"
+	// DecommissionPhaseCleaningUp the cookie and the PVCs of the bookie are being deleted
+	DecommissionPhaseCleaningUp DecommissionPhase = "CleaningUp"
+)
+
+// Decommission is the status of the bookie being decommissioned
+type Decommission struct {
+	// Phase is the phase of the decommission
+	Phase DecommissionPhase `json:"phase"`
+	// Ordinal is the ordinal of the bookie being decommissioned
+	Ordinal int32 `json:"ordinal"`
+	// BookieID is the id of the bookie being decommissioned
+	BookieID string `json:"bookieId"`
+	// StepStartTime is when the current phase started
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+	// Message describes what the decommission is waiting on
+	// +optional
+	Message string `json:"message,omitempty"`
+}
@@ -40,9 +40,11 @@ sed -i 's|name: webhook-service|name: {{ include "operator.webhook-service" . }}
 
 OPERATOR_NAMESPACE=bookkeeper-operator
 
-printf "Copying the CRDs files to the chart\n"
-mkdir -p deployments/charts/operator/crds &&
-  cp -r config/crd/bases/* deployments/charts/operator/crds
+printf "Adding the CRDs with their conversion webhook to the chart\n"
+# The CRDs are templated alongside the webhooks so the conversion webhook shares their caBundle
+for crd in config/crd/bases/*.yaml; do
+  sed '/^spec:$/r deployments/charts/crd-conversion.yaml' "$crd" >>deployments/charts/operator/templates/webhookSecretAndConfigurations.yaml
+done
 printf "Packaging the Helm chart\n"
 helm package deployments/charts/operator/ -d "$HELM_PACKAGE_DIR"
 
@@ -58,4 +60,4 @@ metadata:
 
 printf "Cleaning up\n"
 cp -f webhook.temp deployments/charts/operator/templates/webhookSecretAndConfigurations.yaml &&
-  rm -r webhook.temp deployments/charts/operator/crds
+  rm webhook.temp
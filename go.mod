@@ -8,6 +8,7 @@ require (
 	github.com/monimesl/operator-helper v0.0.0-20231113132835-3586578317d2
 	github.com/onsi/ginkgo/v2 v2.11.0
 	github.com/onsi/gomega v1.27.10
+	github.com/prometheus/client_golang v1.16.0
 	k8s.io/api v0.28.3
 	k8s.io/apimachinery v0.28.3
 	k8s.io/client-go v0.28.3
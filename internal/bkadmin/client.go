@@ -0,0 +1,266 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bkadmin is a client of the bookie HTTP admin API
+// https://bookkeeper.apache.org/docs/admin/http
+package bkadmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 2
+	defaultBackoff = 500 * time.Millisecond
+	maxErrorBody   = 1024
+)
+
+// Client talks to the HTTP admin API of a single bookie
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures the Client
+type Option func(c *Client)
+
+// WithTimeout sets the timeout of each request attempt
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the initial
+// backoff between the attempts, which is doubled after each retry
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithHTTPClient sets the underlying http client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// NewClient creates a client of the bookie admin API served at the specified base url, e.g. http://bookie-0:8080
+func NewClient(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// StatusError is returned when the bookie responds with an unexpected status
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected response status %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// IsNotFound checks whether the error is a not found response from the bookie
+func IsNotFound(err error) bool {
+	statusErr := &StatusError{}
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// BookieInfo is the disk usage of the bookie
+type BookieInfo struct {
+	FreeSpace  int64 `json:"freeSpace"`
+	TotalSpace int64 `json:"totalSpace"`
+}
+
+// BookieState is the state of the bookie
+type BookieState struct {
+	Running                        bool `json:"running"`
+	ReadOnly                       bool `json:"readOnly"`
+	ShuttingDown                   bool `json:"shuttingDown"`
+	AvailableForHighPriorityWrites bool `json:"availableForHighPriorityWrites"`
+}
+
+// BookieInfo gets the disk usage of the bookie
+func (c *Client) BookieInfo(ctx context.Context) (*BookieInfo, error) {
+	info := &BookieInfo{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/bookie/info", nil, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// BookieState gets the state of the bookie
+func (c *Client) BookieState(ctx context.Context) (*BookieState, error) {
+	state := &BookieState{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/bookie/state", nil, nil, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ListBookies lists the writable or the read-only bookies of the cluster keyed by their id
+// with their hostname as the value
+func (c *Client) ListBookies(ctx context.Context, readOnly bool) (map[string]string, error) {
+	bookieType := "rw"
+	if readOnly {
+		bookieType = "ro"
+	}
+	query := url.Values{"type": {bookieType}, "print_hostnames": {"true"}}
+	bookies := map[string]string{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/bookie/list_bookies", query, nil, &bookies); err != nil {
+		return nil, err
+	}
+	return bookies, nil
+}
+
+// IsReadOnly checks whether the bookie is in read-only mode
+func (c *Client) IsReadOnly(ctx context.Context) (bool, error) {
+	state := struct {
+		ReadOnly bool `json:"readOnly"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/bookie/state/readonly", nil, nil, &state); err != nil {
+		return false, err
+	}
+	return state.ReadOnly, nil
+}
+
+// SetReadOnly moves the bookie in or out of read-only mode
+func (c *Client) SetReadOnly(ctx context.Context, readOnly bool) error {
+	body := map[string]bool{"readOnly": readOnly}
+	return c.do(ctx, http.MethodPut, "/api/v1/bookie/state/readonly", nil, body, nil)
+}
+
+// AutoRecoveryEnabled checks whether the ledger replication of the cluster is enabled
+func (c *Client) AutoRecoveryEnabled(ctx context.Context) (bool, error) {
+	status := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/autorecovery/status", nil, nil, &status); err != nil {
+		return false, err
+	}
+	return status.Enabled, nil
+}
+
+// ListUnderReplicatedLedgers lists the ids of the under-replicated ledgers of the cluster
+func (c *Client) ListUnderReplicatedLedgers(ctx context.Context) ([]int64, error) {
+	var ledgers []int64
+	err := c.do(ctx, http.MethodGet, "/api/v1/autorecovery/list_under_replicated_ledger", nil, nil, &ledgers)
+	if IsNotFound(err) {
+		// the bookie responds with a not found when there is none
+		return nil, nil
+	}
+	return ledgers, err
+}
+
+// TriggerGC triggers a garbage collection on the bookie
+func (c *Client) TriggerGC(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "/api/v1/bookie/gc", nil, nil, nil)
+}
+
+// Decommission requests the decommission of the specified bookie. The bookie must be shut down.
+func (c *Client) Decommission(ctx context.Context, bookieID string) error {
+	body := map[string]string{"bookie_src": bookieID}
+	return c.do(ctx, http.MethodPut, "/api/v1/autorecovery/decommission", nil, body, nil)
+}
+
+// do sends the request, retrying on the connection errors and the server errors
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	reqURL := c.baseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, reqURL, payload, result)
+		if err == nil || attempt >= c.retries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, reqURL string, payload []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &StatusError{Method: method, URL: reqURL, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: error on decoding the response: %w", method, reqURL, err)
+	}
+	return nil
+}
+
+// retryable checks whether the failed attempt may succeed on a retry;
+// the connection errors and the attempt timeouts are retried
+func retryable(err error) bool {
+	statusErr := &StatusError{}
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bkadmin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	opts = append([]Option{WithRetries(2, time.Millisecond)}, opts...)
+	return NewClient(server.URL, opts...)
+}
+
+func TestBookieInfo(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/bookie/info" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		_, _ = w.Write([]byte(`{"freeSpace": 25, "totalSpace": 100}`))
+	})
+	info, err := client.BookieInfo(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.FreeSpace != 25 || info.TotalSpace != 100 {
+		t.Errorf("unexpected bookie info: %+v", info)
+	}
+}
+
+func TestListBookies(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/bookie/list_bookies" || r.URL.Query().Get("type") != "ro" ||
+			r.URL.Query().Get("print_hostnames") != "true" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+		_, _ = w.Write([]byte(`{"bk-0.bk-headless:3181": "bk-0.bk-headless"}`))
+	})
+	bookies, err := client.ListBookies(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookies) != 1 || bookies["bk-0.bk-headless:3181"] != "bk-0.bk-headless" {
+		t.Errorf("unexpected bookies: %v", bookies)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]bool{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/api/v1/bookie/state/readonly" || !body["readOnly"] {
+			t.Errorf("unexpected request: %s %s %v", r.Method, r.URL, body)
+		}
+	})
+	if err := client.SetReadOnly(context.TODO(), true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecommission(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/api/v1/autorecovery/decommission" ||
+			body["bookie_src"] != "bk-2.bk-headless:3181" {
+			t.Errorf("unexpected request: %s %s %v", r.Method, r.URL, body)
+		}
+	})
+	if err := client.Decommission(context.TODO(), "bk-2.bk-headless:3181"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListUnderReplicatedLedgers(t *testing.T) {
+	ledgers := []int64{3, 7}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if len(ledgers) == 0 {
+			http.Error(w, "No under replicated ledgers found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ledgers)
+	})
+	got, err := client.ListUnderReplicatedLedgers(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 7 {
+		t.Errorf("unexpected ledgers: %v", got)
+	}
+	ledgers = nil
+	if got, err = client.ListUnderReplicatedLedgers(context.TODO()); err != nil || len(got) != 0 {
+		t.Errorf("expected no ledgers on not found, got %v: %v", got, err)
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"enabled": true}`))
+	})
+	enabled, err := client.AutoRecoveryEnabled(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d", enabled, attempts)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err := client.TriggerGC(context.TODO())
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a bad request status error, got %v", err)
+	}
+	if atomic.LoadInt32(&attempts) != 1 {
+		t.Errorf("expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}, WithTimeout(20*time.Millisecond), WithRetries(1, time.Millisecond))
+	if _, err := client.IsReadOnly(context.TODO()); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("expected the timed out attempt to be retried once, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	prometheusRuleKind                  = "PrometheusRule"
+	defaultAlertFor                     = "5m"
+	defaultJournalSyncLatencyMillis     = int32(100)
+	defaultDiskUsagePercent             = int32(85)
+	defaultUnderReplicatedLedgersWindow = "30m"
+)
+
+type prometheusRuleSpec struct {
+	Groups []ruleGroup `json:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string      `json:"name"`
+	Rules []alertRule `json:"rules"`
+}
+
+type alertRule struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ReconcileAlerts reconcile the PrometheusRule of the curated alerts of the specified cluster
+func ReconcileAlerts(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	if !cluster.DeletionTimestamp.IsZero() {
+		// the rule is garbage collected with the cluster
+		return nil
+	}
+	if !cluster.AlertsEnabled() && cluster.Status.Metadata.PrometheusRuleVersion == nil {
+		// no rule is desired nor applied, the CRD is not looked up
+		return nil
+	}
+	var desired *unstructured.Unstructured
+	if cluster.AlertsEnabled() {
+		var err error
+		labels := mergeLabels(cluster.GenerateLabels(), cluster.Spec.Monitoring.Labels)
+		desired, err = newPrometheusObject(cluster, prometheusRuleKind,
+			cluster.PrometheusRuleName(), labels, createPrometheusRuleSpec(cluster))
+		if err != nil {
+			return err
+		}
+	}
+	gvk := schema.FromAPIVersionAndKind(monitoringAPIVersion, prometheusRuleKind)
+	version, err := reconcilePrometheusObject(ctx, cluster, gvk, cluster.PrometheusRuleName(), desired)
+	if err != nil {
+		return err
+	}
+	// persisted with the rest of the status by ReconcileClusterStatus
+	cluster.Status.Metadata.PrometheusRuleVersion = version
+	return nil
+}
+
+// createPrometheusRuleSpec creates the alerts of the cluster. The bookie metrics are selected by the
+// namespace and the cluster label the monitor attaches, so each cluster is alerted on separately.
+func createPrometheusRuleSpec(cluster *v1alpha1.BookkeeperCluster) *prometheusRuleSpec {
+	alerts := cluster.Spec.Monitoring.Alerts
+	thresholds := alerts.Thresholds
+	if thresholds == nil {
+		thresholds = &v1alpha1.AlertThresholds{}
+	}
+	forDuration := stringOrDefault(thresholds.For, defaultAlertFor)
+	window := stringOrDefault(thresholds.UnderReplicatedLedgersWindow, defaultUnderReplicatedLedgersWindow)
+	syncLatency := int32OrDefault(thresholds.JournalSyncLatencyMillis, defaultJournalSyncLatencyMillis)
+	diskUsage := int32OrDefault(thresholds.DiskUsagePercent, defaultDiskUsagePercent)
+	selector := fmt.Sprintf(`namespace=%q,%s=%q`, cluster.Namespace, clusterMetricLabel, cluster.Name)
+	labels := mergeLabels(map[string]string{
+		"namespace":        cluster.Namespace,
+		clusterMetricLabel: cluster.Name,
+	}, alerts.Labels)
+	rule := func(alert, severity, expr, summary, description string) alertRule {
+		return alertRule{
+			Alert:  alert,
+			Expr:   expr,
+			For:    forDuration,
+			Labels: mergeLabels(map[string]string{"severity": severity}, labels),
+			Annotations: map[string]string{
+				"summary":     summary,
+				"description": description,
+			},
+		}
+	}
+	rules := []alertRule{
+		rule("BookKeeperBookieReadOnly", "warning",
+			fmt.Sprintf(`bookie_SERVER_STATUS{%s} == 0`, selector),
+			"A bookie is read-only",
+			"The bookie {{ $labels.pod }} of the cluster {{ $labels.namespace }}/{{ $labels."+
+				clusterMetricLabel+" }} is read-only; its disks may be full or failing."),
+		rule("BookKeeperUnderReplicatedLedgersGrowing", "warning",
+			fmt.Sprintf(`delta(auditor_NUM_UNDER_REPLICATED_LEDGERS_sum{%s}[%s]) > 0`, selector, window),
+			"The under-replicated ledgers are growing",
+			fmt.Sprintf("The under-replicated ledgers of the cluster {{ $labels.namespace }}/{{ $labels.%s }} "+
+				"have grown over the last %s.", clusterMetricLabel, window)),
+		rule("BookKeeperJournalSyncLatencyHigh", "warning",
+			fmt.Sprintf(`bookie_journal_JOURNAL_SYNC{%s,success="true",quantile="0.99"} > %d`,
+				selector, syncLatency),
+			"The bookie journal sync latency is high",
+			fmt.Sprintf("The p99 journal sync latency of the bookie {{ $labels.pod }} is "+
+				"{{ $value | humanize }}ms, above %dms.", syncLatency)),
+		rule("BookKeeperDiskUsageHigh", "warning",
+			fmt.Sprintf(`{__name__=~"bookie_ledger_dir_.*_usage",%s} > %d`, selector, diskUsage),
+			"The bookie disk usage is high",
+			fmt.Sprintf("The ledger directory usage of the bookie {{ $labels.pod }} is "+
+				"{{ $value | humanize }}%%, above %d%%; the bookie turns read-only when its disks are full.",
+				diskUsage)),
+	}
+	if cluster.AutoRecoveryReplicas() > 0 {
+		rules = append(rules, rule("BookKeeperAutoRecoveryNotRunning", "critical",
+			fmt.Sprintf(`(sum(up{%s,component=%q}) or vector(0)) < 1`, selector, autorecoveryComponent),
+			"The autorecovery is not running",
+			"No autorecovery pod of the cluster "+cluster.Namespace+"/"+cluster.Name+
+				" is scraped up; the ledgers of the lost bookies are not re-replicated."))
+	}
+	return &prometheusRuleSpec{Groups: []ruleGroup{{
+		Name:  fmt.Sprintf("bookkeeper.%s.%s", cluster.Namespace, cluster.Name),
+		Rules: rules,
+	}}}
+}
+
+func stringOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func int32OrDefault(value *int32, defaultValue int32) int32 {
+	if value == nil {
+		return defaultValue
+	}
+	return *value
+}
@@ -18,7 +18,9 @@ package bookkeepercluster
 
 import (
 	"context"
+	"fmt"
 	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
 	"github.com/monimesl/operator-helper/k8s/pod"
 	"github.com/monimesl/operator-helper/reconciler"
 	v1 "k8s.io/api/apps/v1"
@@ -31,8 +33,15 @@ const (
 	autorecoveryComponent = "bookkeeper-autorecovery"
 )
 
-// ReconcileAutoRecovery reconcile the deployment of the specified cluster
+// ReconcileAutoRecovery reconcile the autorecovery deployment and state of the specified cluster
 func ReconcileAutoRecovery(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	if err := reconcileAutoRecoveryDeployment(ctx, cluster); err != nil {
+		return err
+	}
+	return reconcileAutoRecoveryState(ctx, cluster)
+}
+
+func reconcileAutoRecoveryDeployment(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
 	dep := &v1.Deployment{}
 	return ctx.GetResource(types.NamespacedName{
 		Name:      cluster.AutoRecoveryDeploymentName(),
@@ -40,8 +49,10 @@ func ReconcileAutoRecovery(ctx reconciler.Context, cluster *v1alpha1.BookkeeperC
 	}, dep,
 		// Found
 		func() error {
-			if *cluster.Spec.AutoRecoveryReplicas != *dep.Spec.Replicas {
-				return updateAutoRecoveryDeployment(ctx, dep, cluster)
+			desired := createAutoRecoveryDeployment(cluster)
+			if *desired.Spec.Replicas != *dep.Spec.Replicas ||
+				templateChanged(desired, dep) {
+				return updateAutoRecoveryDeployment(ctx, cluster, dep, desired)
 			}
 			return nil
 		},
@@ -55,49 +66,89 @@ func ReconcileAutoRecovery(ctx reconciler.Context, cluster *v1alpha1.BookkeeperC
 				"Deployment.Name", dep.GetName(),
 				"Deployment.Namespace", dep.GetNamespace())
 			if err := ctx.Client().Create(context.TODO(), dep); err != nil {
+				recordWarning(ctx, cluster, EventDeploymentFailed,
+					"Failed to create the autorecovery deployment %s: %s", dep.Name, err)
 				return err
 			}
 			ctx.Logger().Info("Deployment creation success.",
 				"Deployment.Name", dep.GetName(),
 				"Deployment.Namespace", dep.GetNamespace())
+			recordEvent(ctx, cluster, EventDeploymentCreated,
+				"Created the autorecovery deployment %s with %d replicas", dep.Name, *dep.Spec.Replicas)
 			return nil
 		})
 }
 
-func updateAutoRecoveryDeployment(
-	ctx reconciler.Context, dep *v1.Deployment,
-	cluster *v1alpha1.BookkeeperCluster) error {
-	dep.Spec.Replicas = cluster.Spec.AutoRecoveryReplicas
+func updateAutoRecoveryDeployment(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	dep, desired *v1.Deployment) error {
+	dep.Annotations = mergeLabels(dep.Annotations, desired.Annotations)
+	dep.Spec.Replicas = desired.Spec.Replicas
+	dep.Spec.Template = desired.Spec.Template
 	ctx.Logger().Info("Updating the bookkeeper autorecovery deployment.",
 		"Deployment.Name", dep.GetName(),
-		"Deployment.Namespace", dep.GetNamespace(), "NewReplicas", cluster.Spec.AutoRecoveryReplicas)
-	return ctx.Client().Update(context.TODO(), dep)
+		"Deployment.Namespace", dep.GetNamespace(), "NewReplicas", *desired.Spec.Replicas)
+	if err := ctx.Client().Update(context.TODO(), dep); err != nil {
+		recordWarning(ctx, cluster, EventDeploymentFailed,
+			"Failed to update the autorecovery deployment %s: %s", dep.Name, err)
+		return err
+	}
+	recordEvent(ctx, cluster, EventDeploymentUpdated,
+		"Updated the autorecovery deployment %s with %d replicas", dep.Name, *dep.Spec.Replicas)
+	return nil
+}
+
+// reconcileAutoRecoveryState sets or clears the zookeeper switch which
+// stops the auditor from replicating the ledgers of the lost bookies
+func reconcileAutoRecoveryState(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	enabled := cluster.AutoRecoveryEnabled()
+	applied := cluster.Status.Metadata.AutoRecoveryEnabled
+	if !cluster.DeletionTimestamp.IsZero() || (applied != nil && *applied == enabled) {
+		return nil
+	}
+	updated, err := zk.UpdateAutoRecoveryState(cluster, enabled)
+	if err != nil {
+		return fmt.Errorf("error on updating the cluster (%s) autorecovery state: %w", cluster.Name, err)
+	}
+	if updated {
+		ctx.Logger().Info("Updated the cluster autorecovery state",
+			"cluster", cluster.GetName(), "enabled", enabled)
+		recordEvent(ctx, cluster, EventAutoRecoveryUpdated, "Set the autorecovery enabled to %t", enabled)
+		// persisted with the rest of the status by ReconcileClusterStatus
+		cluster.Status.Metadata.AutoRecoveryEnabled = &enabled
+	}
+	return nil
 }
 
 func createAutoRecoveryDeployment(c *v1alpha1.BookkeeperCluster) *v1.Deployment {
 	name := c.AutoRecoveryDeploymentName()
+	replicas := c.AutoRecoveryReplicas()
 	labels := c.GenerateWorkloadLabels(autorecoveryComponent)
+	template := v12.PodTemplateSpec{
+		ObjectMeta: pod.NewMetadata(*c.Spec.PodConfig.DeepCopy(), name, "", labels,
+			mergeLabels(c.GenerateAnnotations(), map[string]string{
+				configHashAnnotation: configHash(createConfigmapData(c)),
+			})),
+		Spec: createAutoRecoveryPodSpec(c),
+	}
 	return &v1.Deployment{
 		TypeMeta: v13.TypeMeta{
 			Kind:       "Deployment",
 			APIVersion: "apps/v1",
 		},
 		ObjectMeta: v13.ObjectMeta{
-			Namespace:   c.Namespace,
-			Name:        name,
-			Labels:      labels,
-			Annotations: c.GenerateAnnotations(),
+			Namespace: c.Namespace,
+			Name:      name,
+			Labels:    labels,
+			Annotations: mergeLabels(c.GenerateAnnotations(), map[string]string{
+				templateHashAnnotation: templateHash(&template),
+			}),
 		},
 		Spec: v1.DeploymentSpec{
-			Replicas: c.Spec.AutoRecoveryReplicas,
+			Replicas: &replicas,
 			Selector: &v13.LabelSelector{
 				MatchLabels: labels,
 			},
-			Template: v12.PodTemplateSpec{
-				ObjectMeta: pod.NewMetadata(c.Spec.PodConfig, name, "", labels,
-					c.GenerateAnnotations()),
-				Spec: createAutoRecoveryPodSpec(c),
-			},
+			Template: template,
 		},
 	}
 }
@@ -113,7 +164,7 @@ func createAutoRecoveryPodSpec(c *v1alpha1.BookkeeperCluster) v12.PodSpec {
 		},
 	}
 	image := c.Image()
-	volumes := make([]v12.Volume, 0)
+	volumes, volumeMounts, initContainers := zkSecurityPodConfig(c)
 	container := v12.Container{
 		Name:  autorecoveryComponent,
 		Image: image.ToString(),
@@ -123,9 +174,13 @@ func createAutoRecoveryPodSpec(c *v1alpha1.BookkeeperCluster) v12.PodSpec {
 		Args: []string{
 			"/opt/bookkeeper/bin/bookkeeper", "autorecovery",
 		},
+		Ports: []v12.ContainerPort{
+			{Name: v1alpha1.ServiceMetricsPortName, ContainerPort: c.Spec.Ports.Metrics},
+		},
 		EnvFrom:         environment,
 		Env:             pod.DecorateContainerEnvVars(true, c.Spec.PodConfig.Spec.Env...),
+		VolumeMounts:    volumeMounts,
 		ImagePullPolicy: image.PullPolicy,
 	}
-	return pod.NewSpec(c.Spec.PodConfig, volumes, nil, []v12.Container{container})
+	return pod.NewSpec(c.Spec.PodConfig, volumes, initContainers, []v12.Container{container})
 }
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/bkadmin"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
+	"github.com/monimesl/operator-helper/oputil"
+	"github.com/monimesl/operator-helper/reconciler"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bookieInfoTimeout bounds the admin API call made for the status of each bookie
+	bookieInfoTimeout = 3 * time.Second
+	// bookieInfoWorkers bounds the admin API calls made concurrently for the status of the bookies
+	bookieInfoWorkers = 8
+)
+
+func bookiePodName(sts *v1.StatefulSet, ordinal int32) string {
+	return fmt.Sprintf("%s-%d", sts.Name, ordinal)
+}
+
+// getBookiePod gets the bookie pod of the specified ordinal; nil when it does not exist
+func getBookiePod(ctx reconciler.Context, sts *v1.StatefulSet, ordinal int32) (*v12.Pod, error) {
+	p := &v12.Pod{}
+	err := ctx.Client().Get(context.TODO(), types.NamespacedName{
+		Name:      bookiePodName(sts, ordinal),
+		Namespace: sts.Namespace,
+	}, p)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return p, err
+}
+
+// newBookieAdminClient creates a client of the admin API of the specified bookie pod
+func newBookieAdminClient(cluster *v1alpha1.BookkeeperCluster, podName string, opts ...bkadmin.Option) *bkadmin.Client {
+	return bkadmin.NewClient(fmt.Sprintf("http://%s:%d", cluster.BookiePodFQDN(podName), cluster.Spec.Ports.Admin), opts...)
+}
+
+// bookieStatuses reports the status of the bookie pods from their zookeeper registration and their admin API
+func bookieStatuses(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	zkClient *zk.Client, pods []v12.Pod) ([]v1alpha1.BookieStatus, error) {
+	writable, err := zkClient.WritableBookies(cluster)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := zkClient.ReadOnlyBookies(cluster)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]v1alpha1.BookieStatus, 0, len(pods))
+	for i := range pods {
+		p := &pods[i]
+		ordinal, ok := podOrdinal(p.Name)
+		if p.Labels["component"] != bookieComponent || !ok {
+			continue
+		}
+		status := v1alpha1.BookieStatus{
+			ID:      cluster.BookieID(p.Name),
+			Pod:     p.Name,
+			Ordinal: ordinal,
+			State:   v1alpha1.BookieStateUnavailable,
+			Version: podBookieVersion(p),
+		}
+		switch {
+		case oputil.Contains(writable, status.ID):
+			status.State = v1alpha1.BookieStateWritable
+		case oputil.Contains(readOnly, status.ID):
+			status.State = v1alpha1.BookieStateReadOnly
+		}
+		statuses = append(statuses, status)
+	}
+	setBookiesDiskSpace(ctx, cluster, statuses)
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Ordinal < statuses[j].Ordinal
+	})
+	return statuses, nil
+}
+
+// setBookiesDiskSpace gets the disk usage of the registered bookies, the ledger directories from their
+// admin API and the journal directory from df in their container. The bookies are queried concurrently
+// so the unresponsive ones do not add up their timeouts.
+func setBookiesDiskSpace(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, statuses []v1alpha1.BookieStatus) {
+	executor := getPodExecutor(ctx)
+	workers := make(chan struct{}, bookieInfoWorkers)
+	wg := sync.WaitGroup{}
+	for i := range statuses {
+		status := &statuses[i]
+		if status.State == v1alpha1.BookieStateUnavailable {
+			continue
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			adminClient := newBookieAdminClient(cluster, status.Pod,
+				bkadmin.WithTimeout(bookieInfoTimeout), bkadmin.WithRetries(0, 0))
+			if info, err := adminClient.BookieInfo(context.TODO()); err != nil {
+				ctx.Logger().Info("Error getting the bookie disk usage",
+					"bookie", status.ID, "error", err.Error())
+			} else {
+				status.FreeDiskSpace = diskSpaceQuantity(info.FreeSpace)
+				status.TotalDiskSpace = diskSpaceQuantity(info.TotalSpace)
+			}
+			if executor == nil {
+				return
+			}
+			execCtx, cancel := context.WithTimeout(context.TODO(), bookieInfoTimeout)
+			defer cancel()
+			if free, total, err := directoryDiskSpace(execCtx, executor, cluster.Namespace,
+				status.Pod, cluster.Spec.Directories.JournalDir); err != nil {
+				ctx.Logger().Info("Error getting the bookie journal disk usage",
+					"bookie", status.ID, "error", err.Error())
+			} else {
+				status.JournalFreeDiskSpace = diskSpaceQuantity(free)
+				status.JournalTotalDiskSpace = diskSpaceQuantity(total)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func podOrdinal(podName string) (int32, bool) {
+	i := strings.LastIndex(podName, "-")
+	if i < 0 {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(podName[i+1:], 10, 32)
+	return int32(ordinal), err == nil
+}
+
+// podBookieVersion returns the image tag of the bookie container of the pod
+func podBookieVersion(p *v12.Pod) string {
+	for _, container := range p.Spec.Containers {
+		if container.Name != bookieComponent {
+			continue
+		}
+		image := strings.Split(container.Image, "@")[0]
+		if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+			return image[i+1:]
+		}
+	}
+	return ""
+}
+
+// diskSpaceQuantity rounds the disk space down to MiB so the status does not change on every write
+func diskSpaceQuantity(bytes int64) *resource.Quantity {
+	const mebibyte = 1 << 20
+	return resource.NewQuantity(bytes/mebibyte*mebibyte, resource.BinarySI)
+}
@@ -20,11 +20,17 @@ import (
 	"context"
 	"fmt"
 	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal"
 	"github.com/monimesl/bookkeeper-operator/internal/zk"
 	"github.com/monimesl/operator-helper/k8s/pod"
 	"github.com/monimesl/operator-helper/reconciler"
+	v1 "k8s.io/api/core/v1"
+	"time"
 )
 
+// statusRefreshInterval is how often the cluster status is refreshed
+const statusRefreshInterval = time.Minute
+
 // ReconcileClusterStatus reconcile the status of the specified cluster
 //
 //nolint:nakedret
@@ -33,19 +39,26 @@ func ReconcileClusterStatus(ctx reconciler.Context, cluster *v1alpha1.Bookkeeper
 	if err != nil {
 		return err
 	}
-	labels := cluster.GenerateLabels()
-	readyReplicas, unreadyReplicas, err := pod.ListAllWithMatchingLabelsByReadiness(ctx.Client(), cluster.Name, labels)
+	// the bookie pods alone, the autorecovery and the metadata init job pods share the cluster labels
+	labels := cluster.GenerateWorkloadLabels(bookieComponent)
+	readyReplicas, unreadyReplicas, err := pod.ListAllWithMatchingLabelsByReadiness(ctx.Client(), cluster.Namespace, labels)
 	if err != nil {
 		return err
 	}
-	expectedClusterSize := int(*cluster.Spec.Size)
-	switch {
-	case expectedClusterSize == len(readyReplicas):
-		cluster.Status.SetPodsReadyConditionTrue()
-	case len(readyReplicas) == 0:
-		cluster.Status.SetPodsReadyConditionFalse()
-	default:
-		cluster.Status.SetPodsReadyConditionFalse()
+	deleted := !cluster.DeletionTimestamp.IsZero()
+	var zkErr error
+	if deleted {
+		// the deleted cluster is not watched nor its zookeeper metadata updated, the finalizer cleans it up
+		zk.DefaultWatcher.Unwatch(cluster)
+		cluster.Status.Bookies = nil
+	} else {
+		zkErr = updateBookiesStatus(ctx, cluster, append(readyReplicas, unreadyReplicas...))
+		setZooKeeperConditions(cluster, zkErr)
+	}
+	if !deleted && zkErr == nil {
+		// a ready pod may run a read-only or unregistered bookie, so the availability is from zookeeper
+		cluster.Status.SetAvailabilityConditions(writableBookies(cluster),
+			*cluster.Spec.Size, cluster.Spec.WriteQuorumSize(), cluster.Generation)
 	}
 	readyMembers := make([]string, len(readyReplicas))
 	for i, p := range readyReplicas {
@@ -60,11 +73,127 @@ func ReconcileClusterStatus(ctx reconciler.Context, cluster *v1alpha1.Bookkeeper
 	cluster.Status.ReadyReplicas = int32(len(readyReplicas))
 	cluster.Status.CurrentReplicas = int32(len(readyReplicas) + len(unreadyReplicas))
 	if err = ctx.Client().Status().Update(context.TODO(), cluster); err != nil {
-		err = fmt.Errorf("error on updating the cluster (%s) status: %w", cluster.Name, err)
+		return fmt.Errorf("error on updating the cluster (%s) status: %w", cluster.Name, err)
+	}
+	if zkErr != nil || deleted {
+		return zkErr
+	}
+	// the status is not watched, refresh it periodically
+	return requeueAfter(statusRefreshInterval, "refreshing the cluster status")
+}
+
+// setZooKeeperConditions reports the zookeeper connectivity and the cluster metadata errors
+// apart, the other errors, e.g. an authentication failure, are reported as reconcile errors
+func setZooKeeperConditions(cluster *v1alpha1.BookkeeperCluster, err error) {
+	switch {
+	case zk.IsConnectivityError(err):
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterZooKeeperUnreachable, v1.ConditionTrue,
+			v1alpha1.ReasonZooKeeperError, err.Error(), cluster.Generation)
+	case err == nil || zk.IsMetadataError(err):
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterZooKeeperUnreachable, v1.ConditionFalse,
+			v1alpha1.ReasonZooKeeperConnected, "", cluster.Generation)
+	}
+	if zk.IsMetadataError(err) {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterMetadataError, v1.ConditionTrue,
+			v1alpha1.ReasonMetadataError, err.Error(), cluster.Generation)
+	} else if err == nil {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterMetadataError, v1.ConditionFalse,
+			v1alpha1.ReasonMetadataHealthy, "", cluster.Generation)
+	}
+}
+
+// writableBookies counts the writable bookies within the cluster size
+func writableBookies(cluster *v1alpha1.BookkeeperCluster) (writable int32) {
+	for _, bookie := range cluster.Status.Bookies {
+		if bookie.Ordinal < *cluster.Spec.Size && bookie.State == v1alpha1.BookieStateWritable {
+			writable++
+		}
 	}
 	return
 }
 
+func updateBookiesStatus(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, pods []v1.Pod) error {
+	zk.DefaultWatcher.Watch(cluster)
+	zkClient, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return err
+	}
+	defer zkClient.Close()
+	if err = updateOperatorMetadata(ctx, cluster, zkClient); err != nil {
+		return err
+	}
+	if err = updateLedgersLayout(ctx, cluster, zkClient); err != nil {
+		return err
+	}
+	bookies, err := bookieStatuses(ctx, cluster, zkClient, pods)
+	if err != nil {
+		return fmt.Errorf("error on getting the cluster (%s) bookies status: %w", cluster.Name, err)
+	}
+	cluster.Status.Bookies = bookies
+	return nil
+}
+
+// updateOperatorMetadata writes the intent of the operator for the cluster in zookeeper
+func updateOperatorMetadata(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, zkClient *zk.Client) error {
+	metadata := zk.OperatorMetadata{
+		Size:              *cluster.Spec.Size,
+		BookkeeperVersion: cluster.Spec.BookkeeperVersion,
+		ConfigHash:        cluster.Status.Metadata.ConfigHash,
+		OperatorVersion:   internal.Version,
+	}
+	if rollout := cluster.Status.Rollout; rollout != nil {
+		metadata.Rollout = &zk.OperatorMetadataRollout{
+			Phase:    string(rollout.Phase),
+			Revision: rollout.Revision,
+		}
+	}
+	action, err := zkClient.UpdateOperatorMetadata(cluster, metadata)
+	if err != nil {
+		recordWarning(ctx, cluster, EventMetadataUpdateFailed,
+			"Failed to update the zookeeper metadata: %s", err)
+		return fmt.Errorf("error on updating the cluster (%s) operator metadata: %w", cluster.Name, err)
+	}
+	if action != "" {
+		ctx.Logger().Info("Updated the cluster operator metadata",
+			"cluster", cluster.Name, "action", action)
+		recordEvent(ctx, cluster, EventMetadataUpdated,
+			"Updated the zookeeper metadata on %s, the cluster size is %d", action, metadata.Size)
+	}
+	return nil
+}
+
+// updateLedgersLayout reports the ledgers layout of the cluster, warning when the instance id
+// is not the one first read since the bookie cookies are bound to the original instance
+func updateLedgersLayout(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, zkClient *zk.Client) error {
+	layout, err := zkClient.LedgersLayout(cluster)
+	if err != nil {
+		return fmt.Errorf("error on getting the cluster (%s) ledgers layout: %w", cluster.Name, err)
+	} else if layout == nil {
+		return nil
+	}
+	metadata := &cluster.Status.Metadata
+	metadata.LayoutVersion = layout.LayoutVersion
+	metadata.LedgerManagerType = layout.LedgerManagerType()
+	if metadata.InstanceID == "" || metadata.InstanceID == layout.InstanceID {
+		metadata.InstanceID = layout.InstanceID
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterInstanceIDChanged, v1.ConditionFalse,
+			v1alpha1.ReasonInstanceIDMatches, "", cluster.Generation)
+		return nil
+	}
+	if !cluster.Status.IsConditionTrue(v1alpha1.ConditionClusterInstanceIDChanged) {
+		ctx.Logger().Info("The cluster instance id changed, the metadata was reformatted",
+			"cluster", cluster.Name, "instanceId", metadata.InstanceID, "zkInstanceId", layout.InstanceID)
+		recordWarning(ctx, cluster, EventInstanceIDChanged,
+			"The instance id in zookeeper changed from %s to %s, the metadata was reformatted",
+			metadata.InstanceID, layout.InstanceID)
+	}
+	cluster.Status.SetCondition(v1alpha1.ConditionClusterInstanceIDChanged, v1.ConditionTrue,
+		v1alpha1.ReasonInstanceIDChanged, fmt.Sprintf(
+			"the instance id in zookeeper is %s but the cluster was formatted with %s",
+			layout.InstanceID, metadata.InstanceID), cluster.Generation)
+	return nil
+}
+
 func updateMetadata(ctx reconciler.Context, c *v1alpha1.BookkeeperCluster) error {
 	if *c.Spec.Size != c.Status.Metadata.Size ||
 		!mapEqual(c.Spec.BkConfig, c.Status.Metadata.BkConfig) ||
@@ -77,14 +206,6 @@ func updateMetadata(ctx reconciler.Context, c *v1alpha1.BookkeeperCluster) error
 		if c.DeletionTimestamp.IsZero() {
 			c.Status.Metadata.BkConfig = c.Spec.BkConfig
 			c.Status.Metadata.BkVersion = c.Spec.BookkeeperVersion
-			if *c.Spec.Size != c.Status.Metadata.Size {
-				ctx.Logger().Info("Updating the cluster status bookkeeper metadata",
-					"cluster", c.GetName(), "specSize", *c.Spec.Size,
-					"statusSize", c.Status.Metadata.Size)
-				if err := zk.UpdateMetadata(c); err != nil {
-					return err
-				}
-			}
 			c.Status.Metadata.Size = *c.Spec.Size
 			ctx.Logger().Info("Updating the cluster status", "cluster", c.GetName(), "status", c.Status)
 			if err := ctx.Client().Status().Update(context.TODO(), c); err != nil {
@@ -18,17 +18,24 @@ package bookkeepercluster
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal"
 	"github.com/monimesl/operator-helper/config"
 	"github.com/monimesl/operator-helper/k8s/configmap"
 	"github.com/monimesl/operator-helper/oputil"
 	"github.com/monimesl/operator-helper/reconciler"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sort"
 	"strings"
 )
 
+// configHashAnnotation is stamped on the pod templates so the pods are rolled when the configuration changes
+const configHashAnnotation = internal.Domain + "/config-hash"
+
 // ReconcileConfigMap reconcile the configmap of the specified cluster
 func ReconcileConfigMap(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
 	cm := &v1.ConfigMap{}
@@ -38,11 +45,12 @@ func ReconcileConfigMap(ctx reconciler.Context, cluster *v1alpha1.BookkeeperClus
 	}, cm,
 		// Found
 		func() error {
-			if shouldUpdateConfigmap(ctx, cluster) {
+			if shouldUpdateConfigmap(ctx, cm, cluster) {
 				if err := updateConfigmap(ctx, cm, cluster); err != nil {
 					return err
 				}
 			}
+			cluster.Status.Metadata.ConfigHash = configHash(cm.Data)
 			return nil
 		},
 		// Not Found
@@ -56,16 +64,17 @@ func ReconcileConfigMap(ctx reconciler.Context, cluster *v1alpha1.BookkeeperClus
 					ctx.Logger().Info("ConfigMap creation success.",
 						"ConfigMap.Name", cm.GetName(),
 						"ConfigMap.Namespace", cm.GetNamespace())
+					cluster.Status.Metadata.ConfigHash = configHash(cm.Data)
 				}
 			}
 			return
 		})
 }
 
-func shouldUpdateConfigmap(ctx reconciler.Context, c *v1alpha1.BookkeeperCluster) bool {
-	if !mapEqual(c.Spec.BkConfig, c.Status.Metadata.BkConfig) {
+func shouldUpdateConfigmap(ctx reconciler.Context, cm *v1.ConfigMap, c *v1alpha1.BookkeeperCluster) bool {
+	if data := createConfigmapData(c); !mapEqual(data, cm.Data) {
 		ctx.Logger().Info("Bookkeeper cluster config changed",
-			"from", c.Status.Metadata.BkConfig, "to", c.Spec.BkConfig,
+			"from", cm.Data, "to", data,
 		)
 		return true
 	}
@@ -90,6 +99,7 @@ func updateConfigmap(ctx reconciler.Context, cm *v1.ConfigMap, c *v1alpha1.Bookk
 
 func createConfigmapData(c *v1alpha1.BookkeeperCluster) map[string]string {
 	jvmOptions := c.Spec.JVMOptions
+	extraOptions := append(zkSecurityJVMOptions(c), jvmOptions.Extra...)
 	excludedOptions := []string{
 		"BK_zkServers", "BK_zkLedgersRootPath", "BK_httpServerEnabled", "BK_httpServerPort", "BK_enableStatistics",
 		"BOOKIE_PORT", "BOOKIE_GC_OPTS", "BOOKIE_MEM_OPTS", "BOOKIE_EXTRA_OPTS", "BOOKIE_GC_LOGGING_OPTS",
@@ -102,7 +112,7 @@ func createConfigmapData(c *v1alpha1.BookkeeperCluster) map[string]string {
 		"BK_lostBookieRecoveryDelay":    "60",
 		"BK_prometheusStatsHttpAddress": "0.0.0.0",
 		"BK_CLUSTER_ROOT_PATH":          c.ZkRootPath(),
-		"BK_zkServers":                  c.Spec.ZkServers,
+		"BK_zkServers":                  c.Spec.ZkConnectString(),
 		"BK_zkLedgersRootPath":          c.ZkLedgersRootPath(),
 		"BK_indexDirectories":           c.Spec.Directories.IndexDirs,
 		"BK_ledgerDirectories":          c.Spec.Directories.LedgerDirs,
@@ -118,7 +128,7 @@ func createConfigmapData(c *v1alpha1.BookkeeperCluster) map[string]string {
 		// https://github.com/apache/bookkeeper/blob/2346686c3b8621a585ad678926adf60206227367/bin/common.sh#L120
 		"BK_BOOKIE_GC_LOGGING_OPTS": fmt.Sprintf(`"%s"`, strings.Join(jvmOptions.GcLogging, " ")),
 		// https://github.com/apache/bookkeeper/blob/2346686c3b8621a585ad678926adf60206227367/bin/bookkeeper#L149
-		"BK_BOOKIE_EXTRA_OPTS": fmt.Sprintf(`"%s"`, strings.Join(jvmOptions.Extra, " ")),
+		"BK_BOOKIE_EXTRA_OPTS": fmt.Sprintf(`"%s"`, strings.Join(extraOptions, " ")),
 		"CLUSTER_NAME":         c.GetName(),
 	}
 	for k, v := range c.Spec.BkConfig {
@@ -131,6 +141,9 @@ func createConfigmapData(c *v1alpha1.BookkeeperCluster) map[string]string {
 		}
 		data[k] = v
 	}
+	for k, v := range zkSecurityConfig(c) {
+		data[k] = v
+	}
 	for k, v := range data {
 		v = strings.TrimSpace(v)
 		if v == "" {
@@ -141,3 +154,17 @@ func createConfigmapData(c *v1alpha1.BookkeeperCluster) map[string]string {
 	}
 	return data
 }
+
+// configHash computes the content hash of the rendered configmap data
+func configHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(hash, "%s=%s\n", k, data[k])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
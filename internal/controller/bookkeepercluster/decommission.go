@@ -0,0 +1,258 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
+	"github.com/monimesl/operator-helper/k8s/pod"
+	"github.com/monimesl/operator-helper/reconciler"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+const (
+	decommissionRequeueDelay = 15 * time.Second
+	// decommissionRetryTimeout is how long to wait for the decommission
+	// to remove the bookie cookie before requesting it again
+	decommissionRetryTimeout = 10 * time.Minute
+)
+
+// A scale down decommissions the bookies one at a time, from the highest ordinal. Bookkeeper
+// only decommissions a bookie which is shut down, so the bookie is made read-only, its pod is
+// removed from the statefulset then its decommission is requested through a remaining bookie.
+// Once its ledgers are re-replicated, its cookie and PVCs are deleted. Each phase is saved
+// in the cluster status so a restarted operator resumes it. A started decommission completes
+// even if the cluster is scaled back up.
+
+// scalingDown checks whether the statefulset replicas are to be lowered by a decommission
+func scalingDown(cluster *v1alpha1.BookkeeperCluster, sts *v1.StatefulSet) bool {
+	return cluster.DeletionTimestamp.IsZero() &&
+		(cluster.Status.Decommission != nil || *cluster.Spec.Size < *sts.Spec.Replicas)
+}
+
+// reconcileScaleDown decommissions the bookies above the cluster size
+func reconcileScaleDown(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, sts *v1.StatefulSet) error {
+	if !scalingDown(cluster, sts) {
+		return nil
+	}
+	decommission := cluster.Status.Decommission
+	if decommission == nil {
+		ordinal := *sts.Spec.Replicas - 1
+		decommission = &v1alpha1.Decommission{
+			Phase:    v1alpha1.DecommissionPhaseReadOnly,
+			Ordinal:  ordinal,
+			BookieID: cluster.BookieID(bookiePodName(sts, ordinal)),
+		}
+		ctx.Logger().Info("Decommissioning the bookie",
+			"cluster", cluster.Name, "ordinal", ordinal, "bookie", decommission.BookieID)
+		recordEvent(ctx, cluster, EventDecommissionStarted, "Decommissioning the bookie %s", decommission.BookieID)
+		if err := saveDecommission(ctx, cluster, decommission, decommission.Phase, ""); err != nil {
+			return err
+		}
+	}
+	switch decommission.Phase {
+	case v1alpha1.DecommissionPhaseReadOnly:
+		return makeBookieReadOnly(ctx, cluster, sts, decommission)
+	case v1alpha1.DecommissionPhaseStopping:
+		return stopBookie(ctx, cluster, sts, decommission)
+	case v1alpha1.DecommissionPhaseDecommissioning:
+		return requestDecommission(ctx, cluster, sts, decommission)
+	case v1alpha1.DecommissionPhaseRecovering:
+		return waitBookieRecovery(ctx, cluster, decommission)
+	case v1alpha1.DecommissionPhaseCleaningUp:
+		return cleanUpBookie(ctx, cluster, sts, decommission)
+	}
+	return fmt.Errorf("unknown decommission phase (%s) of the cluster (%s)", decommission.Phase, cluster.Name)
+}
+
+func makeBookieReadOnly(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	sts *v1.StatefulSet, decommission *v1alpha1.Decommission) error {
+	p, err := getBookiePod(ctx, sts, decommission.Ordinal)
+	if err != nil {
+		return err
+	}
+	// a bookie which is not running has nothing to be made read-only
+	if p != nil && pod.IsReady(p) {
+		if err = newBookieAdminClient(cluster, p.Name).SetReadOnly(context.TODO(), true); err != nil {
+			return fmt.Errorf("error on making the bookie (%s) read-only: %w", decommission.BookieID, err)
+		}
+	}
+	return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseStopping, "")
+}
+
+func stopBookie(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	sts *v1.StatefulSet, decommission *v1alpha1.Decommission) error {
+	if *sts.Spec.Replicas > decommission.Ordinal {
+		replicas := decommission.Ordinal
+		sts.Spec.Replicas = &replicas
+		ctx.Logger().Info("Removing the decommissioned bookie pod.",
+			"StatefulSet.Name", sts.GetName(),
+			"StatefulSet.Namespace", sts.GetNamespace(),
+			"NewReplicas", replicas)
+		if err := ctx.Client().Update(context.TODO(), sts); err != nil {
+			return fmt.Errorf("error on updating the statefulset (%s) replicas: %w", sts.Name, err)
+		}
+	}
+	if p, err := getBookiePod(ctx, sts, decommission.Ordinal); err != nil {
+		return err
+	} else if p != nil {
+		return requeueAfter(decommissionRequeueDelay, fmt.Sprintf("waiting for the pod %s to terminate", p.Name))
+	}
+	return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseDecommissioning, "")
+}
+
+func requestDecommission(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	sts *v1.StatefulSet, decommission *v1alpha1.Decommission) error {
+	if decommission.Ordinal == 0 {
+		// the scale down to zero is forced, the last bookie has no peer to re-replicate its ledgers to
+		ctx.Logger().Info("Skipping the decommission of the last bookie, its ledgers cannot be re-replicated",
+			"cluster", cluster.Name, "bookie", decommission.BookieID)
+		return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseCleaningUp, "")
+	}
+	var peer *v12.Pod
+	for ordinal := int32(0); ordinal < decommission.Ordinal && peer == nil; ordinal++ {
+		p, err := getBookiePod(ctx, sts, ordinal)
+		if err != nil {
+			return err
+		}
+		if p != nil && pod.IsReady(p) {
+			peer = p
+		}
+	}
+	if peer == nil {
+		return requeueAfter(decommissionRequeueDelay, "waiting for a ready bookie to request the decommission through")
+	}
+	if err := newBookieAdminClient(cluster, peer.Name).Decommission(context.TODO(), decommission.BookieID); err != nil {
+		return fmt.Errorf("error on requesting the bookie (%s) decommission: %w", decommission.BookieID, err)
+	}
+	ctx.Logger().Info("Requested the bookie decommission",
+		"cluster", cluster.Name, "bookie", decommission.BookieID, "through", peer.Name)
+	return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseRecovering, "")
+}
+
+// waitBookieRecovery waits for the decommission to re-replicate the bookie ledgers and remove its cookie
+func waitBookieRecovery(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	decommission *v1alpha1.Decommission) error {
+	zkClient, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return err
+	}
+	defer zkClient.Close()
+	underReplicated, err := zkClient.HasUnderReplicatedLedgers(cluster)
+	if err != nil {
+		return err
+	}
+	cookieExists, err := zkClient.CookieExists(cluster, decommission.BookieID)
+	if err != nil {
+		return err
+	}
+	if (underReplicated || cookieExists) && !cluster.AutoRecoveryEnabled() {
+		return stallDecommission(ctx, cluster, decommission)
+	}
+	switch {
+	case underReplicated:
+		decommission.Message = "waiting for the under-replicated ledgers to be recovered"
+	case cookieExists:
+		if decommission.StepStartTime != nil && time.Since(decommission.StepStartTime.Time) > decommissionRetryTimeout {
+			ctx.Logger().Info("The bookie decommission did not complete in time, requesting it again",
+				"cluster", cluster.Name, "bookie", decommission.BookieID)
+			return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseDecommissioning, "")
+		}
+		decommission.Message = "waiting for the decommission to complete"
+	default:
+		return saveDecommission(ctx, cluster, decommission, v1alpha1.DecommissionPhaseCleaningUp, "")
+	}
+	return requeueAfter(decommissionRequeueDelay, decommission.Message)
+}
+
+// stallDecommission reports the decommission waiting on the disabled autorecovery. It is not
+// polled, enabling the autorecovery changes the cluster and resumes it.
+func stallDecommission(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	decommission *v1alpha1.Decommission) error {
+	message := "the autorecovery is disabled, the bookie ledgers cannot be re-replicated"
+	if decommission.Message != message {
+		decommission.Message = message
+		recordWarning(ctx, cluster, EventDecommissionStalled,
+			"The decommission of the bookie %s is stalled, enable the autorecovery to resume it", decommission.BookieID)
+	}
+	cluster.Status.SetCondition(v1alpha1.ConditionClusterScalingDown, v12.ConditionTrue, v1alpha1.ReasonDecommissionStalled,
+		fmt.Sprintf("the decommission of the bookie %s is stalled: %s", decommission.BookieID, message), cluster.Generation)
+	return waitForChange(message)
+}
+
+func cleanUpBookie(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	sts *v1.StatefulSet, decommission *v1alpha1.Decommission) error {
+	zkClient, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return err
+	}
+	defer zkClient.Close()
+	if err = zkClient.DeleteCookie(cluster, decommission.BookieID); err != nil {
+		return fmt.Errorf("error on deleting the bookie (%s) cookie: %w", decommission.BookieID, err)
+	}
+	podName := bookiePodName(sts, decommission.Ordinal)
+	for _, claim := range sts.Spec.VolumeClaimTemplates {
+		toDel := &v12.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-%s", claim.Name, podName),
+				Namespace: sts.Namespace,
+			},
+		}
+		ctx.Logger().Info("Deleting the decommissioned bookie pvc.",
+			"StatefulSet.Name", sts.GetName(),
+			"StatefulSet.Namespace", sts.GetNamespace(),
+			"PVC.Namespace", toDel.GetNamespace(), "PVC.Name", toDel.GetName())
+		if err = ctx.Client().Delete(context.TODO(), toDel); err != nil && !errors.IsNotFound(err) {
+			recordWarning(ctx, cluster, EventPVCDeleteFailed,
+				"Failed to delete the decommissioned bookie pvc %s: %s", toDel.Name, err)
+			return fmt.Errorf("error on deleing the pvc (%s): %w", toDel.Name, err)
+		}
+	}
+	ctx.Logger().Info("The bookie is decommissioned",
+		"cluster", cluster.Name, "bookie", decommission.BookieID)
+	recordEvent(ctx, cluster, EventDecommissioned,
+		"Decommissioned the bookie %s and deleted its pvcs", decommission.BookieID)
+	cluster.Status.Decommission = nil
+	if err = ctx.Client().Status().Update(context.TODO(), cluster); err != nil {
+		return fmt.Errorf("error on updating the cluster (%s) status: %w", cluster.Name, err)
+	}
+	if *cluster.Spec.Size < *sts.Spec.Replicas {
+		return requeueAfter(decommissionRequeueDelay, "decommissioning the next bookie")
+	}
+	return nil
+}
+
+// saveDecommission moves the decommission to the specified phase and saves
+// it right away so the completed phases are not repeated after a restart
+func saveDecommission(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	decommission *v1alpha1.Decommission, phase v1alpha1.DecommissionPhase, message string) error {
+	now := metav1.Now()
+	decommission.Phase = phase
+	decommission.StepStartTime = &now
+	decommission.Message = message
+	cluster.Status.Decommission = decommission
+	if err := ctx.Client().Status().Update(context.TODO(), cluster); err != nil {
+		return fmt.Errorf("error on updating the cluster (%s) status: %w", cluster.Name, err)
+	}
+	return requeueAfter(decommissionRequeueDelay, fmt.Sprintf("bookie decommission phase: %s", phase))
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/operator-helper/reconciler"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// The reasons of the events recorded on the cluster
+const (
+	EventStatefulSetCreated    = "StatefulSetCreated"
+	EventStatefulSetUpdated    = "StatefulSetUpdated"
+	EventStatefulSetFailed     = "StatefulSetFailed"
+	EventDeploymentCreated     = "DeploymentCreated"
+	EventDeploymentUpdated     = "DeploymentUpdated"
+	EventDeploymentFailed      = "DeploymentFailed"
+	EventPVCDeleted            = "PVCDeleted"
+	EventPVCDeleteFailed       = "PVCDeleteFailed"
+	EventDecommissionStarted   = "DecommissionStarted"
+	EventDecommissioned        = "Decommissioned"
+	EventDecommissionStalled   = "DecommissionStalled"
+	EventMetadataUpdated       = "MetadataUpdated"
+	EventMetadataUpdateFailed  = "MetadataUpdateFailed"
+	EventMetadataCleanedUp     = "MetadataCleanedUp"
+	EventMetadataCleanUpFailed = "MetadataCleanUpFailed"
+	EventMetadataShared        = "MetadataShared"
+	EventMetadataInitStarted   = "MetadataInitStarted"
+	EventMetadataInitialized   = "MetadataInitialized"
+	EventMetadataInitFailed    = "MetadataInitFailed"
+	EventInstanceIDChanged     = "InstanceIDChanged"
+	EventFinalizerAdded        = "FinalizerAdded"
+	EventFinalizing            = "Finalizing"
+	EventFinalized             = "Finalized"
+	EventMonitoringCreated     = "MonitoringCreated"
+	EventMonitoringUpdated     = "MonitoringUpdated"
+	EventMonitoringDeleted     = "MonitoringDeleted"
+	EventMonitoringFailed      = "MonitoringFailed"
+	EventMonitoringUnavailable = "MonitoringUnavailable"
+	EventReconcileFailed       = "ReconcileFailed"
+	EventAutoRecoveryUpdated   = "AutoRecoveryStateUpdated"
+)
+
+// EventRecorderProvider is implemented by the reconciler contexts which record events on the cluster
+type EventRecorderProvider interface {
+	EventRecorder() record.EventRecorder
+}
+
+// recordEvent records a Normal event on the cluster when the context provides a recorder
+func recordEvent(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	reason, messageFmt string, args ...interface{}) {
+	emitEvent(ctx, cluster, v1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// recordWarning records a Warning event on the cluster when the context provides a recorder
+func recordWarning(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	reason, messageFmt string, args ...interface{}) {
+	emitEvent(ctx, cluster, v1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// RecordReconcileFailure records the failure of the cluster reconciliation
+func RecordReconcileFailure(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, err error) {
+	recordWarning(ctx, cluster, EventReconcileFailed, "Reconciliation failed: %s", err)
+}
+
+func emitEvent(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	eventType, reason, messageFmt string, args ...interface{}) {
+	provider, ok := ctx.(EventRecorderProvider)
+	if !ok || provider.EventRecorder() == nil {
+		return
+	}
+	provider.EventRecorder().Eventf(cluster, eventType, reason, messageFmt, args...)
+}
@@ -37,7 +37,11 @@ func ReconcileFinalizer(ctx reconciler.Context, cluster *v1alpha1.BookkeeperClus
 			ctx.Logger().Info("Adding the finalizer to the cluster",
 				"cluster", cluster.Name, "finalizer", finalizerName)
 			cluster.Finalizers = append(cluster.Finalizers, finalizerName)
-			return ctx.Client().Update(context.TODO(), cluster)
+			if err := ctx.Client().Update(context.TODO(), cluster); err != nil {
+				return err
+			}
+			recordEvent(ctx, cluster, EventFinalizerAdded, "Added the finalizer %s", finalizerName)
+			return nil
 		}
 	} else if oputil.Contains(cluster.Finalizers, finalizerName) {
 		if *cluster.Spec.Size > 0 || *cluster.Spec.AutoRecoveryReplicas > 0 {
@@ -49,6 +53,7 @@ func ReconcileFinalizer(ctx reconciler.Context, cluster *v1alpha1.BookkeeperClus
 			if err := ctx.Client().Update(context.TODO(), cluster); err != nil {
 				return fmt.Errorf("BookkeeperCluster object (%s) update error: %w", cluster.Name, err)
 			}
+			recordEvent(ctx, cluster, EventFinalizing, "Scaling the cluster down to zero before deleting it")
 			return nil
 		}
 		ctx.Logger().Info("Finalizing the cluster",
@@ -67,6 +72,7 @@ func ReconcileFinalizer(ctx reconciler.Context, cluster *v1alpha1.BookkeeperClus
 		}
 		ctx.Logger().Info("Cluster finalizers update and cleanup success.",
 			"cluster", cluster.GetName())
+		recordEvent(ctx, cluster, EventFinalized, "Removed the finalizer %s", finalizerName)
 		return nil
 	}
 	return nil
@@ -77,12 +83,51 @@ func cleanUpMetadata(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster
 	if err = cluster.WaitClusterTermination(ctx.Client()); err != nil {
 		return fmt.Errorf("error on waiting for the pods to terminate (%s): %w", cluster.Name, err)
 	}
+	if cluster.ZkRootPathReserved() {
+		// deleting the metadata would delete the one of the clusters with a namespace aware path
+		ctx.Logger().Info("Skipping the metadata cleanup, the zookeeper path overlaps the namespace aware paths",
+			"cluster", cluster.Name, "zkRootPath", cluster.ZkRootPath())
+		recordWarning(ctx, cluster, EventMetadataShared,
+			"Kept the zookeeper metadata %s which overlaps the namespace aware paths of the other clusters",
+			cluster.ZkRootPath())
+		return nil
+	}
+	if owner, err := overlappingCluster(ctx, cluster); err != nil {
+		return err
+	} else if owner != nil {
+		// deleting the metadata would delete the one of the other cluster too
+		ctx.Logger().Info("Skipping the metadata cleanup, the zookeeper path is shared",
+			"cluster", cluster.Name, "zkRootPath", cluster.ZkRootPath(),
+			"otherCluster", owner.Name, "otherNamespace", owner.Namespace)
+		recordWarning(ctx, cluster, EventMetadataShared,
+			"Kept the zookeeper metadata %s which overlaps the one of the cluster %s/%s",
+			cluster.ZkRootPath(), owner.Namespace, owner.Name)
+		return nil
+	}
 	if err = zk.DeleteMetadata(cluster); err != nil {
+		recordWarning(ctx, cluster, EventMetadataCleanUpFailed,
+			"Failed to delete the zookeeper metadata: %s", err)
 		return fmt.Errorf("error on deleting the zookeeper znodes for the cluster (%s): %w", cluster.Name, err)
 	}
+	recordEvent(ctx, cluster, EventMetadataCleanedUp, "Deleted the zookeeper metadata")
 	return nil
 }
 
+// overlappingCluster returns another cluster whose zookeeper metadata overlaps the one of the specified cluster
+func overlappingCluster(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) (*v1alpha1.BookkeeperCluster, error) {
+	clusters := &v1alpha1.BookkeeperClusterList{}
+	if err := ctx.Client().List(context.TODO(), clusters); err != nil {
+		return nil, fmt.Errorf("error on listing the clusters: %w", err)
+	}
+	for i := range clusters.Items {
+		other := &clusters.Items[i]
+		if other.UID != cluster.UID && cluster.ZkMetadataOverlaps(other) {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
 func generateFinalizerName(cluster *v1alpha1.BookkeeperCluster) string {
 	// bookkeepercluster.monime.sl-finalizer-cluster-1
 	return fmt.Sprintf("%s-%s", finalizerNamePrefix, cluster.Name)
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
+	"github.com/monimesl/operator-helper/k8s/pod"
+	"github.com/monimesl/operator-helper/reconciler"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+const (
+	metadataInitComponent    = "metadata-init"
+	metadataInitBackoffLimit = int32(3)
+	metadataInitPollInterval = 10 * time.Second
+)
+
+// ReconcileMetadataInit formats the ledgers metadata of the specified cluster in zookeeper
+// with a one-shot job, the bookies are not created until the metadata is initialized
+func ReconcileMetadataInit(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	if !cluster.DeletionTimestamp.IsZero() || cluster.Status.Metadata.Initialized {
+		return nil
+	}
+	initialized, partial, err := metadataState(cluster)
+	if err != nil {
+		return fmt.Errorf("error on checking the cluster (%s) metadata in zookeeper: %w", cluster.Name, err)
+	}
+	job := &batchv1.Job{}
+	err = ctx.Client().Get(context.TODO(), types.NamespacedName{
+		Name:      cluster.MetadataInitJobName(),
+		Namespace: cluster.Namespace,
+	}, job)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error on getting the metadata init job (%s): %w", cluster.MetadataInitJobName(), err)
+	}
+	found := err == nil
+	if initialized {
+		// persisted with the rest of the status by ReconcileClusterStatus
+		cluster.Status.Metadata.Initialized = true
+		if found {
+			if jobSucceeded(job) {
+				recordEvent(ctx, cluster, EventMetadataInitialized,
+					"Initialized the cluster metadata in zookeeper at %s", cluster.ZkLedgersRootPath())
+			}
+			return deleteMetadataInitJob(ctx, job)
+		}
+		return nil
+	}
+	if found && !jobFailed(job) && !jobSucceeded(job) {
+		// the running job creates the ledgers root before formatting it
+		return requeueAfter(metadataInitPollInterval, "waiting for the metadata initialization")
+	}
+	if partial {
+		// the initialization refuses an existing ledgers root, running it again cannot succeed
+		message := fmt.Sprintf("the ledgers root %s exists without the cluster metadata, "+
+			"it must be removed from zookeeper to initialize the metadata", cluster.ZkLedgersRootPath())
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterPreparing, v12.ConditionTrue,
+			v1alpha1.ReasonPartialMetadata, message, cluster.Generation)
+		recordWarning(ctx, cluster, EventMetadataInitFailed, "The ledgers root %s exists without the "+
+			"cluster metadata, remove it from zookeeper to initialize the metadata", cluster.ZkLedgersRootPath())
+		return fmt.Errorf("the cluster (%s) %s", cluster.Name, message)
+	}
+	if !found {
+		return createMetadataInitJob(ctx, cluster)
+	}
+	if jobFailed(job) {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterPreparing, v12.ConditionTrue,
+			v1alpha1.ReasonMetadataInitFailed, "the metadata initialization job failed", cluster.Generation)
+		recordWarning(ctx, cluster, EventMetadataInitFailed,
+			"The metadata initialization job %s failed, delete it to retry", job.Name)
+		return fmt.Errorf("the cluster (%s) metadata initialization job (%s) failed", cluster.Name, job.Name)
+	}
+	// the job exited before creating the ledgers root, run it again
+	return deleteMetadataInitJob(ctx, job)
+}
+
+// metadataState checks whether the ledgers metadata of the cluster is initialized, or
+// partial when its ledgers root exists without the formatted metadata
+func metadataState(cluster *v1alpha1.BookkeeperCluster) (initialized, partial bool, err error) {
+	cl, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return false, false, err
+	}
+	defer cl.Close()
+	if initialized, err = cl.LedgersMetadataInitialized(cluster); err != nil || initialized {
+		return initialized, false, err
+	}
+	partial, err = cl.LedgersRootExists(cluster)
+	return false, partial, err
+}
+
+// createClusterRoot creates the cluster root the metadata initialization creates the ledgers root in
+func createClusterRoot(cluster *v1alpha1.BookkeeperCluster) error {
+	cl, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	return cl.CreateClusterRoot(cluster)
+}
+
+func createMetadataInitJob(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	if err := createClusterRoot(cluster); err != nil {
+		return fmt.Errorf("error on creating the cluster (%s) root in zookeeper: %w", cluster.Name, err)
+	}
+	job := createMetadataInitJobObject(cluster)
+	if err := ctx.SetOwnershipReference(cluster, job); err != nil {
+		return err
+	}
+	ctx.Logger().Info("Creating the metadata init job.",
+		"Job.Name", job.GetName(),
+		"Job.Namespace", job.GetNamespace())
+	if err := ctx.Client().Create(context.TODO(), job); err != nil {
+		recordWarning(ctx, cluster, EventMetadataInitFailed,
+			"Failed to create the metadata initialization job %s: %s", job.Name, err)
+		return err
+	}
+	recordEvent(ctx, cluster, EventMetadataInitStarted,
+		"Created the job %s initializing the cluster metadata", job.Name)
+	cluster.Status.SetCondition(v1alpha1.ConditionClusterPreparing, v12.ConditionTrue,
+		v1alpha1.ReasonInitializingMetadata, "initializing the cluster metadata", cluster.Generation)
+	return requeueAfter(metadataInitPollInterval, "waiting for the metadata initialization")
+}
+
+func deleteMetadataInitJob(ctx reconciler.Context, job *batchv1.Job) error {
+	ctx.Logger().Info("Deleting the metadata init job.",
+		"Job.Name", job.GetName(),
+		"Job.Namespace", job.GetNamespace())
+	err := ctx.Client().Delete(context.TODO(), job, client.PropagationPolicy(v13.DeletePropagationBackground))
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error on deleting the metadata init job (%s): %w", job.Name, err)
+	}
+	return nil
+}
+
+func jobSucceeded(job *batchv1.Job) bool {
+	return jobConditionTrue(job, batchv1.JobComplete)
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	return jobConditionTrue(job, batchv1.JobFailed)
+}
+
+func jobConditionTrue(job *batchv1.Job, condType batchv1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == condType && condition.Status == v12.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func createMetadataInitJobObject(c *v1alpha1.BookkeeperCluster) *batchv1.Job {
+	backoffLimit := metadataInitBackoffLimit
+	labels := c.GenerateWorkloadLabels(metadataInitComponent)
+	image := c.Image()
+	volumes, volumeMounts, initContainers := zkSecurityPodConfig(c)
+	container := v12.Container{
+		Name:  metadataInitComponent,
+		Image: image.ToString(),
+		Command: []string{
+			"/bin/bash", "/opt/bookkeeper/scripts/entrypoint.sh",
+		},
+		Args: []string{
+			"/opt/bookkeeper/bin/bookkeeper", "shell", "initnewcluster",
+		},
+		EnvFrom: []v12.EnvFromSource{
+			{
+				ConfigMapRef: &v12.ConfigMapEnvSource{
+					LocalObjectReference: v12.LocalObjectReference{
+						Name: c.ConfigMapName(),
+					},
+				},
+			},
+		},
+		Env:             pod.DecorateContainerEnvVars(true, c.Spec.PodConfig.Spec.Env...),
+		VolumeMounts:    volumeMounts,
+		ImagePullPolicy: image.PullPolicy,
+	}
+	podSpec := pod.NewSpec(c.Spec.PodConfig, volumes, initContainers, []v12.Container{container})
+	podSpec.RestartPolicy = v12.RestartPolicyNever
+	return &batchv1.Job{
+		TypeMeta: v13.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: v13.ObjectMeta{
+			Namespace:   c.Namespace,
+			Name:        c.MetadataInitJobName(),
+			Labels:      labels,
+			Annotations: c.GenerateAnnotations(),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: v12.PodTemplateSpec{
+				ObjectMeta: pod.NewMetadata(*c.Spec.PodConfig.DeepCopy(), c.MetadataInitJobName(), "",
+					labels, c.GenerateAnnotations()),
+				Spec: podSpec,
+			},
+		},
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal"
+	"github.com/monimesl/operator-helper/k8s"
+	"github.com/monimesl/operator-helper/reconciler"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"regexp"
+	"strings"
+)
+
+const (
+	monitoringAPIVersion = "monitoring.coreos.com/v1"
+	metricsPath          = "/metrics"
+	// clusterMetricLabel is the label the cluster name is attached to the scraped metrics with
+	clusterMetricLabel = "bookkeeper_cluster"
+)
+
+var (
+	specHashAnnotation   = internal.Domain + "/spec-hash"
+	invalidMetaLabelChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// The Prometheus Operator objects are handled as unstructured since their CRDs are optional; the
+// monitoring is skipped when they are not installed. The spec of each object is hashed into an
+// annotation so the objects are only updated when the desired spec changes.
+
+type monitorSelector struct {
+	Selector          metav1.LabelSelector `json:"selector"`
+	NamespaceSelector namespaceSelector    `json:"namespaceSelector"`
+	PodTargetLabels   []string             `json:"podTargetLabels,omitempty"`
+}
+
+type namespaceSelector struct {
+	MatchNames []string `json:"matchNames"`
+}
+
+type monitorEndpoint struct {
+	Port              string                   `json:"port"`
+	Path              string                   `json:"path"`
+	Interval          string                   `json:"interval,omitempty"`
+	ScrapeTimeout     string                   `json:"scrapeTimeout,omitempty"`
+	Relabelings       []v1alpha1.RelabelConfig `json:"relabelings,omitempty"`
+	MetricRelabelings []v1alpha1.RelabelConfig `json:"metricRelabelings,omitempty"`
+}
+
+type serviceMonitorSpec struct {
+	monitorSelector `json:",inline"`
+	Endpoints       []monitorEndpoint `json:"endpoints"`
+}
+
+type podMonitorSpec struct {
+	monitorSelector     `json:",inline"`
+	PodMetricsEndpoints []monitorEndpoint `json:"podMetricsEndpoints"`
+}
+
+// ReconcileMonitoring reconcile the Prometheus Operator monitor scraping the metrics of the specified cluster
+func ReconcileMonitoring(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	if !cluster.DeletionTimestamp.IsZero() {
+		// the monitor is garbage collected with the cluster
+		return nil
+	}
+	if !cluster.MonitoringEnabled() && cluster.Status.Metadata.ServiceMonitorVersion == nil {
+		// no monitor is desired nor applied, the CRDs are not looked up
+		setMonitoringCondition(ctx, cluster, nil)
+		return nil
+	}
+	missing, err := missingPrometheusCRDs(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	setMonitoringCondition(ctx, cluster, missing)
+	var applied *string
+	for _, kind := range []v1alpha1.MonitorKind{v1alpha1.MonitorKindServiceMonitor, v1alpha1.MonitorKindPodMonitor} {
+		var desired *unstructured.Unstructured
+		if cluster.MonitoringEnabled() && cluster.Spec.Monitoring.Kind == kind {
+			if desired, err = createMonitor(cluster, kind); err != nil {
+				return err
+			}
+		}
+		gvk := schema.FromAPIVersionAndKind(monitoringAPIVersion, string(kind))
+		version, err := reconcilePrometheusObject(ctx, cluster, gvk, cluster.MonitorName(), desired)
+		if err != nil {
+			return err
+		}
+		if version != nil {
+			applied = version
+		}
+	}
+	// persisted with the rest of the status by ReconcileClusterStatus
+	cluster.Status.Metadata.ServiceMonitorVersion = applied
+	return nil
+}
+
+// prometheusCRDInstalled checks whether the CRD of the Prometheus Operator kind is installed
+func prometheusCRDInstalled(ctx reconciler.Context, kind string) (bool, error) {
+	gvk := schema.FromAPIVersionAndKind(monitoringAPIVersion, kind)
+	_, err := ctx.Client().RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// missingPrometheusCRDs returns the kinds of the desired Prometheus Operator objects, the monitor
+// and the alerts rule, whose CRD is not installed
+func missingPrometheusCRDs(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) ([]string, error) {
+	var kinds, missing []string
+	if cluster.MonitoringEnabled() {
+		kinds = append(kinds, string(cluster.Spec.Monitoring.Kind))
+	}
+	if cluster.AlertsEnabled() {
+		kinds = append(kinds, prometheusRuleKind)
+	}
+	for _, kind := range kinds {
+		installed, err := prometheusCRDInstalled(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+		if !installed {
+			missing = append(missing, kind)
+		}
+	}
+	return missing, nil
+}
+
+// setMonitoringCondition reports the desired Prometheus Operator kinds whose CRD is not installed in the
+// MonitoringUnavailable condition. The warning is recorded when they become missing, not on every reconcile.
+func setMonitoringCondition(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, missing []string) {
+	if len(missing) == 0 {
+		if cluster.Status.IsConditionTrue(v1alpha1.ConditionClusterMonitoringUnavailable) {
+			cluster.Status.SetCondition(v1alpha1.ConditionClusterMonitoringUnavailable, v12.ConditionFalse,
+				v1alpha1.ReasonMonitoringAvailable, "", cluster.Generation)
+		}
+		return
+	}
+	message := fmt.Sprintf("the %s CRD is not installed, the Prometheus Operator is required for the monitoring",
+		strings.Join(missing, ", "))
+	if _, condition := cluster.Status.GetCondition(v1alpha1.ConditionClusterMonitoringUnavailable); condition == nil ||
+		condition.Status != v12.ConditionTrue || condition.Message != message {
+		ctx.Logger().Info("The Prometheus Operator CRD is not installed, skipping the monitoring",
+			"cluster", cluster.Name, "kinds", missing)
+		recordWarning(ctx, cluster, EventMonitoringUnavailable,
+			"The %s CRD is not installed, the Prometheus Operator is required for the monitoring",
+			strings.Join(missing, ", "))
+	}
+	// persisted with the rest of the status by ReconcileClusterStatus
+	cluster.Status.SetCondition(v1alpha1.ConditionClusterMonitoringUnavailable, v12.ConditionTrue,
+		v1alpha1.ReasonPrometheusCRDMissing, message, cluster.Generation)
+}
+
+// reconcilePrometheusObject creates or updates the Prometheus Operator object to the desired one, or deletes
+// it when the desired one is nil. It returns the resource version of the applied object, nil when none is.
+// The object is skipped when its CRD is not installed, which is reported by setMonitoringCondition.
+func reconcilePrometheusObject(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	gvk schema.GroupVersionKind, name string, desired *unstructured.Unstructured) (*string, error) {
+	if installed, err := prometheusCRDInstalled(ctx, gvk.Kind); err != nil || !installed {
+		return nil, err
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(gvk)
+	err := ctx.Client().Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cluster.Namespace}, live)
+	switch {
+	case errors.IsNotFound(err):
+		if desired == nil {
+			return nil, nil
+		}
+		if err = ctx.SetOwnershipReference(cluster, desired); err != nil {
+			return nil, err
+		}
+		ctx.Logger().Info("Creating the bookkeeper "+gvk.Kind,
+			"Name", desired.GetName(), "Namespace", desired.GetNamespace())
+		if err = ctx.Client().Create(context.TODO(), desired); err != nil {
+			recordWarning(ctx, cluster, EventMonitoringFailed, "Failed to create the %s %s: %s", gvk.Kind, name, err)
+			return nil, fmt.Errorf("error on creating the %s (%s): %w", gvk.Kind, name, err)
+		}
+		recordEvent(ctx, cluster, EventMonitoringCreated, "Created the %s %s", gvk.Kind, name)
+		version := desired.GetResourceVersion()
+		return &version, nil
+	case err != nil:
+		return nil, err
+	case desired == nil:
+		ctx.Logger().Info("Deleting the bookkeeper "+gvk.Kind,
+			"Name", live.GetName(), "Namespace", live.GetNamespace())
+		if err = ctx.Client().Delete(context.TODO(), live); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("error on deleting the %s (%s): %w", gvk.Kind, name, err)
+		}
+		recordEvent(ctx, cluster, EventMonitoringDeleted, "Deleted the %s %s", gvk.Kind, name)
+		return nil, nil
+	}
+	if live.GetAnnotations()[specHashAnnotation] != desired.GetAnnotations()[specHashAnnotation] {
+		live.Object["spec"] = desired.Object["spec"]
+		live.SetLabels(mergeLabels(live.GetLabels(), desired.GetLabels()))
+		live.SetAnnotations(mergeLabels(live.GetAnnotations(), desired.GetAnnotations()))
+		ctx.Logger().Info("Updating the bookkeeper "+gvk.Kind,
+			"Name", live.GetName(), "Namespace", live.GetNamespace())
+		if err = ctx.Client().Update(context.TODO(), live); err != nil {
+			recordWarning(ctx, cluster, EventMonitoringFailed, "Failed to update the %s %s: %s", gvk.Kind, name, err)
+			return nil, fmt.Errorf("error on updating the %s (%s): %w", gvk.Kind, name, err)
+		}
+		recordEvent(ctx, cluster, EventMonitoringUpdated, "Updated the %s %s", gvk.Kind, name)
+	}
+	version := live.GetResourceVersion()
+	return &version, nil
+}
+
+func createMonitor(cluster *v1alpha1.BookkeeperCluster, kind v1alpha1.MonitorKind) (*unstructured.Unstructured, error) {
+	monitoring := cluster.Spec.Monitoring
+	selector := monitorSelector{
+		Selector:          metav1.LabelSelector{MatchLabels: cluster.GenerateLabels()},
+		NamespaceSelector: namespaceSelector{MatchNames: []string{cluster.Namespace}},
+		PodTargetLabels:   []string{"component"},
+	}
+	endpoint := monitorEndpoint{
+		Port:          v1alpha1.ServiceMetricsPortName,
+		Path:          metricsPath,
+		Interval:      monitoring.Interval,
+		ScrapeTimeout: monitoring.ScrapeTimeout,
+		Relabelings: append([]v1alpha1.RelabelConfig{{
+			SourceLabels: []string{podLabelMetaLabel(k8s.LabelAppInstance)},
+			TargetLabel:  clusterMetricLabel,
+		}}, monitoring.Relabelings...),
+		MetricRelabelings: monitoring.MetricRelabelings,
+	}
+	var spec interface{}
+	if kind == v1alpha1.MonitorKindServiceMonitor {
+		// the client service exposes the same pods, only the headless one is scraped
+		endpoint.Relabelings = append([]v1alpha1.RelabelConfig{{
+			SourceLabels: []string{"__meta_kubernetes_service_name"},
+			Regex:        cluster.HeadlessServiceName(),
+			Action:       "keep",
+		}}, endpoint.Relabelings...)
+		spec = &serviceMonitorSpec{monitorSelector: selector, Endpoints: []monitorEndpoint{endpoint}}
+	} else {
+		spec = &podMonitorSpec{monitorSelector: selector, PodMetricsEndpoints: []monitorEndpoint{endpoint}}
+	}
+	return newPrometheusObject(cluster, string(kind), cluster.MonitorName(),
+		mergeLabels(cluster.GenerateLabels(), monitoring.Labels), spec)
+}
+
+// newPrometheusObject creates the unstructured Prometheus Operator object of the specified spec
+func newPrometheusObject(cluster *v1alpha1.BookkeeperCluster, kind, name string,
+	labels map[string]string, spec interface{}) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error on creating the %s (%s) spec: %w", kind, name, err)
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": content}}
+	obj.SetAPIVersion(monitoringAPIVersion)
+	obj.SetKind(kind)
+	obj.SetName(name)
+	obj.SetNamespace(cluster.Namespace)
+	obj.SetLabels(labels)
+	obj.SetAnnotations(map[string]string{specHashAnnotation: hex.EncodeToString(hash[:])})
+	return obj, nil
+}
+
+// podLabelMetaLabel returns the meta label Prometheus discovers the pod label with
+func podLabelMetaLabel(label string) string {
+	return "__meta_kubernetes_pod_label_" + invalidMetaLabelChar.ReplaceAllString(label, "_")
+}
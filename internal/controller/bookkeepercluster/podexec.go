@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/monimesl/operator-helper/reconciler"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"strconv"
+	"strings"
+)
+
+// PodExecutorProvider is implemented by the reconciler contexts which run commands in the bookie pods
+type PodExecutorProvider interface {
+	PodExecutor() PodExecutor
+}
+
+// PodExecutor runs a command in a container of a pod and returns its standard output
+type PodExecutor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string) ([]byte, error)
+}
+
+type podExecutor struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+}
+
+// NewPodExecutor creates a PodExecutor running the commands through the exec subresource of the pods
+func NewPodExecutor(config *rest.Config) (PodExecutor, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error on creating the kubernetes clientset: %w", err)
+	}
+	return &podExecutor{config: config, clientset: clientset}, nil
+}
+
+func (e *podExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) ([]byte, error) {
+	req := e.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&v12.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return nil, fmt.Errorf("error on creating the executor of the pod (%s): %w", pod, err)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: stdout, Stderr: stderr}); err != nil {
+		return nil, fmt.Errorf("error on running %q in the pod (%s): %w: %s",
+			strings.Join(command, " "), pod, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// getPodExecutor returns the executor of the context; nil when it provides none
+func getPodExecutor(ctx reconciler.Context) PodExecutor {
+	if provider, ok := ctx.(PodExecutorProvider); ok {
+		return provider.PodExecutor()
+	}
+	return nil
+}
+
+// directoryDiskSpace gets the free and total space of the volume of the directory in the bookie container
+func directoryDiskSpace(ctx context.Context, executor PodExecutor, namespace, pod, dir string) (free, total int64, err error) {
+	output, err := executor.Exec(ctx, namespace, pod, bookieComponent, []string{"df", "-P", "-k", dir})
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseDiskSpace(string(output))
+}
+
+// parseDiskSpace parses the POSIX output of df for a single directory:
+//
+//	Filesystem     1024-blocks     Used Available Capacity Mounted on
+//	/dev/sdb          10255636  2092844   8146408      21% /bk/data/journal
+func parseDiskSpace(output string) (free, total int64, err error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return 0, 0, fmt.Errorf("unexpected df output %q", output)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return 0, 0, fmt.Errorf("unexpected df output %q", output)
+	}
+	if total, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("unexpected df total blocks %q: %w", fields[1], err)
+	}
+	if free, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("unexpected df available blocks %q: %w", fields[3], err)
+	}
+	return free * 1024, total * 1024, nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// RequeueError is returned by the reconcile steps which are waiting on the cluster to
+// progress. It asks for the cluster to be reconciled again without failing the reconciliation,
+// or only on the next cluster change when After is zero.
+type RequeueError struct {
+	After  time.Duration
+	Reason string
+}
+
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("requeue after %s: %s", e.After, e.Reason)
+}
+
+func requeueAfter(after time.Duration, reason string) error {
+	return &RequeueError{After: after, Reason: reason}
+}
+
+// waitForChange stops the step until the cluster changes rather than polling it
+func waitForChange(reason string) error {
+	return &RequeueError{Reason: reason}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
+	"github.com/monimesl/operator-helper/k8s/pod"
+	"github.com/monimesl/operator-helper/oputil"
+	"github.com/monimesl/operator-helper/reconciler"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	rolloutRequeueDelay = 15 * time.Second
+	rolloutStepTimeout  = 15 * time.Minute
+)
+
+// The bookies are rolled with a partitioned RollingUpdate. A pod template change sets the
+// partition to the number of replicas so the statefulset controller replaces nothing by itself.
+// The operator then lowers the partition one ordinal at a time, from the highest one, only after
+// the last rolled bookie is healthy again and the cluster has no under-replicated ledgers.
+
+// rolloutUpdateStrategy returns the update strategy to apply with the desired statefulset
+func rolloutUpdateStrategy(desired, sts *v1.StatefulSet) v1.StatefulSetUpdateStrategy {
+	if sts.Spec.UpdateStrategy.Type == v1.RollingUpdateStatefulSetStrategyType &&
+		!templateChanged(desired, sts) {
+		// the partition is owned by the rollout
+		return *sts.Spec.UpdateStrategy.DeepCopy()
+	}
+	return desired.Spec.UpdateStrategy
+}
+
+func rolloutPartition(sts *v1.StatefulSet) int32 {
+	if rollingUpdate := sts.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil {
+		return *rollingUpdate.Partition
+	}
+	return 0
+}
+
+// reconcileRollout rolls the bookies to the statefulset update revision one at a time
+func reconcileRollout(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, sts *v1.StatefulSet) error {
+	if !cluster.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	defer setUpgradingCondition(cluster)
+	if sts.Status.ObservedGeneration < sts.Generation {
+		return requeueAfter(rolloutRequeueDelay, "waiting for the statefulset controller to observe the update")
+	}
+	if sts.Status.UpdateRevision == sts.Status.CurrentRevision {
+		completeRollout(ctx, cluster)
+		return nil
+	}
+	rollout := cluster.Status.Rollout
+	partition := rolloutPartition(sts)
+	if partition > *sts.Spec.Replicas {
+		// the cluster was scaled down during the rollout
+		partition = *sts.Spec.Replicas
+	}
+	if rollout == nil || rollout.Revision != sts.Status.UpdateRevision {
+		ctx.Logger().Info("Starting the bookies rollout",
+			"cluster", cluster.Name, "revision", sts.Status.UpdateRevision)
+		now := metav1.Now()
+		rollout = &v1alpha1.Rollout{
+			Phase:         v1alpha1.RolloutPhaseRolling,
+			Revision:      sts.Status.UpdateRevision,
+			Ordinal:       partition,
+			StepStartTime: &now,
+		}
+		cluster.Status.Rollout = rollout
+	}
+	ready, reason, err := readyForNextRolloutStep(ctx, cluster, sts, partition)
+	if err != nil {
+		return fmt.Errorf("error on checking the cluster (%s) rollout: %w", cluster.Name, err)
+	}
+	if !ready {
+		rollout.Message = reason
+		if rollout.Phase != v1alpha1.RolloutPhaseStalled && rollout.StepStartTime != nil &&
+			time.Since(rollout.StepStartTime.Time) > rolloutStepTimeout {
+			ctx.Logger().Info("The bookies rollout is stalled",
+				"cluster", cluster.Name, "ordinal", rollout.Ordinal, "reason", reason)
+			rollout.Phase = v1alpha1.RolloutPhaseStalled
+		}
+		return requeueAfter(rolloutRequeueDelay, reason)
+	}
+	if partition == 0 {
+		return requeueAfter(rolloutRequeueDelay, "waiting for the statefulset controller to complete the rollout")
+	}
+	next := partition - 1
+	ctx.Logger().Info("Rolling the next bookie",
+		"cluster", cluster.Name, "ordinal", next, "revision", sts.Status.UpdateRevision)
+	if sts.Spec.UpdateStrategy.RollingUpdate == nil {
+		sts.Spec.UpdateStrategy.RollingUpdate = &v1.RollingUpdateStatefulSetStrategy{}
+	}
+	sts.Spec.UpdateStrategy.RollingUpdate.Partition = &next
+	if err = ctx.Client().Update(context.TODO(), sts); err != nil {
+		return fmt.Errorf("error on updating the statefulset (%s) partition: %w", sts.Name, err)
+	}
+	now := metav1.Now()
+	rollout.Phase = v1alpha1.RolloutPhaseRolling
+	rollout.Ordinal = next
+	rollout.StepStartTime = &now
+	rollout.Message = ""
+	return requeueAfter(rolloutRequeueDelay, "waiting for the rolled bookie to become healthy")
+}
+
+// readyForNextRolloutStep checks that the last rolled bookie is healthy
+// again and that the cluster has no under-replicated ledgers
+func readyForNextRolloutStep(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster,
+	sts *v1.StatefulSet, partition int32) (bool, string, error) {
+	zkClient, err := zk.DefaultManager.Client(cluster)
+	if err != nil {
+		return false, "", err
+	}
+	defer zkClient.Close()
+	if partition < *sts.Spec.Replicas {
+		podName := bookiePodName(sts, partition)
+		p, err := getBookiePod(ctx, sts, partition)
+		switch {
+		case err != nil:
+			return false, "", err
+		case p == nil || p.Labels[v1.ControllerRevisionHashLabelKey] != sts.Status.UpdateRevision:
+			return false, fmt.Sprintf("waiting for the pod %s to be updated", podName), nil
+		case !pod.IsReady(p):
+			return false, fmt.Sprintf("waiting for the pod %s to be ready", podName), nil
+		}
+		bookies, err := zkClient.WritableBookies(cluster)
+		if err != nil {
+			return false, "", err
+		}
+		if !oputil.Contains(bookies, cluster.BookieID(podName)) {
+			return false, fmt.Sprintf("waiting for the bookie %s to register as writable", podName), nil
+		}
+	}
+	if underReplicated, err := zkClient.HasUnderReplicatedLedgers(cluster); err != nil {
+		return false, "", err
+	} else if underReplicated {
+		return false, "waiting for the under-replicated ledgers to be recovered", nil
+	}
+	return true, "", nil
+}
+
+func completeRollout(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) {
+	rollout := cluster.Status.Rollout
+	if rollout == nil || rollout.Phase == v1alpha1.RolloutPhaseCompleted {
+		return
+	}
+	ctx.Logger().Info("The bookies rollout is completed",
+		"cluster", cluster.Name, "revision", rollout.Revision)
+	rollout.Phase = v1alpha1.RolloutPhaseCompleted
+	rollout.Ordinal = 0
+	rollout.Message = ""
+}
+
+// setUpgradingCondition reports the rollout progress in the Upgrading condition
+func setUpgradingCondition(cluster *v1alpha1.BookkeeperCluster) {
+	rollout := cluster.Status.Rollout
+	if rollout == nil || rollout.Phase == v1alpha1.RolloutPhaseCompleted {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterUpgrading, v12.ConditionFalse, v1alpha1.ReasonRolloutCompleted,
+			fmt.Sprintf("the bookies run the version %s", cluster.Spec.BookkeeperVersion), cluster.Generation)
+		return
+	}
+	reason := v1alpha1.ReasonRollingUpdate
+	message := fmt.Sprintf("rolling the bookies to the revision %s", rollout.Revision)
+	if from := previousBookieVersions(cluster); len(from) > 0 {
+		reason = v1alpha1.ReasonVersionUpgrade
+		message = fmt.Sprintf("upgrading the bookies from %s to %s",
+			strings.Join(from, ", "), cluster.Spec.BookkeeperVersion)
+	}
+	if rollout.Phase == v1alpha1.RolloutPhaseStalled {
+		reason = v1alpha1.ReasonRolloutStalled
+		message = fmt.Sprintf("%s, stalled %s", message, rollout.Message)
+	}
+	cluster.Status.SetCondition(v1alpha1.ConditionClusterUpgrading, v12.ConditionTrue, reason, message, cluster.Generation)
+}
+
+// previousBookieVersions lists the versions the bookies run other than the desired one
+func previousBookieVersions(cluster *v1alpha1.BookkeeperCluster) []string {
+	var versions []string
+	for _, bookie := range cluster.Status.Bookies {
+		if bookie.Version != "" && bookie.Version != cluster.Spec.BookkeeperVersion &&
+			!oputil.Contains(versions, bookie.Version) {
+			versions = append(versions, bookie.Version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
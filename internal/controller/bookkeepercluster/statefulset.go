@@ -27,6 +27,7 @@ import (
 	"github.com/monimesl/operator-helper/reconciler"
 	v1 "k8s.io/api/apps/v1"
 	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -49,18 +50,35 @@ func ReconcileStatefulSet(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCl
 	}, sts,
 		// Found
 		func() error {
-			if shouldUpdateStatefulSet(ctx, cluster, sts) {
-				if err := updateStatefulset(ctx, sts, cluster); err != nil {
+			liveReplicas := *sts.Spec.Replicas
+			desired := createStatefulSet(cluster)
+			desired.Spec.UpdateStrategy = rolloutUpdateStrategy(desired, sts)
+			if scalingDown(cluster, sts) {
+				// the replicas are lowered by the decommission
+				desired.Spec.Replicas = sts.Spec.Replicas
+			}
+			if shouldUpdateStatefulSet(ctx, desired, sts) {
+				if err := updateStatefulset(ctx, cluster, sts, desired); err != nil {
 					return err
 				}
 				if err := updateStatefulsetPVCs(ctx, sts, cluster); err != nil {
 					return err
 				}
 			}
-			return nil
+			setScalingConditions(cluster, sts, liveReplicas)
+			if err := reconcileScaleDown(ctx, cluster, sts); err != nil {
+				return err
+			}
+			return reconcileRollout(ctx, cluster, sts)
 		},
 		// Not Found
 		func() error {
+			if !cluster.Status.Metadata.Initialized {
+				// the bookies would fail to register without the cluster metadata
+				ctx.Logger().Info("Waiting for the cluster metadata initialization to create the statefulset",
+					"cluster", cluster.Name)
+				return nil
+			}
 			sts = createStatefulSet(cluster)
 			if err := ctx.SetOwnershipReference(cluster, sts); err != nil {
 				return err
@@ -69,52 +87,86 @@ func ReconcileStatefulSet(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCl
 				"StatefulSet.Name", sts.GetName(),
 				"StatefulSet.Namespace", sts.GetNamespace())
 			if err := ctx.Client().Create(context.TODO(), sts); err != nil {
+				recordWarning(ctx, cluster, EventStatefulSetFailed,
+					"Failed to create the statefulset %s: %s", sts.Name, err)
 				return err
 			}
 			ctx.Logger().Info("StatefulSet creation success.",
 				"StatefulSet.Name", sts.GetName(),
 				"StatefulSet.Namespace", sts.GetNamespace())
+			recordEvent(ctx, cluster, EventStatefulSetCreated,
+				"Created the statefulset %s with %d replicas", sts.Name, *sts.Spec.Replicas)
+			cluster.Status.SetPreparingCondition(cluster.Generation)
 			return nil
 		})
 }
 
-func shouldUpdateStatefulSet(ctx reconciler.Context, c *v1alpha1.BookkeeperCluster, sts *v1.StatefulSet) bool {
-	if *c.Spec.Size != *sts.Spec.Replicas {
+// setScalingConditions reports the bookies being added or decommissioned
+func setScalingConditions(cluster *v1alpha1.BookkeeperCluster, sts *v1.StatefulSet, liveReplicas int32) {
+	size := *cluster.Spec.Size
+	if decommission := cluster.Status.Decommission; decommission != nil {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterScalingDown, v12.ConditionTrue, v1alpha1.ReasonDecommissioning,
+			fmt.Sprintf("scaling down to %d bookies, decommissioning the bookie %s (%s)",
+				size, decommission.BookieID, decommission.Phase), cluster.Generation)
+	} else {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterScalingDown, v12.ConditionFalse, v1alpha1.ReasonScaleCompleted,
+			fmt.Sprintf("the cluster is scaled to %d bookies", size), cluster.Generation)
+	}
+	if liveReplicas < size || (cluster.Status.IsConditionTrue(v1alpha1.ConditionClusterScalingUp) &&
+		sts.Status.ReadyReplicas < size) {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterScalingUp, v12.ConditionTrue, v1alpha1.ReasonAddingBookies,
+			fmt.Sprintf("scaling up to %d bookies, %d are ready", size, sts.Status.ReadyReplicas), cluster.Generation)
+	} else {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterScalingUp, v12.ConditionFalse, v1alpha1.ReasonScaleCompleted,
+			fmt.Sprintf("the cluster is scaled to %d bookies", size), cluster.Generation)
+	}
+}
+
+// shouldUpdateStatefulSet compares the desired statefulset with the live one. The labels and annotations
+// are merged into the live ones so only the desired ones are compared, the pod template is compared by hash.
+func shouldUpdateStatefulSet(ctx reconciler.Context, desired, sts *v1.StatefulSet) bool {
+	if *desired.Spec.Replicas != *sts.Spec.Replicas {
 		ctx.Logger().Info("Bookkeeper cluster size changed",
-			"from", *sts.Spec.Replicas, "to", *c.Spec.Size)
+			"from", *sts.Spec.Replicas, "to", *desired.Spec.Replicas)
 		return true
 	}
-	if c.Spec.BookkeeperVersion != c.Status.Metadata.BkVersion {
-		ctx.Logger().Info("Bookkeeper version changed",
-			"from", c.Status.Metadata.BkVersion, "to", c.Spec.BookkeeperVersion,
-		)
+	if !equality.Semantic.DeepDerivative(desired.Labels, sts.Labels) ||
+		!equality.Semantic.DeepDerivative(desired.Annotations, sts.Annotations) {
+		ctx.Logger().Info("Bookkeeper statefulset metadata changed",
+			"StatefulSet.Name", sts.GetName(),
+			"StatefulSet.Namespace", sts.GetNamespace())
 		return true
 	}
-	if !mapEqual(c.Spec.BkConfig, c.Status.Metadata.BkConfig) {
-		ctx.Logger().Info("Bookkeeper cluster config changed",
-			"from", c.Status.Metadata.BkConfig, "to", c.Spec.BkConfig,
-		)
+	if !equality.Semantic.DeepEqual(desired.Spec.UpdateStrategy, sts.Spec.UpdateStrategy) ||
+		templateChanged(desired, sts) {
+		ctx.Logger().Info("Bookkeeper pod template changed",
+			"StatefulSet.Name", sts.GetName(),
+			"StatefulSet.Namespace", sts.GetNamespace())
 		return true
 	}
 	return false
 }
 
-func updateStatefulset(ctx reconciler.Context, sts *v1.StatefulSet, cluster *v1alpha1.BookkeeperCluster) error {
-	sts.Spec.Replicas = cluster.Spec.Size
-	containers := sts.Spec.Template.Spec.Containers
-	for i, container := range containers {
-		if container.Name == bookieComponent {
-			container.Image = cluster.Image().ToString()
-			containers[i] = container
-		}
-	}
-	sts.Spec.Template.Spec.Containers = containers
+// updateStatefulset applies the desired state onto the live statefulset. The selector and
+// volumeClaimTemplates are immutable so the live ones are kept.
+func updateStatefulset(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster, sts, desired *v1.StatefulSet) error {
+	sts.Labels = mergeLabels(sts.Labels, desired.Labels)
+	sts.Annotations = mergeLabels(sts.Annotations, desired.Annotations)
+	sts.Spec.Replicas = desired.Spec.Replicas
+	sts.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+	sts.Spec.Template = desired.Spec.Template
 	ctx.Logger().Info("Updating the bookkeeper statefulset.",
 		"StatefulSet.Name", sts.GetName(),
 		"StatefulSet.Namespace", sts.GetNamespace(),
-		"NewReplicas", cluster.Spec.Size,
-		"NewVersion", cluster.Spec.BookkeeperVersion)
-	return ctx.Client().Update(context.TODO(), sts)
+		"NewReplicas", *desired.Spec.Replicas)
+	if err := ctx.Client().Update(context.TODO(), sts); err != nil {
+		recordWarning(ctx, cluster, EventStatefulSetFailed,
+			"Failed to update the statefulset %s: %s", sts.Name, err)
+		return err
+	}
+	recordEvent(ctx, cluster, EventStatefulSetUpdated,
+		"Updated the statefulset %s with %d replicas", sts.Name, *sts.Spec.Replicas)
+	return nil
 }
 
 func updateStatefulsetPVCs(ctx reconciler.Context, sts *v1.StatefulSet, cluster *v1alpha1.BookkeeperCluster) error {
@@ -122,6 +174,10 @@ func updateStatefulsetPVCs(ctx reconciler.Context, sts *v1.StatefulSet, cluster
 		// Keep the orphan PVC since the reclaimed policy said so
 		return nil
 	}
+	if cluster.Status.Decommission != nil {
+		// The PVCs of a decommissioned bookie are deleted once its ledgers are re-replicated
+		return nil
+	}
 	pvcList, err := pvc.ListAllWithMatchingLabels(ctx.Client(), sts.Namespace, sts.Spec.Template.Labels)
 	if err != nil {
 		return err
@@ -140,8 +196,11 @@ func updateStatefulsetPVCs(ctx reconciler.Context, sts *v1.StatefulSet, cluster
 				"PVC.Namespace", toDel.GetNamespace(), "PVC.Name", toDel.GetName())
 			err = ctx.Client().Delete(context.TODO(), toDel)
 			if err != nil {
+				recordWarning(ctx, cluster, EventPVCDeleteFailed,
+					"Failed to delete the idle pvc %s: %s", toDel.Name, err)
 				return fmt.Errorf("error on deleing the pvc (%s): %w", toDel.Name, err)
 			}
+			recordEvent(ctx, cluster, EventPVCDeleted, "Deleted the idle pvc %s", toDel.Name)
 		}
 	}
 	return nil
@@ -149,6 +208,20 @@ func updateStatefulsetPVCs(ctx reconciler.Context, sts *v1.StatefulSet, cluster
 
 func createStatefulSet(c *v1alpha1.BookkeeperCluster) *v1.StatefulSet {
 	labels := c.GenerateWorkloadLabels(bookieComponent)
+	// copied, the statefulset updates must not write through to the cluster spec
+	replicas, partition := *c.Spec.Size, *c.Spec.Size
+	template := v12.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: c.GetName(),
+			Labels: mergeLabels(labels,
+				c.Spec.PodConfig.Labels,
+			),
+			Annotations: mergeLabels(c.Spec.PodConfig.Annotations, map[string]string{
+				configHashAnnotation: configHash(createConfigmapData(c)),
+			}),
+		},
+		Spec: createBookiePodSpec(c),
+	}
 	return &v1.StatefulSet{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "StatefulSet",
@@ -161,28 +234,25 @@ func createStatefulSet(c *v1alpha1.BookkeeperCluster) *v1.StatefulSet {
 				k8s.LabelAppVersion: c.Spec.BookkeeperVersion,
 				"version":           c.Spec.BookkeeperVersion,
 			}),
-			Annotations: c.GenerateAnnotations(),
+			Annotations: mergeLabels(c.GenerateAnnotations(), map[string]string{
+				templateHashAnnotation: templateHash(&template),
+			}),
 		},
 		Spec: v1.StatefulSetSpec{
 			ServiceName: c.HeadlessServiceName(),
-			Replicas:    c.Spec.Size,
+			Replicas:    &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
+			// the rollout lowers the partition one bookie at a time
 			UpdateStrategy: v1.StatefulSetUpdateStrategy{
 				Type: v1.RollingUpdateStatefulSetStrategyType,
-			},
-			PodManagementPolicy: v1.OrderedReadyPodManagement,
-			Template: v12.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					GenerateName: c.GetName(),
-					Labels: mergeLabels(labels,
-						c.Spec.PodConfig.Labels,
-					),
-					Annotations: c.Spec.PodConfig.Annotations,
+				RollingUpdate: &v1.RollingUpdateStatefulSetStrategy{
+					Partition: &partition,
 				},
-				Spec: createBookiePodSpec(c),
 			},
+			PodManagementPolicy:  v1.OrderedReadyPodManagement,
+			Template:             template,
 			VolumeClaimTemplates: createPersistentVolumeClaims(c),
 		},
 	}
@@ -204,8 +274,8 @@ func createBookiePodSpec(c *v1alpha1.BookkeeperCluster) v12.PodSpec {
 		},
 	}
 	image := c.Image()
-	volumes := make([]v12.Volume, 0)
-	volumeMounts := createVolumeMounts(c.Spec.Directories)
+	volumes, zkMounts, initContainers := zkSecurityPodConfig(c)
+	volumeMounts := append(createVolumeMounts(c.Spec.Directories), zkMounts...)
 	container := v12.Container{
 		Name:      bookieComponent,
 		Image:     image.ToString(),
@@ -226,7 +296,7 @@ func createBookiePodSpec(c *v1alpha1.BookkeeperCluster) v12.PodSpec {
 		StartupProbe:    createStartupProbe(c.Spec),
 		ImagePullPolicy: image.PullPolicy,
 	}
-	return pod.NewSpec(c.Spec.PodConfig, volumes, nil, []v12.Container{container})
+	return pod.NewSpec(c.Spec.PodConfig, volumes, initContainers, []v12.Container{container})
 }
 
 func createVolumeMounts(directories *v1alpha1.Directories) []v12.VolumeMount {
@@ -0,0 +1,45 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/monimesl/bookkeeper-operator/internal"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// templateHashAnnotation is stamped on the workloads with the hash of the desired pod template they
+// were last applied with. The live template is defaulted by the apiserver so it can't be compared
+// with the desired one field by field; a removed field is detected by the hash changing. It is not
+// stamped on the template itself so the pods aren't rolled when it is first added.
+const templateHashAnnotation = internal.Domain + "/template-hash"
+
+// templateHash computes the content hash of the desired pod template
+func templateHash(template *v12.PodTemplateSpec) string {
+	// a pod template always marshals
+	data, _ := json.Marshal(template)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// templateChanged checks whether the desired pod template differs from the one the live workload was applied with
+func templateChanged(desired, live metav1.Object) bool {
+	return desired.GetAnnotations()[templateHashAnnotation] != live.GetAnnotations()[templateHashAnnotation]
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bookkeepercluster
+
+import (
+	"fmt"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	v12 "k8s.io/api/core/v1"
+)
+
+const (
+	zkAuthVolumeName     = "zookeeper-auth"
+	zkAuthMountPath      = "/etc/zookeeper/auth"
+	zkTLSVolumeName      = "zookeeper-tls"
+	zkTLSMountPath       = "/etc/zookeeper/tls"
+	zkKeyStoreVolumeName = "zookeeper-keystore"
+	zkKeyStoreMountPath  = "/etc/zookeeper/keystore"
+	zkKeyStoreFile       = "keystore.pem"
+)
+
+// zkSecurityPodConfig creates the volumes, the mounts and the init containers of the zookeeper
+// security files the bookie and the autorecovery containers connect to zookeeper with
+func zkSecurityPodConfig(c *v1alpha1.BookkeeperCluster) ([]v12.Volume, []v12.VolumeMount, []v12.Container) {
+	var volumes []v12.Volume
+	var mounts []v12.VolumeMount
+	var initContainers []v12.Container
+	if auth := c.Spec.ZkAuth(); auth != nil && auth.Scheme == v1alpha1.ZkAuthSchemeSASL {
+		volumes = append(volumes, secretVolume(zkAuthVolumeName, auth.SecretName,
+			v1alpha1.ZkAuthJaasConfigKey))
+		mounts = append(mounts, v12.VolumeMount{Name: zkAuthVolumeName, MountPath: zkAuthMountPath, ReadOnly: true})
+	} else if auth != nil {
+		// the bookies authenticate with the digest credentials of the operator
+		volumes = append(volumes, v12.Volume{
+			Name: zkAuthVolumeName,
+			VolumeSource: v12.VolumeSource{
+				EmptyDir: &v12.EmptyDirVolumeSource{Medium: v12.StorageMediumMemory},
+			},
+		})
+		authMount := v12.VolumeMount{Name: zkAuthVolumeName, MountPath: zkAuthMountPath}
+		mounts = append(mounts, authMount)
+		initContainers = append(initContainers, zkDigestJaasContainer(c, auth, authMount))
+	}
+	if zkTLS := c.Spec.ZkTLS(); zkTLS != nil {
+		keys := []string{v1alpha1.ZkTLSCAKey}
+		if zkTLS.ClientAuth {
+			keys = append(keys, v1alpha1.ZkTLSCertKey, v1alpha1.ZkTLSKeyKey)
+		}
+		volumes = append(volumes, secretVolume(zkTLSVolumeName, zkTLS.SecretName, keys...))
+		mounts = append(mounts, v12.VolumeMount{Name: zkTLSVolumeName, MountPath: zkTLSMountPath, ReadOnly: true})
+		if zkTLS.ClientAuth {
+			// the zookeeper PEM key store reads the private key and the certificate from a single file
+			volumes = append(volumes, v12.Volume{
+				Name: zkKeyStoreVolumeName,
+				VolumeSource: v12.VolumeSource{
+					EmptyDir: &v12.EmptyDirVolumeSource{Medium: v12.StorageMediumMemory},
+				},
+			})
+			keyStoreMount := v12.VolumeMount{Name: zkKeyStoreVolumeName, MountPath: zkKeyStoreMountPath}
+			mounts = append(mounts, keyStoreMount)
+			image := c.Image()
+			initContainers = append(initContainers, v12.Container{
+				Name:  zkKeyStoreVolumeName,
+				Image: image.ToString(),
+				Command: []string{"/bin/sh", "-c", fmt.Sprintf("cat %s/%s %s/%s > %s/%s",
+					zkTLSMountPath, v1alpha1.ZkTLSKeyKey, zkTLSMountPath, v1alpha1.ZkTLSCertKey,
+					zkKeyStoreMountPath, zkKeyStoreFile)},
+				VolumeMounts: []v12.VolumeMount{
+					{Name: zkTLSVolumeName, MountPath: zkTLSMountPath, ReadOnly: true},
+					keyStoreMount,
+				},
+				ImagePullPolicy: image.PullPolicy,
+			})
+		}
+	}
+	return volumes, mounts, initContainers
+}
+
+// zkDigestJaasContainer creates the init container writing the JAAS configuration of the
+// zookeeper client from the digest credentials of the Secret
+func zkDigestJaasContainer(c *v1alpha1.BookkeeperCluster, auth *v1alpha1.ZkAuth,
+	authMount v12.VolumeMount) v12.Container {
+	image := c.Image()
+	secretEnv := func(name, key string) v12.EnvVar {
+		return v12.EnvVar{
+			Name: name,
+			ValueFrom: &v12.EnvVarSource{
+				SecretKeyRef: &v12.SecretKeySelector{
+					LocalObjectReference: v12.LocalObjectReference{Name: auth.SecretName},
+					Key:                  key,
+				},
+			},
+		}
+	}
+	script := `escape() { printf '%s' "$1" | sed 's/[\\"]/\\&/g'; }
+cat > ` + zkAuthMountPath + "/" + v1alpha1.ZkAuthJaasConfigKey + ` <<EOF
+Client {
+  org.apache.zookeeper.server.auth.DigestLoginModule required
+  username="$(escape "$ZK_USERNAME")"
+  password="$(escape "$ZK_PASSWORD")";
+};
+EOF`
+	return v12.Container{
+		Name:    zkAuthVolumeName,
+		Image:   image.ToString(),
+		Command: []string{"/bin/sh", "-c", script},
+		Env: []v12.EnvVar{
+			secretEnv("ZK_USERNAME", v1alpha1.ZkAuthUsernameKey),
+			secretEnv("ZK_PASSWORD", v1alpha1.ZkAuthPasswordKey),
+		},
+		VolumeMounts:    []v12.VolumeMount{authMount},
+		ImagePullPolicy: image.PullPolicy,
+	}
+}
+
+// zkSecurityJVMOptions creates the system properties configuring the zookeeper client security
+func zkSecurityJVMOptions(c *v1alpha1.BookkeeperCluster) []string {
+	var options []string
+	if c.Spec.ZkAuth() != nil {
+		options = append(options, fmt.Sprintf("-Djava.security.auth.login.config=%s/%s",
+			zkAuthMountPath, v1alpha1.ZkAuthJaasConfigKey))
+	}
+	if zkTLS := c.Spec.ZkTLS(); zkTLS != nil {
+		options = append(options,
+			"-Dzookeeper.client.secure=true",
+			"-Dzookeeper.clientCnxnSocket=org.apache.zookeeper.ClientCnxnSocketNetty",
+			fmt.Sprintf("-Dzookeeper.ssl.trustStore.location=%s/%s", zkTLSMountPath, v1alpha1.ZkTLSCAKey),
+			"-Dzookeeper.ssl.trustStore.type=PEM")
+		if zkTLS.ClientAuth {
+			options = append(options,
+				fmt.Sprintf("-Dzookeeper.ssl.keyStore.location=%s/%s", zkKeyStoreMountPath, zkKeyStoreFile),
+				"-Dzookeeper.ssl.keyStore.type=PEM")
+		}
+	}
+	return options
+}
+
+// zkSecurityConfig creates the bookkeeper configuration of the zookeeper client
+// security, it overrides the one of the cluster BkConfig
+func zkSecurityConfig(c *v1alpha1.BookkeeperCluster) map[string]string {
+	data := map[string]string{}
+	if c.Spec.ZkSASLEnabled() {
+		// the bookies create their znodes with creator-only ACLs
+		data["BK_zkEnableSecurity"] = "true"
+	}
+	return data
+}
+
+func secretVolume(name, secretName string, keys ...string) v12.Volume {
+	items := make([]v12.KeyToPath, len(keys))
+	for i, key := range keys {
+		items[i] = v12.KeyToPath{Key: key, Path: key}
+	}
+	return v12.Volume{
+		Name: name,
+		VolumeSource: v12.VolumeSource{
+			Secret: &v12.SecretVolumeSource{SecretName: secretName, Items: items},
+		},
+	}
+}
@@ -18,56 +18,196 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
 	bookkeepercluster2 "github.com/monimesl/bookkeeper-operator/internal/controller/bookkeepercluster"
+	"github.com/monimesl/bookkeeper-operator/internal/metrics"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
 	"github.com/monimesl/operator-helper/reconciler"
 	v12 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	v13 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
+	"time"
 )
 
 var (
-	_              reconciler.Context    = &BookkeeperClusterReconciler{}
-	_              reconciler.Reconciler = &BookkeeperClusterReconciler{}
-	reconcileFuncs                       = []func(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error{
+	_              reconciler.Context                       = &BookkeeperClusterReconciler{}
+	_              reconciler.Reconciler                    = &BookkeeperClusterReconciler{}
+	_              bookkeepercluster2.EventRecorderProvider = &BookkeeperClusterReconciler{}
+	_              bookkeepercluster2.PodExecutorProvider   = &BookkeeperClusterReconciler{}
+	reconcileFuncs                                          = []func(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error{
 		bookkeepercluster2.ReconcilePodDisruptionBudget,
 		bookkeepercluster2.ReconcileConfigMap,
 		bookkeepercluster2.ReconcileServices,
+		bookkeepercluster2.ReconcileMetadataInit,
 		bookkeepercluster2.ReconcileStatefulSet,
 		bookkeepercluster2.ReconcileAutoRecovery,
+		bookkeepercluster2.ReconcileMonitoring,
+		bookkeepercluster2.ReconcileAlerts,
 		bookkeepercluster2.ReconcileClusterStatus,
-		bookkeepercluster2.ReconcileFinalizer,
 	}
 )
 
+// errStepRetried stops the steps after a transient zookeeper error, the cluster is requeued instead of failing
+var errStepRetried = errors.New("the reconcile step is retried")
+
 // BookkeeperClusterReconciler defines the reconciler to reconcile BookkeeperCluster resources
 type BookkeeperClusterReconciler struct {
 	reconciler.Context
+	// Recorder records the events of the cluster lifecycle
+	Recorder record.EventRecorder
+	// Executor runs the commands in the bookie pods, e.g. to get the journal disk usage
+	Executor bookkeepercluster2.PodExecutor
+}
+
+// EventRecorder returns the recorder of the cluster events
+func (r *BookkeeperClusterReconciler) EventRecorder() record.EventRecorder {
+	return r.Recorder
+}
+
+// PodExecutor returns the executor of the commands in the bookie pods
+func (r *BookkeeperClusterReconciler) PodExecutor() bookkeepercluster2.PodExecutor {
+	return r.Executor
 }
 
 // Configure configures the above BookkeeperClusterReconciler
 func (r *BookkeeperClusterReconciler) Configure(ctx reconciler.Context) error {
 	r.Context = ctx
 	return ctx.NewControllerBuilder().
-		For(&v1alpha1.BookkeeperCluster{}).
+		For(&v1alpha1.BookkeeperCluster{}, builder.WithPredicates(clusterChangedPredicate())).
 		Owns(&v13.PodDisruptionBudget{}).
 		Owns(&v12.StatefulSet{}).
 		Owns(&v12.Deployment{}).
+		Owns(&batchv1.Job{}).
 		Owns(&v1.ConfigMap{}).
 		Owns(&v1.Service{}).
+		// the bookies joining and leaving zookeeper
+		WatchesRawSource(&source.Channel{Source: zk.DefaultWatcher.Events()}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
 
+// clusterChangedPredicate filters out the cluster updates which only change its status. Every reconcile
+// updates the status, e.g. the bookies disk usage, and watching it would requeue the cluster right away
+// in a loop instead of after the refresh interval of ReconcileClusterStatus. The spec, label and annotation
+// changes are kept, so is the deletion which bumps the generation of the cluster.
+func clusterChangedPredicate() predicate.Predicate {
+	return predicate.Or(
+		predicate.GenerationChangedPredicate{},
+		predicate.LabelChangedPredicate{},
+		predicate.AnnotationChangedPredicate{})
+}
+
 // Reconcile handles reconciliation request for BookkeeperCluster instances
 func (r *BookkeeperClusterReconciler) Reconcile(_ context.Context, request reconcile.Request) (reconcile.Result, error) {
 	cluster := &v1alpha1.BookkeeperCluster{}
-	return r.Run(request, cluster, func(_ bool) (err error) {
+	requeueAfter := time.Duration(0)
+	result, err := r.Run(request, cluster, func(deleted bool) (err error) {
 		for _, fun := range reconcileFuncs {
-			if err = fun(r, cluster); err != nil {
+			if err = r.runStep(fun, cluster, &requeueAfter); err != nil {
 				break
 			}
 		}
+		// the finalizer runs even after a failed step, e.g. an unreachable zookeeper,
+		// else the cluster could never get its finalizer nor be deleted
+		if finalizerErr := r.runStep(bookkeepercluster2.ReconcileFinalizer, cluster, &requeueAfter); err == nil {
+			err = finalizerErr
+		}
+		if errors.Is(err, errStepRetried) {
+			err = nil
+		}
+		if err != nil {
+			bookkeepercluster2.RecordReconcileFailure(r, cluster, err)
+		}
+		if deleted {
+			metrics.DeleteCluster(cluster)
+		} else {
+			metrics.UpdateCluster(cluster)
+		}
+		r.setReconcileErrorCondition(cluster, err)
 		return
 	})
+	if err == nil && cluster.UID == "" {
+		// not found, the cluster is gone without its deletion being reconciled
+		gone := &v1alpha1.BookkeeperCluster{ObjectMeta: metav1.ObjectMeta{
+			Namespace: request.Namespace,
+			Name:      request.Name,
+		}}
+		zk.DefaultWatcher.Unwatch(gone)
+		metrics.DeleteCluster(gone)
+	}
+	if err == nil && requeueAfter > 0 {
+		return reconcile.Result{RequeueAfter: requeueAfter}, nil
+	}
+	return result, err
+}
+
+// runStep runs the reconcile function, it returns nil when the step only requeues the cluster,
+// i.e. it waits on the cluster or a transient zookeeper error, lowering requeueAfter to its delay
+func (r *BookkeeperClusterReconciler) runStep(fun func(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error,
+	cluster *v1alpha1.BookkeeperCluster, requeueAfter *time.Duration) error {
+	start := time.Now()
+	err := fun(r, cluster)
+	requeue := &bookkeepercluster2.RequeueError{}
+	requeued := errors.As(err, &requeue)
+	retry := &zk.RetryError{}
+	retried := !requeued && errors.As(err, &retry)
+	metrics.ObserveReconcileStep(stepName(fun), time.Since(start), err != nil && !requeued && !retried)
+	switch {
+	case retried:
+		r.Logger().Info("Retrying the cluster reconciliation",
+			"cluster", cluster.Name, "after", retry.After, "error", retry.Err.Error())
+		lowerRequeueAfter(requeueAfter, retry.After)
+		// the transient zookeeper error stops the steps like a failure without failing the reconciliation
+		return errStepRetried
+	case requeued:
+		// a step waiting on the cluster doesn't stop the others
+		r.Logger().Info("Requeueing the cluster reconciliation",
+			"cluster", cluster.Name, "after", requeue.After, "reason", requeue.Reason)
+		lowerRequeueAfter(requeueAfter, requeue.After)
+		return nil
+	}
+	return err
+}
+
+func lowerRequeueAfter(requeueAfter *time.Duration, after time.Duration) {
+	if after > 0 && (*requeueAfter == 0 || after < *requeueAfter) {
+		*requeueAfter = after
+	}
+}
+
+// stepName returns the name of the reconcile function, e.g. ReconcileStatefulSet
+func stepName(fun func(ctx reconciler.Context, cluster *v1alpha1.BookkeeperCluster) error) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fun).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// setReconcileErrorCondition reports the failure of the reconciliation in the ReconcileError condition
+func (r *BookkeeperClusterReconciler) setReconcileErrorCondition(cluster *v1alpha1.BookkeeperCluster, err error) {
+	if !cluster.DeletionTimestamp.IsZero() {
+		return
+	}
+	if err != nil {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterReconcileError, v1.ConditionTrue,
+			v1alpha1.ReasonReconcileFailed, err.Error(), cluster.Generation)
+	} else if cluster.Status.IsConditionTrue(v1alpha1.ConditionClusterReconcileError) {
+		cluster.Status.SetCondition(v1alpha1.ConditionClusterReconcileError, v1.ConditionFalse,
+			v1alpha1.ReasonReconcileSucceeded, "", cluster.Generation)
+	} else {
+		return
+	}
+	if updateErr := r.Client().Status().Update(context.TODO(), cluster); updateErr != nil {
+		r.Logger().Info("Error updating the cluster reconcile error condition",
+			"cluster", cluster.Name, "error", updateErr.Error())
+	}
 }
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package controller
+
+import (
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"testing"
+)
+
+func TestClusterChangedPredicate(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutate    func(c *v1alpha1.BookkeeperCluster)
+		reconcile bool
+	}{
+		{
+			name: "status only",
+			mutate: func(c *v1alpha1.BookkeeperCluster) {
+				c.Status.ReadyReplicas = 3
+				c.Status.Bookies = []v1alpha1.BookieStatus{{Pod: "bk-0", State: v1alpha1.BookieStateReadOnly}}
+				c.ResourceVersion = "2"
+			},
+		},
+		{
+			name:      "spec",
+			mutate:    func(c *v1alpha1.BookkeeperCluster) { c.Generation = 2 },
+			reconcile: true,
+		},
+		{
+			name:      "labels",
+			mutate:    func(c *v1alpha1.BookkeeperCluster) { c.Labels = map[string]string{"team": "storage"} },
+			reconcile: true,
+		},
+		{
+			name: "annotations",
+			mutate: func(c *v1alpha1.BookkeeperCluster) {
+				c.Annotations = map[string]string{v1alpha1.AnnotationAllowUnsafeUpdate: "true"}
+			},
+			reconcile: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &v1alpha1.BookkeeperCluster{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", Name: "bk", Generation: 1, ResourceVersion: "1",
+			}}
+			cluster := old.DeepCopy()
+			tt.mutate(cluster)
+			if got := clusterChangedPredicate().Update(event.UpdateEvent{ObjectOld: old, ObjectNew: cluster}); got != tt.reconcile {
+				t.Errorf("clusterChangedPredicate().Update() = %v, want %v", got, tt.reconcile)
+			}
+		})
+	}
+}
@@ -21,3 +21,7 @@ const OperatorName = "bookkeeper-operator"
 
 // Domain defines the domain of the operator
 const Domain = "bookkeeper.monime.sl"
+
+// Version is the version of the operator, set at build time with
+// -ldflags "-X github.com/monimesl/bookkeeper-operator/internal.Version=<version>"
+var Version = "dev"
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metrics exports the operator view of the managed clusters
+// through the metrics registry of the controller manager
+package metrics
+
+import (
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"time"
+)
+
+const namespace = "bookkeeper_operator"
+
+var (
+	clusterLabels = []string{"namespace", "cluster"}
+
+	desiredBookies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_desired_bookies",
+		Help:      "The number of bookies desired by the cluster spec.",
+	}, clusterLabels)
+	currentBookies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_current_bookies",
+		Help:      "The number of bookie pods of the cluster.",
+	}, clusterLabels)
+	readyBookies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_ready_bookies",
+		Help:      "The number of ready bookie pods of the cluster.",
+	}, clusterLabels)
+	bookiesByState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_bookies",
+		Help:      "The number of bookies of the cluster by their state in zookeeper.",
+	}, append(clusterLabels, "state"))
+	rolloutPhase = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_rollout_phase",
+		Help:      "The phase of the cluster bookies rollout, 1 for the current phase.",
+	}, append(clusterLabels, "phase"))
+	rolloutOrdinal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_rollout_ordinal",
+		Help:      "The ordinal of the last bookie rolled, the bookies below it are yet to roll.",
+	}, clusterLabels)
+	decommissionPhase = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_decommission_phase",
+		Help:      "The phase of the cluster bookie decommission, 1 for the current phase.",
+	}, append(clusterLabels, "phase"))
+
+	reconcileStepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_step_duration_seconds",
+		Help:      "The duration of the cluster reconcile steps.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"step"})
+	reconcileStepErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_step_errors_total",
+		Help:      "The number of the failed cluster reconcile steps.",
+	}, []string{"step"})
+
+	zkOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "zookeeper_operation_duration_seconds",
+		Help:      "The latency of the zookeeper operations made by the operator.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"operation"})
+	zkOperationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "zookeeper_operation_failures_total",
+		Help:      "The number of the failed zookeeper operations made by the operator.",
+	}, []string{"operation"})
+	zkConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zookeeper_connections",
+		Help:      "The number of the cached zookeeper connections of each ensemble by their session state.",
+	}, []string{"ensemble", "state"})
+
+	clusterCollectors = []*prometheus.GaugeVec{
+		desiredBookies, currentBookies, readyBookies, bookiesByState,
+		rolloutPhase, rolloutOrdinal, decommissionPhase,
+	}
+
+	rolloutPhases = []v1alpha1.RolloutPhase{
+		v1alpha1.RolloutPhaseRolling,
+		v1alpha1.RolloutPhaseStalled,
+		v1alpha1.RolloutPhaseCompleted,
+	}
+	decommissionPhases = []v1alpha1.DecommissionPhase{
+		v1alpha1.DecommissionPhaseReadOnly,
+		v1alpha1.DecommissionPhaseStopping,
+		v1alpha1.DecommissionPhaseDecommissioning,
+		v1alpha1.DecommissionPhaseRecovering,
+		v1alpha1.DecommissionPhaseCleaningUp,
+	}
+	bookieStates = []v1alpha1.BookieState{
+		v1alpha1.BookieStateWritable,
+		v1alpha1.BookieStateReadOnly,
+		v1alpha1.BookieStateUnavailable,
+	}
+)
+
+func init() {
+	for _, collector := range clusterCollectors {
+		metrics.Registry.MustRegister(collector)
+	}
+	metrics.Registry.MustRegister(reconcileStepDuration, reconcileStepErrors,
+		zkOperationDuration, zkOperationFailures, zkConnections)
+}
+
+// UpdateCluster exports the state of the cluster from its spec and status
+func UpdateCluster(cluster *v1alpha1.BookkeeperCluster) {
+	ns, name := cluster.Namespace, cluster.Name
+	desiredBookies.WithLabelValues(ns, name).Set(float64(*cluster.Spec.Size))
+	currentBookies.WithLabelValues(ns, name).Set(float64(len(cluster.Status.Bookies)))
+	readyBookies.WithLabelValues(ns, name).Set(float64(cluster.Status.ReadyReplicas))
+	for _, state := range bookieStates {
+		count := 0
+		for _, bookie := range cluster.Status.Bookies {
+			if bookie.State == state {
+				count++
+			}
+		}
+		bookiesByState.WithLabelValues(ns, name, string(state)).Set(float64(count))
+	}
+	rollout := cluster.Status.Rollout
+	for _, phase := range rolloutPhases {
+		rolloutPhase.WithLabelValues(ns, name, string(phase)).Set(boolValue(rollout != nil && rollout.Phase == phase))
+	}
+	if rollout != nil {
+		rolloutOrdinal.WithLabelValues(ns, name).Set(float64(rollout.Ordinal))
+	} else {
+		rolloutOrdinal.DeleteLabelValues(ns, name)
+	}
+	decommission := cluster.Status.Decommission
+	for _, phase := range decommissionPhases {
+		decommissionPhase.WithLabelValues(ns, name, string(phase)).
+			Set(boolValue(decommission != nil && decommission.Phase == phase))
+	}
+}
+
+// DeleteCluster removes the exported state of the deleted cluster
+func DeleteCluster(cluster *v1alpha1.BookkeeperCluster) {
+	labels := prometheus.Labels{"namespace": cluster.Namespace, "cluster": cluster.Name}
+	for _, collector := range clusterCollectors {
+		collector.DeletePartialMatch(labels)
+	}
+}
+
+// ObserveReconcileStep records the duration and the failure of a cluster reconcile step
+func ObserveReconcileStep(step string, duration time.Duration, failed bool) {
+	reconcileStepDuration.WithLabelValues(step).Observe(duration.Seconds())
+	if failed {
+		reconcileStepErrors.WithLabelValues(step).Inc()
+	}
+}
+
+// ObserveZkOperation records the latency and the failure of a zookeeper operation
+func ObserveZkOperation(operation string, duration time.Duration, failed bool) {
+	zkOperationDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if failed {
+		zkOperationFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+// SetZkConnections exports the number of the cached zookeeper connections of each ensemble by state
+func SetZkConnections(connections map[string]map[string]int) {
+	zkConnections.Reset()
+	for ensemble, states := range connections {
+		for state, count := range states {
+			zkConnections.WithLabelValues(ensemble, state).Set(float64(count))
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func newCluster(name string) *v1alpha1.BookkeeperCluster {
+	size := int32(3)
+	return &v1alpha1.BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1alpha1.BookkeeperClusterSpec{Size: &size},
+		Status: v1alpha1.BookkeeperClusterStatus{
+			ReadyReplicas: 2,
+			Bookies: []v1alpha1.BookieStatus{
+				{Ordinal: 0, State: v1alpha1.BookieStateWritable},
+				{Ordinal: 1, State: v1alpha1.BookieStateWritable},
+				{Ordinal: 2, State: v1alpha1.BookieStateReadOnly},
+			},
+			Rollout: &v1alpha1.Rollout{Phase: v1alpha1.RolloutPhaseRolling, Ordinal: 2},
+		},
+	}
+}
+
+func TestUpdateCluster(t *testing.T) {
+	cluster := newCluster("update")
+	defer DeleteCluster(cluster)
+	UpdateCluster(cluster)
+	for _, tc := range []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{"desired", testutil.ToFloat64(desiredBookies.WithLabelValues("default", "update")), 3},
+		{"current", testutil.ToFloat64(currentBookies.WithLabelValues("default", "update")), 3},
+		{"ready", testutil.ToFloat64(readyBookies.WithLabelValues("default", "update")), 2},
+		{"writable", testutil.ToFloat64(bookiesByState.WithLabelValues("default", "update",
+			string(v1alpha1.BookieStateWritable))), 2},
+		{"read-only", testutil.ToFloat64(bookiesByState.WithLabelValues("default", "update",
+			string(v1alpha1.BookieStateReadOnly))), 1},
+		{"unavailable", testutil.ToFloat64(bookiesByState.WithLabelValues("default", "update",
+			string(v1alpha1.BookieStateUnavailable))), 0},
+		{"rolling", testutil.ToFloat64(rolloutPhase.WithLabelValues("default", "update",
+			string(v1alpha1.RolloutPhaseRolling))), 1},
+		{"completed", testutil.ToFloat64(rolloutPhase.WithLabelValues("default", "update",
+			string(v1alpha1.RolloutPhaseCompleted))), 0},
+		{"rollout ordinal", testutil.ToFloat64(rolloutOrdinal.WithLabelValues("default", "update")), 2},
+	} {
+		if tc.value != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, tc.value)
+		}
+	}
+	cluster.Status.Rollout = nil
+	UpdateCluster(cluster)
+	if count := testutil.CollectAndCount(rolloutOrdinal); count != 0 {
+		t.Errorf("expected the rollout ordinal to be removed after the rollout, got %d series", count)
+	}
+}
+
+func TestDeleteCluster(t *testing.T) {
+	kept := newCluster("kept")
+	UpdateCluster(kept)
+	counts := make([]int, len(clusterCollectors))
+	for i, collector := range clusterCollectors {
+		counts[i] = testutil.CollectAndCount(collector)
+	}
+	deleted := newCluster("deleted")
+	UpdateCluster(deleted)
+	DeleteCluster(deleted)
+	for i, collector := range clusterCollectors {
+		if count := testutil.CollectAndCount(collector); count != counts[i] {
+			t.Errorf("expected the %d series of the kept cluster alone, got %d", counts[i], count)
+		}
+	}
+	DeleteCluster(kept)
+	for _, collector := range clusterCollectors {
+		if count := testutil.CollectAndCount(collector); count != 0 {
+			t.Errorf("expected no series after deleting the clusters, got %d", count)
+		}
+	}
+}
+
+func TestObserveReconcileStep(t *testing.T) {
+	ObserveReconcileStep("TestStep", time.Millisecond, false)
+	ObserveReconcileStep("TestStep", time.Millisecond, true)
+	if count := testutil.ToFloat64(reconcileStepErrors.WithLabelValues("TestStep")); count != 1 {
+		t.Errorf("expected one failed step, got %v", count)
+	}
+	if count := testutil.CollectAndCount(reconcileStepDuration); count != 1 {
+		t.Errorf("expected one step histogram, got %d", count)
+	}
+}
+
+func TestSetZkConnections(t *testing.T) {
+	SetZkConnections(map[string]map[string]int{"zk-a:2181": {"connected": 2, "expired": 1}})
+	if count := testutil.ToFloat64(zkConnections.WithLabelValues("zk-a:2181", "connected")); count != 2 {
+		t.Errorf("expected 2 connected connections, got %v", count)
+	}
+	SetZkConnections(map[string]map[string]int{"zk-b:2181": {"connected": 1}})
+	if count := testutil.CollectAndCount(zkConnections); count != 1 {
+		t.Errorf("expected the connections of the closed ensemble to be reset, got %d series", count)
+	}
+}
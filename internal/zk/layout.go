@@ -0,0 +1,105 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"strconv"
+	"strings"
+)
+
+const ledgerManagerFactorySuffix = "LedgerManagerFactory"
+
+// LedgersLayout is the format of the ledgers metadata of a cluster as written by bookkeeper
+type LedgersLayout struct {
+	// InstanceID is the unique id bookkeeper generates when the metadata is formatted
+	InstanceID string
+	// LayoutVersion is the format version of the LAYOUT znode
+	LayoutVersion int32
+	// LedgerManagerFactory is the class of the ledger manager factory, e.g.
+	// org.apache.bookkeeper.meta.HierarchicalLedgerManagerFactory
+	LedgerManagerFactory string
+	// LedgerManagerVersion is the version of the ledger manager
+	LedgerManagerVersion int32
+}
+
+// LedgerManagerType returns the type of the ledger manager as configured in
+// bookkeeper, e.g. "hierarchical" for the HierarchicalLedgerManagerFactory
+func (l *LedgersLayout) LedgerManagerType() string {
+	class := l.LedgerManagerFactory[strings.LastIndex(l.LedgerManagerFactory, ".")+1:]
+	if !strings.HasSuffix(class, ledgerManagerFactorySuffix) || class == ledgerManagerFactorySuffix {
+		return l.LedgerManagerFactory
+	}
+	return strings.ToLower(strings.TrimSuffix(class, ledgerManagerFactorySuffix))
+}
+
+// LedgersLayout reads the INSTANCEID and LAYOUT znodes of the ledgers root of the specified
+// cluster, it returns nil when the ledgers metadata is not formatted yet
+func (c *Client) LedgersLayout(cluster *v1alpha1.BookkeeperCluster) (*LedgersLayout, error) {
+	root := cluster.ZkLedgersRootPath()
+	instanceID, _, err := c.getNodeData(fmt.Sprintf("%s/%s", root, instanceIDNode))
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data, _, err := c.getNodeData(fmt.Sprintf("%s/%s", root, layoutNode))
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	layout, err := parseLayout(data)
+	if err != nil {
+		return nil, metadataError("error on parsing the ledgers layout of the cluster (%s): %w", cluster.Name, err)
+	}
+	layout.InstanceID = strings.TrimSpace(string(instanceID))
+	return layout, nil
+}
+
+// parseLayout parses the LAYOUT znode data which is the layout format version
+// and the ledger manager factory class with its version, on separate lines:
+//
+//	2
+//	org.apache.bookkeeper.meta.HierarchicalLedgerManagerFactory:1
+func parseLayout(data []byte) (*LedgersLayout, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("malformed layout %q", data)
+	}
+	layoutVersion, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed layout version %q: %w", lines[0], err)
+	}
+	manager := strings.TrimSpace(lines[1])
+	i := strings.LastIndex(manager, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("malformed ledger manager %q", manager)
+	}
+	managerVersion, err := strconv.ParseInt(manager[i+1:], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ledger manager version %q: %w", manager, err)
+	}
+	return &LedgersLayout{
+		LayoutVersion:        int32(layoutVersion),
+		LedgerManagerFactory: manager[:i],
+		LedgerManagerVersion: int32(managerVersion),
+	}, nil
+}
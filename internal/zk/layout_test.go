@@ -0,0 +1,80 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	layout, err := parseLayout([]byte("2\norg.apache.bookkeeper.meta.HierarchicalLedgerManagerFactory:1\n"))
+	if err != nil {
+		t.Fatalf("parseLayout: %v", err)
+	}
+	expected := LedgersLayout{
+		LayoutVersion:        2,
+		LedgerManagerFactory: "org.apache.bookkeeper.meta.HierarchicalLedgerManagerFactory",
+		LedgerManagerVersion: 1,
+	}
+	if *layout != expected {
+		t.Errorf("parseLayout() = %+v, want %+v", *layout, expected)
+	}
+	if layout, err = parseLayout([]byte(" 2 \r\n class:3 \r\n")); err != nil {
+		t.Fatalf("parseLayout with the spaces: %v", err)
+	} else if layout.LayoutVersion != 2 || layout.LedgerManagerFactory != "class" || layout.LedgerManagerVersion != 3 {
+		t.Errorf("unexpected layout with the spaces %+v", *layout)
+	}
+}
+
+func TestParseLayoutMalformed(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"2",
+		"2\n",
+		"two\nclass:1",
+		"2\nclass",
+		"2\n:1",
+		"2\nclass:",
+		"2\nclass:one",
+		"99999999999\nclass:1",
+	} {
+		if layout, err := parseLayout([]byte(data)); err == nil {
+			t.Errorf("parseLayout(%q) = %+v, want an error", data, *layout)
+		}
+	}
+}
+
+func TestLedgerManagerType(t *testing.T) {
+	tests := []struct {
+		factory string
+		want    string
+	}{
+		{"org.apache.bookkeeper.meta.HierarchicalLedgerManagerFactory", "hierarchical"},
+		{"org.apache.bookkeeper.meta.LongHierarchicalLedgerManagerFactory", "longhierarchical"},
+		{"org.apache.bookkeeper.meta.FlatLedgerManagerFactory", "flat"},
+		{"HierarchicalLedgerManagerFactory", "hierarchical"},
+		{"com.example.CustomManager", "com.example.CustomManager"},
+		{"org.apache.bookkeeper.meta.LedgerManagerFactory", "org.apache.bookkeeper.meta.LedgerManagerFactory"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		layout := &LedgersLayout{LedgerManagerFactory: tt.factory}
+		if got := layout.LedgerManagerType(); got != tt.want {
+			t.Errorf("LedgerManagerType(%q) = %q, want %q", tt.factory, got, tt.want)
+		}
+	}
+}
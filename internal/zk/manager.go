@@ -0,0 +1,396 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/metrics"
+	"github.com/monimesl/operator-helper/config"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultIdleTimeout is how long an unused connection is kept open
+const defaultIdleTimeout = 5 * time.Minute
+
+// DefaultManager is the connection manager the reconcilers get their zookeeper clients from
+var DefaultManager = NewManager(defaultIdleTimeout)
+
+// Manager caches one zookeeper connection per ensemble, session settings and credentials so the
+// sessions are reused across the reconciles. The expired connections are redialed and the idle ones
+// closed. The connection states are exported as metrics rather than as a readiness check, one
+// unreachable ensemble must not make the operator, and so its webhooks, unavailable. It is run by
+// the controller manager which closes all the connections on shutdown.
+type Manager struct {
+	idleTimeout time.Duration
+	// reader reads the Secrets of the zookeeper credentials
+	reader      client.Reader
+	mu          sync.Mutex
+	connections map[string]*connection
+	// dialing holds the dial in flight of each connection key
+	dialing map[string]*dialCall
+	// backoffs holds the transient failures of each connection key, the failed dials included
+	backoffs map[string]*backoff
+	closed   bool
+}
+
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+type connection struct {
+	conn *zk.Conn
+	// ensemble is the sorted servers of the connection, the connection key without the credentials
+	ensemble string
+	// authenticated is true when the session is authenticated with the digest credentials
+	authenticated bool
+	state         zk.State
+	expired       bool
+	// retired is true once the expired connection is replaced, it is closed when its last borrower releases it
+	retired  bool
+	refs     int
+	lastUsed time.Time
+}
+
+// NewManager creates a connection manager closing the connections unused for the idle timeout
+func NewManager(idleTimeout time.Duration) *Manager {
+	return &Manager{
+		idleTimeout: idleTimeout,
+		connections: map[string]*connection{},
+		dialing:     map[string]*dialCall{},
+		backoffs:    map[string]*backoff{},
+	}
+}
+
+// SetReader sets the reader the Secrets of the zookeeper credentials are read with
+func (m *Manager) SetReader(reader client.Reader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reader = reader
+}
+
+// Client returns a client of the specified cluster over the cached connection of its ensemble,
+// dialing it when there is none. The client must be closed to release the connection.
+func (m *Manager) Client(cluster *v1alpha1.BookkeeperCluster) (*Client, error) {
+	_, chroot := cluster.Spec.ZkEndpoints()
+	digest, err := m.digest(cluster)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, tlsFingerprint, err := m.tlsConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	key := connectionKey(cluster, digest, tlsFingerprint)
+	backoff := m.backoff(key)
+	conn, err := m.connection(key, func() (*connection, error) {
+		c, events, err := dial(cluster, digest, tlsConfig, backoff)
+		if err != nil {
+			return nil, err
+		}
+		conn := &connection{
+			conn:          c,
+			ensemble:      ensemble(cluster),
+			authenticated: digest != nil,
+			state:         zk.StateHasSession,
+		}
+		go m.watch(conn, events)
+		return conn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return &Client{
+		conn:          conn.conn,
+		chroot:        chroot,
+		retries:       int(cluster.Spec.ZkRetries()),
+		backoff:       backoff,
+		authenticated: conn.authenticated,
+		release:       func() { once.Do(func() { m.release(conn) }) },
+	}, nil
+}
+
+// backoff returns the transient failures counter of the connection key
+func (m *Manager) backoff(key string) *backoff {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.backoffs[key]
+	if !ok {
+		b = &backoff{}
+		m.backoffs[key] = b
+	}
+	return b
+}
+
+// connection borrows the cached connection of the key, dialing it when there is none. The dial
+// is made without holding the lock so an unreachable ensemble doesn't block the other ones, the
+// concurrent borrowers of the same key wait for the single dial in flight.
+func (m *Manager) connection(key string, dial func() (*connection, error)) (*connection, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, zk.ErrClosing
+		}
+		conn, ok := m.connections[key]
+		if ok && conn.expired {
+			// the borrowers, e.g. a bookie registrations watch, keep the expired connection until they release it
+			config.RequireRootLogger().Info("Redialing the expired zookeeper connection", "ensemble", conn.ensemble)
+			conn.retired = true
+			if conn.refs == 0 {
+				conn.conn.Close()
+			}
+			delete(m.connections, key)
+			ok = false
+		}
+		if ok {
+			conn.refs++
+			conn.lastUsed = time.Now()
+			m.mu.Unlock()
+			return conn, nil
+		}
+		if call, dialing := m.dialing[key]; dialing {
+			m.mu.Unlock()
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			continue
+		}
+		call := &dialCall{done: make(chan struct{})}
+		m.dialing[key] = call
+		m.mu.Unlock()
+		conn, err := dial()
+		m.mu.Lock()
+		delete(m.dialing, key)
+		call.err = err
+		close(call.done)
+		if err == nil && m.closed {
+			conn.conn.Close()
+			err = zk.ErrClosing
+		}
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		conn.refs++
+		conn.lastUsed = time.Now()
+		m.connections[key] = conn
+		m.updateMetrics()
+		m.mu.Unlock()
+		return conn, nil
+	}
+}
+
+// Start closes the idle connections periodically until the context is done, then closes all of them
+func (m *Manager) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.closeAll()
+			return nil
+		case <-ticker.C:
+			m.closeIdle()
+		}
+	}
+}
+
+// NeedLeaderElection allows the connections to be closed on the shutdown of a non-leader operator
+func (m *Manager) NeedLeaderElection() bool {
+	return false
+}
+
+// watch tracks the state of the connection from its events until it is closed
+func (m *Manager) watch(conn *connection, events <-chan zk.Event) {
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+		m.mu.Lock()
+		conn.state = event.State
+		if event.State == zk.StateExpired {
+			conn.expired = true
+		} else if event.State == zk.StateHasSession {
+			conn.expired = false
+		}
+		m.updateMetrics()
+		m.mu.Unlock()
+	}
+}
+
+func (m *Manager) release(conn *connection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn.refs--
+	conn.lastUsed = time.Now()
+	if conn.retired && conn.refs == 0 {
+		conn.conn.Close()
+	}
+}
+
+func (m *Manager) closeIdle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, conn := range m.connections {
+		if conn.refs == 0 && time.Since(conn.lastUsed) >= m.idleTimeout {
+			config.RequireRootLogger().Info("Closing the idle zookeeper connection", "ensemble", conn.ensemble)
+			conn.conn.Close()
+			delete(m.connections, key)
+		}
+	}
+	for key := range m.backoffs {
+		if _, ok := m.connections[key]; !ok && m.dialing[key] == nil {
+			delete(m.backoffs, key)
+		}
+	}
+	m.updateMetrics()
+}
+
+func (m *Manager) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for key, conn := range m.connections {
+		config.RequireRootLogger().Info("Closing the zookeeper connection", "ensemble", conn.ensemble)
+		conn.conn.Close()
+		delete(m.connections, key)
+	}
+	m.updateMetrics()
+}
+
+// updateMetrics exports the number of the cached connections of each ensemble by state
+func (m *Manager) updateMetrics() {
+	connections := map[string]map[string]int{}
+	for _, conn := range m.connections {
+		if connections[conn.ensemble] == nil {
+			connections[conn.ensemble] = map[string]int{}
+		}
+		connections[conn.ensemble][conn.state.String()]++
+	}
+	metrics.SetZkConnections(connections)
+}
+
+// digest reads the "username:password" digest credentials of the cluster, nil when it has none
+func (m *Manager) digest(cluster *v1alpha1.BookkeeperCluster) ([]byte, error) {
+	auth := cluster.Spec.ZkAuth()
+	if auth == nil {
+		return nil, nil
+	}
+	secret, err := m.secret(cluster, auth.SecretName)
+	if err != nil {
+		return nil, err
+	}
+	username := secret.Data[v1alpha1.ZkAuthUsernameKey]
+	password := secret.Data[v1alpha1.ZkAuthPasswordKey]
+	if len(username) == 0 || len(password) == 0 {
+		if auth.Scheme == v1alpha1.ZkAuthSchemeSASL {
+			// the bookies alone authenticate
+			return nil, nil
+		}
+		return nil, fmt.Errorf("the zookeeper credentials secret (%s) has no %q and %q keys",
+			auth.SecretName, v1alpha1.ZkAuthUsernameKey, v1alpha1.ZkAuthPasswordKey)
+	}
+	return []byte(fmt.Sprintf("%s:%s", username, password)), nil
+}
+
+// tlsConfig creates the TLS configuration of the cluster connection from its certificates secret,
+// nil when the connection is in plain text. It returns the fingerprint of the certificates too.
+func (m *Manager) tlsConfig(cluster *v1alpha1.BookkeeperCluster) (*tls.Config, []byte, error) {
+	zkTLS := cluster.Spec.ZkTLS()
+	if zkTLS == nil {
+		return nil, nil, nil
+	}
+	secret, err := m.secret(cluster, zkTLS.SecretName)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[v1alpha1.ZkTLSCAKey]) {
+		return nil, nil, fmt.Errorf("the zookeeper TLS secret (%s) has no valid %q certificate",
+			zkTLS.SecretName, v1alpha1.ZkTLSCAKey)
+	}
+	tlsCfg := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	fingerprint := sha256.New()
+	fingerprint.Write(secret.Data[v1alpha1.ZkTLSCAKey])
+	if zkTLS.ClientAuth {
+		cert, err := tls.X509KeyPair(secret.Data[v1alpha1.ZkTLSCertKey], secret.Data[v1alpha1.ZkTLSKeyKey])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error on loading the client certificate of the zookeeper TLS secret (%s): %w",
+				zkTLS.SecretName, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+		fingerprint.Write(secret.Data[v1alpha1.ZkTLSCertKey])
+		fingerprint.Write(secret.Data[v1alpha1.ZkTLSKeyKey])
+	}
+	return tlsCfg, fingerprint.Sum(nil), nil
+}
+
+func (m *Manager) secret(cluster *v1alpha1.BookkeeperCluster, name string) (*v1.Secret, error) {
+	if m.reader == nil {
+		return nil, fmt.Errorf("no reader is set to read the zookeeper secret (%s)", name)
+	}
+	secret := &v1.Secret{}
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: name}
+	if err := m.reader.Get(context.TODO(), key, secret); err != nil {
+		return nil, fmt.Errorf("error on getting the zookeeper secret (%s): %w", name, err)
+	}
+	return secret, nil
+}
+
+// connectionKey identifies the connection of the cluster by its ensemble, by the session settings
+// and by the credentials the connection is authenticated with, so the rotated ones are redialed
+func connectionKey(cluster *v1alpha1.BookkeeperCluster, digest, tlsFingerprint []byte) string {
+	key := fmt.Sprintf("%s;session=%s;connection=%s", ensemble(cluster),
+		cluster.Spec.ZkSessionTimeout(), cluster.Spec.ZkConnectionTimeout())
+	if auth := cluster.Spec.ZkAuth(); auth != nil {
+		key = fmt.Sprintf("%s;auth=%s/%s#%s", key, cluster.Namespace, auth.SecretName, fingerprint(digest))
+	}
+	if zkTLS := cluster.Spec.ZkTLS(); zkTLS != nil {
+		key = fmt.Sprintf("%s;tls=%s/%s#%s", key, cluster.Namespace, zkTLS.SecretName, fingerprint(tlsFingerprint))
+	}
+	return key
+}
+
+// ensemble returns the servers of the cluster ensemble regardless of their order
+func ensemble(cluster *v1alpha1.BookkeeperCluster) string {
+	servers, _ := cluster.Spec.ZkEndpoints()
+	sorted := append([]string(nil), servers...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// fingerprint returns a short hash of the credentials, never the credentials themselves
+func fingerprint(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
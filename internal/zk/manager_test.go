@@ -0,0 +1,67 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/operator-helper/config"
+	"testing"
+	"time"
+)
+
+// newTestConnection creates a connection to an unreachable server, the client dials it in the background
+func newTestConnection(t *testing.T) *connection {
+	c, _, err := zk.Connect([]string{"127.0.0.1:1"}, time.Second, zk.WithLogInfo(false))
+	if err != nil {
+		t.Fatalf("zk.Connect: %v", err)
+	}
+	return &connection{conn: c, ensemble: "127.0.0.1:1", state: zk.StateHasSession}
+}
+
+func TestManagerRedialsExpiredBorrowedConnection(t *testing.T) {
+	config.GetLogger("test")
+	m := NewManager(time.Minute)
+	defer m.closeAll()
+	dials := 0
+	dial := func() (*connection, error) {
+		dials++
+		return newTestConnection(t), nil
+	}
+	expired, err := m.connection("key", dial)
+	if err != nil {
+		t.Fatalf("connection: %v", err)
+	}
+	// borrowed, e.g. by a watch, when the session expires
+	expired.expired = true
+	redialed, err := m.connection("key", dial)
+	if err != nil {
+		t.Fatalf("connection: %v", err)
+	}
+	if dials != 2 || redialed == expired {
+		t.Fatalf("the expired connection is not redialed, %d dials", dials)
+	}
+	if !expired.retired || redialed.retired {
+		t.Errorf("the expired connection is not retired")
+	}
+	m.release(expired)
+	if expired.refs != 0 {
+		t.Errorf("the retired connection has %d refs", expired.refs)
+	}
+	if again, _ := m.connection("key", dial); again != redialed || dials != 2 {
+		t.Errorf("the redialed connection is not reused")
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/operator-helper/config"
+	"time"
+)
+
+const (
+	// OperatorMetadataSchemaVersion is the version of the operator metadata document format
+	OperatorMetadataSchemaVersion = 1
+	// maxMetadataWriteAttempts bounds the compare-and-set attempts lost to the concurrent writers
+	maxMetadataWriteAttempts = 5
+)
+
+// The actions the operator metadata is last written on
+const (
+	ActionCreate          = "Create"
+	ActionMigrate         = "Migrate"
+	ActionScale           = "Scale"
+	ActionUpgrade         = "Upgrade"
+	ActionReconfigure     = "Reconfigure"
+	ActionRollout         = "Rollout"
+	ActionOperatorUpgrade = "OperatorUpgrade"
+)
+
+// OperatorMetadata is the intent of the operator for a cluster. It is stored as a
+// JSON document in the operator znode of the cluster root for the other tooling to read.
+type OperatorMetadata struct {
+	// SchemaVersion is the version of the document format
+	SchemaVersion int `json:"schemaVersion"`
+	// Size is the number of bookies of the cluster spec
+	Size int32 `json:"size"`
+	// BookkeeperVersion is the bookkeeper version of the cluster spec
+	BookkeeperVersion string `json:"bookkeeperVersion"`
+	// ConfigHash is the content hash of the configuration the bookies are rolled to
+	ConfigHash string `json:"configHash,omitempty"`
+	// OperatorVersion is the version of the operator writing the document
+	OperatorVersion string `json:"operatorVersion"`
+	// Rollout is the state of the bookies rolling update, nil when none was started
+	Rollout *OperatorMetadataRollout `json:"rollout,omitempty"`
+	// LastAction is the change of the intent the document is last written on
+	LastAction string `json:"lastAction"`
+	// UpdatedAt is the time of the last write in milliseconds since the epoch
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+// OperatorMetadataRollout is the state of the bookies rolling update in the operator metadata
+type OperatorMetadataRollout struct {
+	Phase    string `json:"phase"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// UpdateOperatorMetadata writes the operator metadata of the specified cluster when its intent changed.
+// The write is a compare-and-set on the znode version, it is retried on the concurrent writes. The
+// legacy size and updatedat znodes are deleted once migrated. It returns the action written on, or an
+// empty string when the intent is unchanged.
+func (c *Client) UpdateOperatorMetadata(cluster *v1alpha1.BookkeeperCluster, desired OperatorMetadata) (string, error) {
+	path := operatorMetadataZNode(cluster)
+	for attempt := 0; attempt < maxMetadataWriteAttempts; attempt++ {
+		current, stat, err := c.readOperatorMetadata(cluster)
+		if err != nil {
+			return "", err
+		}
+		if current != nil && current.SchemaVersion > OperatorMetadataSchemaVersion {
+			return "", metadataError("the operator metadata (%s) schema version %d is newer than the supported %d",
+				path, current.SchemaVersion, OperatorMetadataSchemaVersion)
+		}
+		if current != nil && current.sameIntent(&desired) {
+			return "", nil
+		}
+		legacy, err := c.hasLegacyMetadata(cluster)
+		if err != nil {
+			return "", err
+		}
+		metadata := desired
+		metadata.SchemaVersion = OperatorMetadataSchemaVersion
+		metadata.LastAction = metadata.actionFrom(current, legacy)
+		metadata.UpdatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return "", err
+		}
+		config.RequireRootLogger().Info("Writing the operator metadata",
+			"path", path, "data", string(data))
+		if stat == nil {
+			err = c.createOperatorMetadata(cluster, data)
+		} else {
+			err = c.retry("set", func() error {
+				_, err := c.conn.Set(c.chrooted(path), data, stat.Version)
+				return err
+			})
+		}
+		if errors.Is(err, zk.ErrNodeExists) || errors.Is(err, zk.ErrBadVersion) {
+			// written by another writer meanwhile, compare with its write
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if legacy {
+			if err = c.deleteNodes(clusterSizeNode(cluster), clusterUpdateTimeNode(cluster)); err != nil {
+				return "", err
+			}
+		}
+		return metadata.LastAction, nil
+	}
+	return "", metadataError("the operator metadata (%s) is concurrently written, gave up after %d attempts",
+		path, maxMetadataWriteAttempts)
+}
+
+func (c *Client) readOperatorMetadata(cluster *v1alpha1.BookkeeperCluster) (*OperatorMetadata, *zk.Stat, error) {
+	path := operatorMetadataZNode(cluster)
+	data, stat, err := c.getNodeData(path)
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	metadata := &OperatorMetadata{}
+	if err = json.Unmarshal(data, metadata); err != nil {
+		return nil, nil, metadataError("error on parsing the operator metadata (%s): %w", path, err)
+	}
+	return metadata, stat, nil
+}
+
+// createOperatorMetadata creates the operator metadata znode, failing with
+// zk.ErrNodeExists when it is created by another writer meanwhile
+func (c *Client) createOperatorMetadata(cluster *v1alpha1.BookkeeperCluster, data []byte) error {
+	if err := c.createPath(clusterNode(cluster)); err != nil {
+		return err
+	}
+	return c.retry("create", func() error {
+		_, err := c.conn.Create(c.chrooted(operatorMetadataZNode(cluster)), data, 0, c.readableACL())
+		return err
+	})
+}
+
+func (c *Client) hasLegacyMetadata(cluster *v1alpha1.BookkeeperCluster) (bool, error) {
+	for _, path := range []string{clusterSizeNode(cluster), clusterUpdateTimeNode(cluster)} {
+		_, err := c.getNodeState(path)
+		if err == nil {
+			return true, nil
+		} else if !errors.Is(err, zk.ErrNoNode) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// sameIntent checks whether the metadata has the same intent as the other, regardless of when
+// and on which action they were written
+func (m *OperatorMetadata) sameIntent(other *OperatorMetadata) bool {
+	return m.Size == other.Size &&
+		m.BookkeeperVersion == other.BookkeeperVersion &&
+		m.ConfigHash == other.ConfigHash &&
+		m.OperatorVersion == other.OperatorVersion &&
+		m.sameRollout(other)
+}
+
+func (m *OperatorMetadata) sameRollout(other *OperatorMetadata) bool {
+	if m.Rollout == nil || other.Rollout == nil {
+		return m.Rollout == other.Rollout
+	}
+	return *m.Rollout == *other.Rollout
+}
+
+// actionFrom returns the action changing the previous metadata to this one
+func (m *OperatorMetadata) actionFrom(previous *OperatorMetadata, legacy bool) string {
+	switch {
+	case previous == nil && legacy:
+		return ActionMigrate
+	case previous == nil:
+		return ActionCreate
+	case m.Size != previous.Size:
+		return ActionScale
+	case m.BookkeeperVersion != previous.BookkeeperVersion:
+		return ActionUpgrade
+	case m.ConfigHash != previous.ConfigHash:
+		return ActionReconfigure
+	case !m.sameRollout(previous):
+		return ActionRollout
+	default:
+		return ActionOperatorUpgrade
+	}
+}
+
+func operatorMetadataZNode(cluster *v1alpha1.BookkeeperCluster) string {
+	return fmt.Sprintf("%s/%s", clusterNode(cluster), operatorMetadataNode)
+}
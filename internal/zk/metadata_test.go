@@ -0,0 +1,133 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"testing"
+)
+
+func newOperatorMetadata() *OperatorMetadata {
+	return &OperatorMetadata{
+		SchemaVersion:     OperatorMetadataSchemaVersion,
+		Size:              3,
+		BookkeeperVersion: "4.16.3",
+		ConfigHash:        "abc",
+		OperatorVersion:   "v0.2.0",
+		Rollout:           &OperatorMetadataRollout{Phase: "Completed", Revision: "r1"},
+		LastAction:        ActionCreate,
+		UpdatedAt:         1,
+	}
+}
+
+func TestSameIntent(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(m *OperatorMetadata)
+		same   bool
+	}{
+		{"same", func(m *OperatorMetadata) {}, true},
+		{"written later on another action", func(m *OperatorMetadata) { m.UpdatedAt = 2; m.LastAction = ActionScale }, true},
+		{"other schema version", func(m *OperatorMetadata) { m.SchemaVersion = 0 }, true},
+		{"size", func(m *OperatorMetadata) { m.Size = 5 }, false},
+		{"bookkeeper version", func(m *OperatorMetadata) { m.BookkeeperVersion = "4.17.0" }, false},
+		{"config hash", func(m *OperatorMetadata) { m.ConfigHash = "def" }, false},
+		{"operator version", func(m *OperatorMetadata) { m.OperatorVersion = "v0.3.0" }, false},
+		{"rollout phase", func(m *OperatorMetadata) { m.Rollout.Phase = "Rolling" }, false},
+		{"rollout revision", func(m *OperatorMetadata) { m.Rollout.Revision = "r2" }, false},
+		{"no rollout", func(m *OperatorMetadata) { m.Rollout = nil }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := newOperatorMetadata()
+			tt.mutate(other)
+			if got := newOperatorMetadata().sameIntent(other); got != tt.same {
+				t.Errorf("sameIntent() = %v, want %v", got, tt.same)
+			}
+			if got := other.sameIntent(newOperatorMetadata()); got != tt.same {
+				t.Errorf("reversed sameIntent() = %v, want %v", got, tt.same)
+			}
+		})
+	}
+	if noRollout := (&OperatorMetadata{}); !noRollout.sameIntent(&OperatorMetadata{}) {
+		t.Errorf("the metadata without a rollout should have the same intent")
+	}
+}
+
+func TestActionFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous *OperatorMetadata
+		legacy   bool
+		mutate   func(m *OperatorMetadata)
+		action   string
+	}{
+		{name: "create", action: ActionCreate, mutate: func(m *OperatorMetadata) {}},
+		{name: "migrate", legacy: true, action: ActionMigrate, mutate: func(m *OperatorMetadata) {}},
+		{
+			name:     "scale",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.Size = 5 },
+			action:   ActionScale,
+		},
+		{
+			name:     "scale with an upgrade",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.Size = 5; m.BookkeeperVersion = "4.17.0" },
+			action:   ActionScale,
+		},
+		{
+			name:     "upgrade",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.BookkeeperVersion = "4.17.0"; m.ConfigHash = "def" },
+			action:   ActionUpgrade,
+		},
+		{
+			name:     "reconfigure",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.ConfigHash = "def" },
+			action:   ActionReconfigure,
+		},
+		{
+			name:     "rollout",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.Rollout = &OperatorMetadataRollout{Phase: "Rolling", Revision: "r2"} },
+			action:   ActionRollout,
+		},
+		{
+			name:     "operator upgrade",
+			previous: newOperatorMetadata(),
+			mutate:   func(m *OperatorMetadata) { m.OperatorVersion = "v0.3.0" },
+			action:   ActionOperatorUpgrade,
+		},
+		{
+			name:     "previous over the legacy metadata",
+			previous: newOperatorMetadata(),
+			legacy:   true,
+			mutate:   func(m *OperatorMetadata) { m.Size = 5 },
+			action:   ActionScale,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := newOperatorMetadata()
+			tt.mutate(metadata)
+			if got := metadata.actionFrom(tt.previous, tt.legacy); got != tt.action {
+				t.Errorf("actionFrom() = %q, want %q", got, tt.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"crypto/tls"
+	"github.com/go-zookeeper/zk"
+	"net"
+	"sync"
+	"time"
+)
+
+// tlsDialer creates a dialer connecting to the zookeeper servers over TLS
+func tlsDialer(config *tls.Config) zk.Dialer {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		cfg := config.Clone()
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ServerName = host
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, cfg)
+	}
+}
+
+// hostProvider iterates over the servers without resolving them, unlike the default
+// provider which dials their IP addresses the server certificates are not issued for
+type hostProvider struct {
+	mu        sync.Mutex
+	servers   []string
+	current   int
+	lastTried int
+}
+
+// Init is called with the servers of the connection string
+func (hp *hostProvider) Init(servers []string) error {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.servers = append([]string(nil), servers...)
+	hp.current = -1
+	hp.lastTried = -1
+	return nil
+}
+
+// Len returns the number of servers
+func (hp *hostProvider) Len() int {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return len(hp.servers)
+}
+
+// Next returns the next server to connect to, retryStart is true once all the servers are tried
+func (hp *hostProvider) Next() (server string, retryStart bool) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.current = (hp.current + 1) % len(hp.servers)
+	retryStart = hp.current == hp.lastTried
+	if hp.lastTried == -1 {
+		hp.lastTried = hp.current
+	}
+	return hp.servers[hp.current], retryStart
+}
+
+// Connected notifies the provider of a successful connection to the current server
+func (hp *hostProvider) Connected() {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.lastTried = hp.current
+}
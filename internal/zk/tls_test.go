@@ -0,0 +1,93 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"testing"
+)
+
+type hostAttempt struct {
+	server     string
+	retryStart bool
+}
+
+func nextHosts(hp *hostProvider, n int) []hostAttempt {
+	attempts := make([]hostAttempt, n)
+	for i := range attempts {
+		attempts[i].server, attempts[i].retryStart = hp.Next()
+	}
+	return attempts
+}
+
+func assertHostAttempts(t *testing.T, got, want []hostAttempt) {
+	if len(got) != len(want) {
+		t.Fatalf("expected %d attempts, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("attempt %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHostProviderRetryStart(t *testing.T) {
+	hp := &hostProvider{}
+	if err := hp.Init([]string{"zk-0:2281", "zk-1:2281", "zk-2:2281"}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if hp.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", hp.Len())
+	}
+	// the retry starts when the servers wrap around to the first one tried
+	assertHostAttempts(t, nextHosts(hp, 7), []hostAttempt{
+		{"zk-0:2281", false},
+		{"zk-1:2281", false},
+		{"zk-2:2281", false},
+		{"zk-0:2281", true},
+		{"zk-1:2281", false},
+		{"zk-2:2281", false},
+		{"zk-0:2281", true},
+	})
+}
+
+func TestHostProviderRetryStartAfterConnected(t *testing.T) {
+	hp := &hostProvider{}
+	if err := hp.Init([]string{"zk-0:2281", "zk-1:2281", "zk-2:2281"}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	nextHosts(hp, 2)
+	hp.Connected()
+	// once disconnected from zk-1, the retry starts when it is tried again
+	assertHostAttempts(t, nextHosts(hp, 4), []hostAttempt{
+		{"zk-2:2281", false},
+		{"zk-0:2281", false},
+		{"zk-1:2281", true},
+		{"zk-2:2281", false},
+	})
+}
+
+func TestHostProviderSingleServer(t *testing.T) {
+	hp := &hostProvider{}
+	if err := hp.Init([]string{"zk:2281"}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	assertHostAttempts(t, nextHosts(hp, 3), []hostAttempt{
+		{"zk:2281", false},
+		{"zk:2281", true},
+		{"zk:2281", true},
+	})
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/operator-helper/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sync"
+	"time"
+)
+
+const (
+	watchEventsBufferSize = 64
+	maxWatchRetryBackoff  = time.Minute
+)
+
+// DefaultWatcher watches the bookie registrations of the reconciled clusters
+var DefaultWatcher = NewWatcher(DefaultManager)
+
+// Watcher watches the available and read-only bookie znodes of the clusters and sends an
+// event of the owning cluster on each registration change. The events are the source of the
+// controller so the cluster status follows the bookies joining and leaving zookeeper.
+type Watcher struct {
+	manager *Manager
+	events  chan event.GenericEvent
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	watches map[types.NamespacedName]*clusterWatch
+}
+
+type clusterWatch struct {
+	// target identifies the watched znodes, the cluster is watched again when they change
+	target string
+	cancel context.CancelFunc
+}
+
+// NewWatcher creates a watcher getting its zookeeper clients from the specified manager
+func NewWatcher(manager *Manager) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Watcher{
+		manager: manager,
+		events:  make(chan event.GenericEvent, watchEventsBufferSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		watches: map[types.NamespacedName]*clusterWatch{},
+	}
+}
+
+// Events returns the channel of the events of the clusters whose bookie registrations changed
+func (w *Watcher) Events() <-chan event.GenericEvent {
+	return w.events
+}
+
+// Watch starts watching the bookie registrations of the specified cluster unless already watched
+func (w *Watcher) Watch(cluster *v1alpha1.BookkeeperCluster) {
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	_, chroot := cluster.Spec.ZkEndpoints()
+	target := fmt.Sprintf("%s%s%s", ensemble(cluster), chroot, cluster.ZkLedgersRootPath())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+	if watch, ok := w.watches[key]; ok {
+		if watch.target == target {
+			return
+		}
+		watch.cancel()
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.watches[key] = &clusterWatch{target: target, cancel: cancel}
+	config.RequireRootLogger().Info("Watching the cluster bookie registrations",
+		"cluster", key, "zNodes", bookieRegistrationNodes(cluster))
+	go w.run(ctx, cluster.DeepCopy())
+}
+
+// Unwatch stops watching the bookie registrations of the specified cluster
+func (w *Watcher) Unwatch(cluster *v1alpha1.BookkeeperCluster) {
+	key := types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if watch, ok := w.watches[key]; ok {
+		watch.cancel()
+		delete(w.watches, key)
+	}
+}
+
+// Start stops all the watches when the context is done
+func (w *Watcher) Start(ctx context.Context) error {
+	<-ctx.Done()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancel()
+	w.watches = map[types.NamespacedName]*clusterWatch{}
+	return nil
+}
+
+// run watches the cluster until the context is done, setting the watches again after each
+// change and retrying with an exponential backoff when zookeeper is unreachable
+func (w *Watcher) run(ctx context.Context, cluster *v1alpha1.BookkeeperCluster) {
+	backoff := retryBackoff
+	for ctx.Err() == nil {
+		err := w.watchOnce(ctx, cluster)
+		if err == nil {
+			backoff = retryBackoff
+			continue
+		}
+		config.RequireRootLogger().Info("The cluster bookie registrations watch failed, retrying",
+			"cluster", cluster.Name, "namespace", cluster.Namespace, "after", backoff, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWatchRetryBackoff {
+			backoff = maxWatchRetryBackoff
+		}
+	}
+}
+
+// watchOnce sets the watches of the cluster and waits for one of them to fire. The connection is
+// released after, so an expired one can be redialed by the manager.
+func (w *Watcher) watchOnce(ctx context.Context, cluster *v1alpha1.BookkeeperCluster) error {
+	cl, err := w.manager.Client(cluster)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	nodes := bookieRegistrationNodes(cluster)
+	watches := make([]<-chan zk.Event, len(nodes))
+	for i, node := range nodes {
+		if watches[i], err = cl.watchChildren(node); err != nil {
+			return err
+		}
+	}
+	var ev zk.Event
+	select {
+	case <-ctx.Done():
+		return nil
+	case ev = <-watches[0]:
+	case ev = <-watches[1]:
+	}
+	// the registrations may have changed while the watch was lost too
+	w.enqueue(ctx, cluster)
+	return ev.Err
+}
+
+func (w *Watcher) enqueue(ctx context.Context, cluster *v1alpha1.BookkeeperCluster) {
+	ev := event.GenericEvent{Object: &v1alpha1.BookkeeperCluster{
+		ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: cluster.Name},
+	}}
+	select {
+	case w.events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// watchChildren sets a watch on the children of the znode, or on its creation when it does not exist yet
+func (c *Client) watchChildren(path string) (<-chan zk.Event, error) {
+	var events <-chan zk.Event
+	err := c.retry("watch", func() error {
+		for {
+			var err error
+			_, _, events, err = c.conn.ChildrenW(c.chrooted(path))
+			if !errors.Is(err, zk.ErrNoNode) {
+				return err
+			}
+			var exists bool
+			exists, _, events, err = c.conn.ExistsW(c.chrooted(path))
+			if err != nil || !exists {
+				return err
+			}
+			// created meanwhile, watch its children
+		}
+	})
+	return events, err
+}
+
+// bookieRegistrationNodes returns the znodes the bookies of the cluster register under
+func bookieRegistrationNodes(cluster *v1alpha1.BookkeeperCluster) []string {
+	available := fmt.Sprintf("%s/%s", cluster.ZkLedgersRootPath(), availableNode)
+	return []string{available, fmt.Sprintf("%s/%s", available, readOnlyNode)}
+}
@@ -17,70 +17,265 @@
 package zk
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/go-zookeeper/zk"
 	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/bookkeeper-operator/internal/metrics"
 	"github.com/monimesl/operator-helper/config"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
+	operatorMetadataNode = "operator"
+	// the legacy znodes of the operator metadata, migrated to the operator metadata znode
 	updateTimeNode = "updatedat"
 	sizeNode       = "size"
+
+	underReplicationNode = "underreplication"
+	autoRecoveryOffNode  = "disable"
+	availableNode        = "available"
+	readOnlyNode         = "readonly"
+	urLedgersNode        = "ledgers"
+	urLedgerPrefix       = "urL"
+	cookiesNode          = "cookies"
+	instanceIDNode       = "INSTANCEID"
+	layoutNode           = "LAYOUT"
+)
+
+const (
+	retryBackoff    = 200 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
 )
 
 type Client struct {
 	conn *zk.Conn
+	// chroot prefixes the paths since the client does not support the chroot of the connection string
+	chroot  string
+	retries int
+	// backoff counts the transient failures of the ensemble across the clients
+	backoff *backoff
+	// authenticated is true when the session is authenticated, the operator znodes are then
+	// writable by the operator alone
+	authenticated bool
+	// release returns the connection to the manager it is borrowed from
+	release func()
 }
 
-// UpdateMetadata update the metadata of the specified cluster
-func UpdateMetadata(cluster *v1alpha1.BookkeeperCluster) error {
-	if cl, err := NewZkClient(cluster); err != nil {
+// DeleteMetadata deletes all zNodes created by the zookeeper cluster
+func DeleteMetadata(cluster *v1alpha1.BookkeeperCluster) error {
+	if cl, err := DefaultManager.Client(cluster); err != nil {
 		return err
 	} else {
 		defer cl.Close()
-		return cl.updateClusterSizeMeta(cluster)
+		return cl.deleteNodes(cluster.ZkRootPath())
 	}
 }
 
-// DeleteMetadata deletes all zNodes created by the zookeeper cluster
-func DeleteMetadata(cluster *v1alpha1.BookkeeperCluster) error {
-	if cl, err := NewZkClient(cluster); err != nil {
-		return err
+// UpdateAutoRecoveryState enables or disables the ledger replication of the specified cluster
+// the same way "bookkeeper shell autorecovery" does. It returns false when the cluster ledgers
+// metadata is not yet initialized, in which case there is nothing to update yet.
+func UpdateAutoRecoveryState(cluster *v1alpha1.BookkeeperCluster, enabled bool) (bool, error) {
+	if cl, err := DefaultManager.Client(cluster); err != nil {
+		return false, err
 	} else {
 		defer cl.Close()
-		return cl.deleteNodes(cluster.ZkRootPath())
+		return cl.updateAutoRecoveryState(cluster, enabled)
 	}
 }
 
-// NewZkClient creates a new zookeeper client connected to the specified cluster
-func NewZkClient(cluster *v1alpha1.BookkeeperCluster) (*Client, error) {
-	address := cluster.Spec.ZkServers
-	c, _, err := zk.Connect([]string{address}, 10*time.Second)
+// dial connects to the ensemble of the specified cluster and waits for the session to be
+// established within the configured connection timeout. The session is authenticated with
+// the digest credentials and the connection is over TLS when specified. It returns the
+// connection events which follow the session establishment.
+func dial(cluster *v1alpha1.BookkeeperCluster, digest []byte,
+	tlsConfig *tls.Config, backoff *backoff) (*zk.Conn, <-chan zk.Event, error) {
+	// the chroot is applied to the paths by the client
+	servers, _ := cluster.Spec.ZkEndpoints()
+	if err := v1alpha1.ValidateZkEndpoints(servers); err != nil {
+		// not retried nor reported as the ensemble being unreachable, the connection string must be fixed
+		return nil, nil, fmt.Errorf("error on parsing the zookeeper connection string %q: %w",
+			cluster.Spec.ZkServers, err)
+	}
+	sessionTimeout := cluster.Spec.ZkSessionTimeout()
+	connect := func() (*zk.Conn, <-chan zk.Event, error) {
+		if tlsConfig == nil {
+			return zk.Connect(servers, sessionTimeout, zk.WithLogInfo(false))
+		}
+		// the servers are dialed by their hostnames for their certificates to be verified
+		return zk.Connect(servers, sessionTimeout, zk.WithLogInfo(false),
+			zk.WithDialer(tlsDialer(tlsConfig)), zk.WithHostProvider(&hostProvider{}))
+	}
+	cl := &Client{retries: int(cluster.Spec.ZkRetries()), backoff: backoff}
+	var conn *zk.Conn
+	var events <-chan zk.Event
+	err := cl.retry("connect", func() (err error) {
+		conn, events, err = connect()
+		if err != nil {
+			return err
+		}
+		if err = waitForSession(events, cluster.Spec.ZkConnectionTimeout()); err != nil {
+			conn.Close()
+			return err
+		}
+		if digest != nil {
+			// the credentials are resent by the connection on reconnect
+			if err = conn.AddAuth(string(v1alpha1.ZkAuthSchemeDigest), digest); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("error on connecting to the zookeeper servers %v: %w", servers, err)
 	}
-	return &Client{conn: c}, nil
+	return conn, events, nil
 }
 
-func (c *Client) updateClusterSizeMeta(cluster *v1alpha1.BookkeeperCluster) error {
+// waitForSession waits for the connection events to report an established session
+func waitForSession(events <-chan zk.Event, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return zk.ErrClosing
+			}
+			switch event.State {
+			case zk.StateHasSession:
+				return nil
+			case zk.StateAuthFailed:
+				return zk.ErrAuthFailed
+			}
+		case <-timer.C:
+			return fmt.Errorf("no session established within %s: %w", timeout, zk.ErrNoServer)
+		}
+	}
+}
+
+func (c *Client) updateAutoRecoveryState(cluster *v1alpha1.BookkeeperCluster, enabled bool) (bool, error) {
+	if _, err := c.getNodeState(cluster.ZkLedgersRootPath()); errors.Is(err, zk.ErrNoNode) {
+		config.RequireRootLogger().Info("The cluster ledgers metadata is not yet initialized",
+			"cluster", cluster.GetName(), "zNode", cluster.ZkLedgersRootPath())
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
 	config.RequireRootLogger().Info("Updating the BookkeeperCluster"+
-		" metadata in zookeeper", "cluster", cluster.GetName())
-	sizeZNode := clusterSizeNode(cluster)
-	updateTimeZNode := clusterUpdateTimeNode(cluster)
-	var size = int(*cluster.Spec.Size)
-	err := c.setNodeData(sizeZNode, []byte(fmt.Sprintf("%d", size)))
-	if err != nil {
-		return err
+		" autorecovery state in zookeeper", "cluster", cluster.GetName(), "enabled", enabled)
+	if enabled {
+		return true, c.deleteNode(autoRecoveryOffZNode(cluster))
+	}
+	return true, c.createNode(autoRecoveryOffZNode(cluster), []byte{})
+}
+
+// LedgersMetadataInitialized checks whether the ledgers metadata of the specified cluster is formatted,
+// i.e. the INSTANCEID and LAYOUT znodes exist under the ledgers root
+func (c *Client) LedgersMetadataInitialized(cluster *v1alpha1.BookkeeperCluster) (bool, error) {
+	for _, node := range []string{instanceIDNode, layoutNode} {
+		_, err := c.getNodeState(fmt.Sprintf("%s/%s", cluster.ZkLedgersRootPath(), node))
+		if errors.Is(err, zk.ErrNoNode) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// LedgersRootExists checks whether the ledgers root of the specified cluster exists, a ledgers
+// root without the formatted metadata is left by an interrupted or a foreign initialization
+func (c *Client) LedgersRootExists(cluster *v1alpha1.BookkeeperCluster) (bool, error) {
+	_, err := c.getNodeState(cluster.ZkLedgersRootPath())
+	if errors.Is(err, zk.ErrNoNode) {
+		return false, nil
 	}
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-	return c.setNodeData(updateTimeZNode, []byte(fmt.Sprintf("%d", now)))
+	return err == nil, err
 }
 
-// Close closes the zookeeper connection
+// CreateClusterRoot creates the root znode of the specified cluster and its parents with an open ACL,
+// the metadata initialization of bookkeeper creates the ledgers root but not its parents
+func (c *Client) CreateClusterRoot(cluster *v1alpha1.BookkeeperCluster) error {
+	return c.createPath(clusterNode(cluster))
+}
+
+// WritableBookies lists the ids of the writable bookies registered by the specified cluster
+func (c *Client) WritableBookies(cluster *v1alpha1.BookkeeperCluster) ([]string, error) {
+	children, err := c.getChildren(fmt.Sprintf("%s/%s", cluster.ZkLedgersRootPath(), availableNode))
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bookies := make([]string, 0, len(children))
+	for _, child := range children {
+		if child != readOnlyNode {
+			bookies = append(bookies, child)
+		}
+	}
+	return bookies, nil
+}
+
+// ReadOnlyBookies lists the ids of the read-only bookies registered by the specified cluster
+func (c *Client) ReadOnlyBookies(cluster *v1alpha1.BookkeeperCluster) ([]string, error) {
+	bookies, err := c.getChildren(fmt.Sprintf("%s/%s/%s", cluster.ZkLedgersRootPath(), availableNode, readOnlyNode))
+	if errors.Is(err, zk.ErrNoNode) {
+		return nil, nil
+	}
+	return bookies, err
+}
+
+// CookieExists checks whether the cookie of the specified bookie is registered
+func (c *Client) CookieExists(cluster *v1alpha1.BookkeeperCluster, bookieID string) (bool, error) {
+	_, err := c.getNodeState(cookieNode(cluster, bookieID))
+	if errors.Is(err, zk.ErrNoNode) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteCookie deletes the cookie of the specified bookie
+func (c *Client) DeleteCookie(cluster *v1alpha1.BookkeeperCluster, bookieID string) error {
+	return c.deleteNode(cookieNode(cluster, bookieID))
+}
+
+// HasUnderReplicatedLedgers checks whether the auditor has marked any ledger of the specified cluster under-replicated
+func (c *Client) HasUnderReplicatedLedgers(cluster *v1alpha1.BookkeeperCluster) (bool, error) {
+	return c.hasUnderReplicatedLedgers(fmt.Sprintf("%s/%s/%s",
+		cluster.ZkLedgersRootPath(), underReplicationNode, urLedgersNode))
+}
+
+// hasUnderReplicatedLedgers walks the hierarchical tree the
+// under-replicated ledgers are stored in, e.g. 0000/0000/0000/urL0000000001
+func (c *Client) hasUnderReplicatedLedgers(path string) (bool, error) {
+	children, err := c.getChildren(path)
+	if errors.Is(err, zk.ErrNoNode) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, child := range children {
+		if strings.HasPrefix(child, urLedgerPrefix) {
+			return true, nil
+		}
+		if found, err := c.hasUnderReplicatedLedgers(path + "/" + child); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// Close closes the zookeeper connection, or releases it when borrowed from a manager
 func (c *Client) Close() {
+	if c.release != nil {
+		c.release()
+		return
+	}
 	config.RequireRootLogger().Info("Closing the zookeeper client")
 	c.conn.Close()
 }
@@ -97,44 +292,61 @@ func clusterUpdateTimeNode(cluster *v1alpha1.BookkeeperCluster) string {
 	return fmt.Sprintf("%s/%s", clusterNode(cluster), updateTimeNode)
 }
 
-func (c *Client) setNodeData(path string, data []byte) (err error) {
-	config.RequireRootLogger().
-		Info("Creating the operator metadata node",
-			"path", path, "data", string(data))
-	stats, err := c.getNodeState(path)
-	if errors.Is(err, zk.ErrNoNode) {
-		return c.createNode(path, data)
-	} else if err != nil {
-		return err
-	}
-	if _, err = c.conn.Set(path, data, stats.Version); errors.Is(err, zk.ErrNodeExists) {
-		return nil
-	}
-	return
+func cookieNode(cluster *v1alpha1.BookkeeperCluster, bookieID string) string {
+	return fmt.Sprintf("%s/%s/%s", cluster.ZkLedgersRootPath(), cookiesNode, bookieID)
+}
+
+func autoRecoveryOffZNode(cluster *v1alpha1.BookkeeperCluster) string {
+	return fmt.Sprintf("%s/%s/%s", cluster.ZkLedgersRootPath(), underReplicationNode, autoRecoveryOffNode)
 }
 
 func (c *Client) getNodeState(clusterNode string) (*zk.Stat, error) {
-	_, sts, err := c.conn.Get(clusterNode)
+	_, sts, err := c.getNodeData(clusterNode)
+	return sts, err
+}
+
+func (c *Client) getNodeData(path string) ([]byte, *zk.Stat, error) {
+	var data []byte
+	var sts *zk.Stat
+	err := c.retry("get", func() (err error) {
+		data, sts, err = c.conn.Get(c.chrooted(path))
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return sts, nil
+	return data, sts, nil
 }
 
-func (c *Client) createNode(path string, data []byte) error {
-	path = strings.TrimPrefix(path, "/")
-	paths := strings.Split(path, "/")
-	zNodes := make([]string, len(paths))
-	for i := range paths {
-		zNodes[i] = "/" + strings.Join(paths[0:i+1], "/")
+// createNode creates the znode with the ACL of the operator znodes, unless it exists
+func (c *Client) createNode(zNode string, data []byte) error {
+	if err := c.createPath(zNode[:strings.LastIndex(zNode, "/")]); err != nil {
+		return err
 	}
-	for i, zNode := range zNodes {
-		var nodeData []byte = nil
-		if i == len(zNodes)-1 {
-			// Last node
-			nodeData = data
-		}
-		_, err := c.conn.Create(zNode, nodeData, 0, zk.WorldACL(zk.PermAll))
+	err := c.retry("create", func() error {
+		_, err := c.conn.Create(c.chrooted(zNode), data, 0, c.ownerACL())
+		return err
+	})
+	if errors.Is(err, zk.ErrNodeExists) {
+		return nil
+	}
+	return err
+}
+
+// createPath creates the missing nodes of the path, the chroot ones included. They are created
+// with an open ACL since the bookies and the other clusters create their znodes under them.
+func (c *Client) createPath(path string) error {
+	trimmed := strings.Trim(c.chrooted(path), "/")
+	if trimmed == "" {
+		return nil
+	}
+	paths := strings.Split(trimmed, "/")
+	for i := range paths {
+		zNode := "/" + strings.Join(paths[0:i+1], "/")
+		err := c.retry("create", func() error {
+			_, err := c.conn.Create(zNode, nil, 0, zk.WorldACL(zk.PermAll))
+			return err
+		})
 		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
 			return err
 		}
@@ -142,6 +354,22 @@ func (c *Client) createNode(path string, data []byte) error {
 	return nil
 }
 
+// ownerACL is the ACL of the znodes the operator owns
+func (c *Client) ownerACL() []zk.ACL {
+	if c.authenticated {
+		return zk.AuthACL(zk.PermAll)
+	}
+	return zk.WorldACL(zk.PermAll)
+}
+
+// readableACL is the ACL of the operator znodes the other tools read
+func (c *Client) readableACL() []zk.ACL {
+	if c.authenticated {
+		return append(zk.AuthACL(zk.PermAll), zk.WorldACL(zk.PermRead)...)
+	}
+	return zk.WorldACL(zk.PermAll)
+}
+
 func (c *Client) deleteNodes(paths ...string) error {
 	for _, path := range paths {
 		if err := c.deleteNode(path); err != nil {
@@ -161,7 +389,13 @@ func (c *Client) deleteNode(path string) error {
 	} else if err != nil {
 		return err
 	}
-	err = c.conn.Delete(path, stat.Version)
+	err = c.retry("delete", func() error {
+		return c.conn.Delete(c.chrooted(path), stat.Version)
+	})
+	if errors.Is(err, zk.ErrNoNode) {
+		// deleted by a retried attempt
+		return nil
+	}
 	if errors.Is(err, zk.ErrNotEmpty) {
 		children, err2 := c.getChildren(path)
 		if err2 != nil {
@@ -180,9 +414,128 @@ func (c *Client) deleteNode(path string) error {
 }
 
 func (c *Client) getChildren(path string) ([]string, error) {
-	children, _, err := c.conn.Children(path)
+	var children []string
+	err := c.retry("children", func() (err error) {
+		children, _, err = c.conn.Children(c.chrooted(path))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return children, nil
 }
+
+// chrooted returns the absolute path of the specified path within the chroot
+func (c *Client) chrooted(path string) string {
+	return c.chroot + path
+}
+
+// retry runs the zookeeper operation. A transient error is returned as a RetryError for the operation
+// to be retried after an exponential backoff by requeueing the reconciliation, rather than by blocking
+// the reconcile worker, until the ensemble fails more than the configured retries in a row.
+func (c *Client) retry(operation string, fn func() error) error {
+	if c.backoff == nil {
+		c.backoff = &backoff{}
+	}
+	start := time.Now()
+	err := fn()
+	observe(operation, start, err)
+	if err == nil {
+		c.backoff.succeeded()
+		return nil
+	}
+	if !isTransient(err) {
+		return err
+	}
+	attempt, after := c.backoff.failed()
+	if attempt > c.retries {
+		return err
+	}
+	config.RequireRootLogger().Info("Retrying the zookeeper operation",
+		"operation", operation, "attempt", attempt, "after", after, "error", err.Error())
+	return &RetryError{Operation: operation, After: after, Err: err}
+}
+
+// RetryError is a transient error of a zookeeper operation which is to be retried after the backoff
+type RetryError struct {
+	Operation string
+	After     time.Duration
+	Err       error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("the zookeeper operation %s is retried after %s: %s", e.Operation, e.After, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// backoff counts the consecutive transient failures of the operations on an ensemble
+type backoff struct {
+	mu       sync.Mutex
+	failures int
+}
+
+// failed counts a failure and returns the number of the consecutive ones with the delay to retry after
+func (b *backoff) failed() (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	after := retryBackoff
+	for i := 1; i < b.failures && after < maxRetryBackoff; i++ {
+		after *= 2
+	}
+	if after > maxRetryBackoff {
+		after = maxRetryBackoff
+	}
+	return b.failures, after
+}
+
+func (b *backoff) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// MetadataError is an error of the cluster metadata stored in zookeeper rather than of the connection
+type MetadataError struct {
+	Err error
+}
+
+func (e *MetadataError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MetadataError) Unwrap() error {
+	return e.Err
+}
+
+func metadataError(format string, args ...interface{}) error {
+	return &MetadataError{Err: fmt.Errorf(format, args...)}
+}
+
+// IsMetadataError checks whether the error is caused by the cluster metadata stored in zookeeper
+func IsMetadataError(err error) bool {
+	var metadataErr *MetadataError
+	return errors.As(err, &metadataErr)
+}
+
+// IsConnectivityError checks whether the error is caused by the zookeeper connection or session
+func IsConnectivityError(err error) bool {
+	return isTransient(err)
+}
+
+// isTransient checks whether the error is caused by the connection rather than the request
+func isTransient(err error) bool {
+	return errors.Is(err, zk.ErrNoServer) || errors.Is(err, zk.ErrConnectionClosed) ||
+		errors.Is(err, zk.ErrSessionExpired) || errors.Is(err, zk.ErrSessionMoved)
+}
+
+// observe records the latency of the zookeeper operation. A missing
+// or an existing node is an expected answer rather than a failure.
+func observe(operation string, start time.Time, err error) {
+	failed := err != nil && !errors.Is(err, zk.ErrNoNode) &&
+		!errors.Is(err, zk.ErrNodeExists) && !errors.Is(err, zk.ErrNotEmpty)
+	metrics.ObserveZkOperation(operation, time.Since(start), failed)
+}
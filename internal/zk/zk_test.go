@@ -0,0 +1,78 @@
+/*
+ * Copyright 2021 - now, the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zk
+
+import (
+	"errors"
+	"github.com/go-zookeeper/zk"
+	"github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	"github.com/monimesl/operator-helper/config"
+	"testing"
+	"time"
+)
+
+func TestDialInvalidConnectString(t *testing.T) {
+	for _, zkServers := range []string{"", "/bk", "zk-0:2181,zk_1:2181", "zk-0:port/bk"} {
+		cluster := &v1alpha1.BookkeeperCluster{Spec: v1alpha1.BookkeeperClusterSpec{ZkServers: zkServers}}
+		_, _, err := dial(cluster, nil, nil, nil)
+		if err == nil {
+			t.Errorf("dial(%q) succeeded, want an error", zkServers)
+		} else if IsConnectivityError(err) {
+			t.Errorf("dial(%q) = %v, want a non connectivity error", zkServers, err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	config.GetLogger("test")
+	cl := &Client{retries: 3, backoff: &backoff{}}
+	transient := func() error { return zk.ErrConnectionClosed }
+	for _, after := range []time.Duration{retryBackoff, 2 * retryBackoff, 4 * retryBackoff} {
+		err := cl.retry("get", transient)
+		retry := &RetryError{}
+		if !errors.As(err, &retry) || retry.After != after {
+			t.Fatalf("retry() = %v, want a retry after %s", err, after)
+		}
+		if !IsConnectivityError(err) {
+			t.Errorf("retry() = %v, want a connectivity error", err)
+		}
+	}
+	// the retries are exhausted
+	if err := cl.retry("get", transient); !errors.Is(err, zk.ErrConnectionClosed) || errors.As(err, new(*RetryError)) {
+		t.Errorf("retry() = %v, want the transient error", err)
+	}
+	if err := cl.retry("get", func() error { return zk.ErrNoNode }); err != zk.ErrNoNode {
+		t.Errorf("retry() = %v, want the non transient error", err)
+	}
+	if err := cl.retry("get", func() error { return nil }); err != nil {
+		t.Errorf("retry() = %v, want no error", err)
+	}
+	// the success resets the backoff
+	if err := cl.retry("get", transient); !errors.As(err, new(*RetryError)) {
+		t.Errorf("retry() = %v, want a retry", err)
+	}
+}
+
+func TestBackoffMax(t *testing.T) {
+	b := &backoff{}
+	for i := 0; i < 100; i++ {
+		b.failed()
+	}
+	if _, after := b.failed(); after != maxRetryBackoff {
+		t.Errorf("backoff.failed() = %s, want %s", after, maxRetryBackoff)
+	}
+}
@@ -19,6 +19,8 @@ package main
 import (
 	"github.com/monimesl/bookkeeper-operator/internal"
 	"github.com/monimesl/bookkeeper-operator/internal/controller"
+	"github.com/monimesl/bookkeeper-operator/internal/controller/bookkeepercluster"
+	"github.com/monimesl/bookkeeper-operator/internal/zk"
 	"github.com/monimesl/operator-helper/config"
 	"github.com/monimesl/operator-helper/reconciler"
 	"github.com/monimesl/operator-helper/webhook"
@@ -27,6 +29,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	bookkeeperv1alpha1 "github.com/monimesl/bookkeeper-operator/api/v1alpha1"
+	bookkeeperv1beta1 "github.com/monimesl/bookkeeper-operator/api/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -41,6 +44,7 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(bookkeeperv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(bookkeeperv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -50,14 +54,29 @@ func main() {
 	if err != nil {
 		log.Fatalf("manager create error: %s", err)
 	}
+	bookkeeperv1alpha1.SetWebhookClusterReader(mgr.GetAPIReader())
 	if err = webhook.Configure(mgr,
 		&bookkeeperv1alpha1.BookkeeperCluster{}); err != nil {
 		log.Fatalf("webhook config error: %s", err)
 	}
+	executor, err := bookkeepercluster.NewPodExecutor(mgr.GetConfig())
+	if err != nil {
+		log.Fatalf("pod executor create error: %s", err)
+	}
 	if err = reconciler.Configure(mgr,
-		&controller.BookkeeperClusterReconciler{}); err != nil {
+		&controller.BookkeeperClusterReconciler{
+			Recorder: mgr.GetEventRecorderFor(internal.OperatorName),
+			Executor: executor,
+		}); err != nil {
 		log.Fatalf("reconciler cfg error: %s", err)
 	}
+	zk.DefaultManager.SetReader(mgr.GetAPIReader())
+	if err = mgr.Add(zk.DefaultManager); err != nil {
+		log.Fatalf("zookeeper manager add error: %s", err)
+	}
+	if err = mgr.Add(zk.DefaultWatcher); err != nil {
+		log.Fatalf("zookeeper watcher add error: %s", err)
+	}
 	if err = mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		log.Fatalf("operator start error: %s", err)
 	}